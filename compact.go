@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"time"
+)
+
+// compactEvery compacts the collections of tde one after the other, each
+// period, until the engine is closed. Collections with nothing to reclaim
+// are left alone, as compacting stops every read and write meanwhile.
+func compactEvery(tde *kv.TiedotEngine, period time.Duration) {
+	for _ = range time.Tick(period) {
+		if tde.Check() != nil {
+			return
+		}
+		stats, err := tde.Stats()
+		if err != nil {
+			log.Errorf("Failure listing collections to compact err=%v", err)
+			continue
+		}
+		for _, s := range stats {
+			if !s.Reclaimable() {
+				log.V(2).Infof("Nothing to compact in collection=%s", s.Name)
+				continue
+			}
+			if _, _, err := tde.Compact(s.Name); err != nil {
+				log.Errorf("Failure compacting collection=%s err=%v", s.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// Package config loads LWS settings from a YAML or TOML file, overlays
+// environment variables and command line flags on top, and hands each service
+// its own typed section.
+//
+// A section is any pointer to a struct whose fields carry a `config` tag.
+// Sections are registered from init functions so that their flags exist
+// before flag.Parse is called:
+//
+//	type Config struct {
+//		Base string `config:"base" usage:"Base URL for the shortener"`
+//	}
+//
+//	func init() { config.Register("short", &conf) }
+//
+// The field above can be set with `base` in the `short` table of the config
+// file, with the LWS_SHORT_BASE environment variable, or with the -short-base
+// flag, in increasing order of precedence. Fields of the section named "" live
+// at the top level of the file. A `flag` tag overrides the flag name; if that
+// flag is already defined elsewhere (the log flags, for instance) the field
+// mirrors it instead of defining a new one, and `flag:"-"` disables the flag.
+//
+// Sections implementing Validator are checked once everything is merged.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is prepended to the name of every environment variable.
+const EnvPrefix = "LWS_"
+
+// File is the -config flag, the path of the config file used by Parse.
+var File = flag.String("config", "", "Path to a YAML or TOML config file")
+
+// Validator is implemented by sections that can check their own settings.
+type Validator interface {
+	Validate() error
+}
+
+type field struct {
+	key     string
+	env     string
+	flag    string
+	foreign bool // flag is owned by another package, push values into it
+	touched bool // set from the file or the environment
+	v       reflect.Value
+}
+
+type section struct {
+	name   string
+	ptr    interface{}
+	fields []*field
+}
+
+var sections []*section
+
+// pending holds the command line value of a flag defined by Register. Values
+// are only applied in Load, after the file and the environment.
+type pending struct {
+	def string
+	val *string
+}
+
+func (p *pending) String() string {
+	if p.val == nil {
+		return p.def
+	}
+	return *p.val
+}
+
+func (p *pending) Set(s string) error {
+	p.val = &s
+	return nil
+}
+
+type boolPending struct{ pending }
+
+func (b *boolPending) IsBoolFlag() bool { return true }
+
+// Register adds a config section called name, backed by ptr, which must be a
+// pointer to a struct. The current contents of the struct are the defaults.
+// Register panics on misuse, so it should be called from init.
+func Register(name string, ptr interface{}) {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic("config: section " + name + " must be a pointer to a struct")
+	}
+	for _, s := range sections {
+		if s.name == name {
+			panic("config: section " + name + " registered twice")
+		}
+	}
+	sec := &section{name: name, ptr: ptr}
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := sf.Tag.Get("config")
+		if key == "" || key == "-" {
+			continue
+		}
+		f := &field{
+			key:  key,
+			env:  EnvPrefix + envName(qualify(name, key, "_")),
+			flag: qualify(name, key, "-"),
+			v:    v.Field(i),
+		}
+		if fname := sf.Tag.Get("flag"); fname != "" {
+			f.flag = fname
+		}
+		switch {
+		case f.flag == "-":
+			f.flag = ""
+		case flag.Lookup(f.flag) != nil:
+			f.foreign = true
+			if err := set(f.v, flag.Lookup(f.flag).Value.String()); err != nil {
+				panic(fmt.Sprintf("config: cannot mirror flag -%s: %v", f.flag, err))
+			}
+		default:
+			p := pending{def: format(f.v)}
+			if f.v.Kind() == reflect.Bool {
+				flag.Var(&boolPending{p}, f.flag, sf.Tag.Get("usage"))
+			} else {
+				flag.Var(&p, f.flag, sf.Tag.Get("usage"))
+			}
+		}
+		sec.fields = append(sec.fields, f)
+	}
+	sections = append(sections, sec)
+}
+
+// Parse parses the command line flags and then calls Load with the -config
+// flag.
+func Parse() error {
+	flag.Parse()
+	return Load(*File)
+}
+
+// Load merges the config file at path (skipped if path is empty), the
+// environment and the command line flags into every registered section, then
+// validates them. The file format is picked from its extension: .yaml, .yml
+// or .toml.
+func Load(path string) error {
+	if path != "" {
+		raw, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		if err := apply(raw); err != nil {
+			return fmt.Errorf("config: %s: %v", path, err)
+		}
+	}
+	for _, s := range sections {
+		for _, f := range s.fields {
+			if env := os.Getenv(f.env); env != "" {
+				if err := set(f.v, env); err != nil {
+					return fmt.Errorf("config: $%s: %v", f.env, err)
+				}
+				f.touched = true
+			}
+		}
+	}
+	var err error
+	flag.Visit(func(fl *flag.Flag) {
+		for _, s := range sections {
+			for _, f := range s.fields {
+				if err != nil || f.flag != fl.Name {
+					continue
+				}
+				if e := set(f.v, fl.Value.String()); e != nil {
+					err = fmt.Errorf("config: -%s: %v", fl.Name, e)
+				}
+				f.touched = false
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range sections {
+		for _, f := range s.fields {
+			if f.foreign && f.touched {
+				if err := flag.Set(f.flag, format(f.v)); err != nil {
+					return fmt.Errorf("config: %s: cannot apply to -%s: %v", s.label(f), f.flag, err)
+				}
+			}
+		}
+		if v, ok := s.ptr.(Validator); ok {
+			if err := v.Validate(); err != nil {
+				return fmt.Errorf("config: invalid %s section: %v", s.title(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var y map[interface{}]interface{}
+		if err = yaml.Unmarshal(b, &y); err == nil {
+			raw = normalize(y).(map[string]interface{})
+		}
+	case ".toml":
+		_, err = toml.Decode(string(b), &raw)
+	default:
+		return nil, fmt.Errorf("config: %s: unknown file type, want .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %v", path, err)
+	}
+	return raw, nil
+}
+
+// normalize turns the map[interface{}]interface{} produced by the YAML
+// decoder into map[string]interface{} like the TOML decoder produces.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+	}
+	return v
+}
+
+func apply(raw map[string]interface{}) error {
+	for k, v := range raw {
+		if s := lookup(k); s != nil {
+			if v == nil {
+				delete(raw, k) // an empty table
+				continue
+			}
+			table, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be a table", k)
+			}
+			if err := s.apply(table); err != nil {
+				return err
+			}
+			delete(raw, k)
+		}
+	}
+	if top := lookup(""); top != nil {
+		return top.apply(raw)
+	}
+	for k := range raw {
+		return fmt.Errorf("unknown key %s", k)
+	}
+	return nil
+}
+
+func (s *section) apply(table map[string]interface{}) error {
+	for k, v := range table {
+		f := s.field(k)
+		if f == nil {
+			return fmt.Errorf("unknown key %s", qualify(s.name, k, "."))
+		}
+		if v == nil {
+			continue
+		}
+		if err := set(f.v, v); err != nil {
+			return fmt.Errorf("%s: %v", s.label(f), err)
+		}
+		f.touched = true
+	}
+	return nil
+}
+
+func lookup(name string) *section {
+	for _, s := range sections {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *section) field(key string) *field {
+	for _, f := range s.fields {
+		if f.key == key {
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *section) label(f *field) string {
+	return qualify(s.name, f.key, ".")
+}
+
+func (s *section) title() string {
+	if s.name == "" {
+		return "top-level"
+	}
+	return s.name
+}
+
+func qualify(name, key, sep string) string {
+	if name == "" {
+		return key
+	}
+	return name + sep + key
+}
+
+func envName(s string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(s))
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set stores raw into v. Strings (from flags and the environment) are parsed
+// according to the kind of v; anything else comes from a config file and is
+// either a list or a scalar that is parsed from its printed form.
+func set(v reflect.Value, raw interface{}) error {
+	if list, ok := raw.([]interface{}); ok {
+		if v.Kind() != reflect.Slice {
+			return fmt.Errorf("got a list, want %s", v.Type())
+		}
+		s := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, e := range list {
+			if err := set(s.Index(i), e); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	str, ok := raw.(string)
+	if !ok {
+		if _, isMap := raw.(map[string]interface{}); isMap {
+			return fmt.Errorf("got a table, want %s", v.Type())
+		}
+		str = fmt.Sprint(raw)
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", str)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(str, 0, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", str)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(str, 0, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", str)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", str)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		parts := strings.Split(str, ",")
+		if str == "" {
+			parts = nil
+		}
+		list := make([]interface{}, len(parts))
+		for i, p := range parts {
+			list[i] = strings.TrimSpace(p)
+		}
+		return set(v, list)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// format prints v the way set parses it.
+func format(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	if v.Kind() == reflect.Slice {
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = format(v.Index(i))
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSection struct {
+	Base    string        `config:"base" usage:"base URL"`
+	Workers int           `config:"workers"`
+	Enabled bool          `config:"enabled"`
+	Timeout time.Duration `config:"timeout"`
+	Hosts   []string      `config:"hosts"`
+	Ignored string
+}
+
+func (t *testSection) Validate() error {
+	if t.Workers < 0 {
+		return errors.New("workers must not be negative")
+	}
+	return nil
+}
+
+type topSection struct {
+	Port string `config:"port" flag:"-"`
+}
+
+// reset forgets every registered section so each test starts clean. Flag
+// names must still be unique across tests since flag.CommandLine is global.
+func reset() {
+	sections = nil
+}
+
+func writeFile(t *testing.T, name, body string) string {
+	dir, err := ioutil.TempDir("", "lws-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestYAML(t *testing.T) {
+	reset()
+	sec := &testSection{Base: "http://localhost/", Workers: 1}
+	top := &topSection{Port: ":3000"}
+	Register("yaml", sec)
+	Register("", top)
+	p := writeFile(t, "lws.yaml", `
+port: ":4000"
+yaml:
+  base: http://example.com/
+  workers: 4
+  enabled: true
+  timeout: 5s
+  hosts: [a, b]
+`)
+	defer os.RemoveAll(filepath.Dir(p))
+	if err := Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if sec.Base != "http://example.com/" || sec.Workers != 4 || !sec.Enabled {
+		t.Errorf("unexpected section %+v", sec)
+	}
+	if sec.Timeout != 5*time.Second {
+		t.Errorf("Timeout=%v, want 5s", sec.Timeout)
+	}
+	if len(sec.Hosts) != 2 || sec.Hosts[1] != "b" {
+		t.Errorf("Hosts=%v, want [a b]", sec.Hosts)
+	}
+	if top.Port != ":4000" {
+		t.Errorf("Port=%q, want :4000", top.Port)
+	}
+}
+
+func TestTOML(t *testing.T) {
+	reset()
+	sec := &testSection{}
+	Register("toml", sec)
+	p := writeFile(t, "lws.toml", "[toml]\nbase = \"http://example.org/\"\nworkers = 2\n")
+	defer os.RemoveAll(filepath.Dir(p))
+	if err := Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if sec.Base != "http://example.org/" || sec.Workers != 2 {
+		t.Errorf("unexpected section %+v", sec)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	reset()
+	sec := &testSection{Base: "default", Workers: 1}
+	Register("prec", sec)
+	p := writeFile(t, "lws.yml", "prec:\n  base: file\n  workers: 2\n  enabled: true\n")
+	defer os.RemoveAll(filepath.Dir(p))
+
+	os.Setenv("LWS_PREC_WORKERS", "3")
+	defer os.Setenv("LWS_PREC_WORKERS", "")
+	if err := flag.Set("prec-base", "flag"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if sec.Base != "flag" {
+		t.Errorf("Base=%q, flag should win over the file", sec.Base)
+	}
+	if sec.Workers != 3 {
+		t.Errorf("Workers=%d, environment should win over the file", sec.Workers)
+	}
+	if !sec.Enabled {
+		t.Errorf("Enabled should come from the file")
+	}
+}
+
+func TestMirrorForeignFlag(t *testing.T) {
+	reset()
+	owned := flag.Int("mirror_level", 7, "flag owned by another package")
+	sec := &struct {
+		Level int `config:"level" flag:"mirror_level"`
+	}{}
+	Register("mirror", sec)
+	if sec.Level != 7 {
+		t.Errorf("Level=%d, want the flag's current value 7", sec.Level)
+	}
+	p := writeFile(t, "lws.yaml", "mirror:\n  level: 2\n")
+	defer os.RemoveAll(filepath.Dir(p))
+	if err := Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if *owned != 2 {
+		t.Errorf("mirrored flag=%d, want 2 from the file", *owned)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, c := range []struct {
+		name, body, want string
+	}{
+		{"unknown.yaml", "errs:\n  bse: x\n", "unknown key errs.bse"},
+		{"toplevel.yaml", "nope: 1\n", "unknown key nope"},
+		{"type.yaml", "errs:\n  workers: many\n", `errs.workers: invalid integer "many"`},
+		{"table.yaml", "errs: 3\n", "errs must be a table"},
+		{"invalid.yaml", "errs:\n  workers: -1\n", "invalid errs section: workers must not be negative"},
+		{"lws.ini", "", "unknown file type"},
+	} {
+		reset()
+		Register("errs", &testSection{})
+		p := writeFile(t, c.name, c.body)
+		err := Load(p)
+		os.RemoveAll(filepath.Dir(p))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: err=%v, want it to mention %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	reset()
+	Register("twice", &testSection{})
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a section twice should panic")
+		}
+	}()
+	Register("twice", &struct{}{})
+}
@@ -1,53 +1,63 @@
-// Package base62 implements conversion to and from base62. Useful for url shorteners.
+// Package base62 implements conversion to and from base62, and other
+// positional encodings such as base58 and base36. Useful for url shorteners.
 package base62
 
 import (
-	"bytes"
-	"math"
+	"errors"
+	"strconv"
 )
 
-// characters used for conversion
-const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// Predefined encodings.
+var (
+	// Base62 uses digits, then lower case, then upper case letters.
+	Base62 = NewEncoding("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
-// converts number to base62
-func EncodeInt(number int64) string {
-	if number == 0 {
-		return string(alphabet[0])
-	}
+	// Base58 is the Bitcoin alphabet, which leaves out 0, O, I and l.
+	Base58 = NewEncoding("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz")
 
-	chars := make([]byte, 0)
+	// Base36 uses digits and lower case letters, and decodes either case.
+	Base36 = NewEncoding("0123456789abcdefghijklmnopqrstuvwxyz").foldCase()
 
-	length := int64(len(alphabet))
+	// Crockford32 is Douglas Crockford's base32, which leaves out I, L, O
+	// and U. It decodes either case, and reads I and L as 1 and O as 0.
+	Crockford32 = NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").foldCase().
+			alias('I', '1').alias('i', '1').alias('L', '1').alias('l', '1').
+			alias('O', '0').alias('o', '0')
+)
 
-	for number > 0 {
-		result := number / length
-		remainder := number % length
-		chars = append(chars, alphabet[remainder])
-		number = result
-	}
+// StdEncoding is the encoding used by the package level functions.
+var StdEncoding = Base62
 
-	for i, j := 0, len(chars)-1; i < j; i, j = i+1, j-1 {
-		chars[i], chars[j] = chars[j], chars[i]
-	}
+// ErrEmpty is returned when decoding an empty number.
+var ErrEmpty = errors.New("base62: empty input")
+
+// ErrOverflow is returned when a token encodes a number that does not fit the
+// requested type.
+var ErrOverflow = errors.New("base62: value out of range")
+
+// CorruptInputError is returned when a token contains a character outside the
+// alphabet. Its value is the offset of that character.
+type CorruptInputError int64
 
-	return string(chars)
+func (e CorruptInputError) Error() string {
+	return "base62: illegal character at input byte " + strconv.FormatInt(int64(e), 10)
 }
 
-// converts base62 token to int
+// converts number to base62, negative numbers get a leading '-'
+func EncodeInt(number int64) string {
+	return StdEncoding.EncodeInt64(number)
+}
+
+// Decode converts a base62 token, as produced by EncodeInt, back to a number.
+func Decode(token string) (int64, error) {
+	return StdEncoding.DecodeInt64(token)
+}
+
+// converts base62 token to int, returns 0 for tokens Decode rejects
 func DecodeString(token string) int64 {
-	var number int64
-	idx := 0.0
-	chars := []byte(alphabet)
-
-	charsLength := float64(len(chars))
-	tokenLength := float64(len(token))
-
-	for _, c := range []byte(token) {
-		power := tokenLength - (idx + 1)
-		index := bytes.IndexByte(chars, c)
-		number += int64(index * int(math.Pow(charsLength, power)))
-		idx++
+	n, err := Decode(token)
+	if err != nil {
+		return 0
 	}
-
-	return number
+	return n
 }
@@ -1,8 +1,14 @@
 package base62
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
 	"testing"
+	"testing/quick"
 )
 
 func TestReciprocal(t *testing.T) {
@@ -41,3 +47,121 @@ func TestDecode(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestBounds(t *testing.T) {
+	for _, c := range []struct {
+		n     int64
+		token string
+	}{
+		{math.MaxInt64, "aZl8N0y58M7"},
+		{math.MinInt64, "-aZl8N0y58M8"},
+		{-1, "-1"},
+		{-99, "-1B"},
+		{1 << 53, "FfGNdXsE8"},
+		{1<<53 + 1, "FfGNdXsE9"},
+	} {
+		if got := EncodeInt(c.n); got != c.token {
+			t.Errorf("EncodeInt(%d)=%q, want %q", c.n, got, c.token)
+		}
+		got, err := Decode(c.token)
+		if err != nil || got != c.n {
+			t.Errorf("Decode(%q)=%d, %v, want %d", c.token, got, err, c.n)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, c := range []struct {
+		token string
+		err   error
+	}{
+		{"", ErrEmpty},
+		{"-", CorruptInputError(1)},
+		{"ab_c", CorruptInputError(2)},
+		{"1-", CorruptInputError(1)},
+		{"é", CorruptInputError(0)},
+		{"aZl8N0y58M8", ErrOverflow},
+		{"-aZl8N0y58M9", ErrOverflow},
+		{"100000000000", ErrOverflow},
+		{"zzzzzzzzzzzzzzzzzzzzzzzz", ErrOverflow},
+	} {
+		if _, err := Decode(c.token); err != c.err {
+			t.Errorf("Decode(%q) err=%v, want %v", c.token, err, c.err)
+		}
+	}
+	if DecodeString("ab_c") != 0 {
+		t.Error("DecodeString should return 0 for an invalid token")
+	}
+}
+
+// TestQuickRoundTrip fuzzes EncodeInt/Decode over the full int64 range.
+func TestQuickRoundTrip(t *testing.T) {
+	f := func(n int64) bool {
+		got, err := Decode(EncodeInt(n))
+		return err == nil && got == n
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 100000}); err != nil {
+		t.Error(err)
+	}
+	// quick favours small magnitudes, so also walk every bit width
+	for shift := uint(0); shift < 64; shift++ {
+		for _, n := range []int64{1 << shift, 1<<shift - 1, -(1 << shift), -(1 << shift) + 1} {
+			if !f(n) {
+				t.Errorf("round trip failed for %d", n)
+			}
+		}
+	}
+}
+
+// TestQuickDecode fuzzes Decode with arbitrary strings: it must either fail
+// or return a number that encodes back to the same token.
+func TestQuickDecode(t *testing.T) {
+	f := func(token string) bool {
+		n, err := Decode(token)
+		if err != nil {
+			return true
+		}
+		canonical := strings.TrimLeft(strings.TrimPrefix(token, "-"), "0")
+		if canonical == "" {
+			return n == 0
+		}
+		if token[0] == '-' {
+			canonical = "-" + canonical
+		}
+		return EncodeInt(n) == canonical
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 100000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkB62Decode(b *testing.B) {
+	token := EncodeInt(math.MaxInt64)
+	for i := 0; i < b.N; i++ {
+		Decode(token)
+	}
+}
+
+var streamData = bytes.Repeat([]byte("legowebservices streams "), 1<<14)
+
+func BenchmarkB62StreamEncode(b *testing.B) {
+	b.SetBytes(int64(len(streamData)))
+	for i := 0; i < b.N; i++ {
+		e := NewEncoder(ioutil.Discard)
+		e.Write(streamData)
+		e.Close()
+	}
+}
+
+func BenchmarkB62StreamDecode(b *testing.B) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.Write(streamData)
+	e.Close()
+	encoded := buf.Bytes()
+	b.SetBytes(int64(len(streamData)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		io.Copy(ioutil.Discard, NewDecoder(bytes.NewReader(encoded)))
+	}
+}
@@ -0,0 +1,302 @@
+package base62
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// An Encoding is a positional number system defined by an alphabet, the
+// first character of which is the zero digit. Like encoding/base64, an
+// Encoding is safe for concurrent use once created.
+//
+// Numbers are written most significant digit first, negative ones with a
+// leading '-'. Byte slices are treated as big-endian numbers, with each
+// leading zero byte written as one zero digit, the way Bitcoin's base58
+// keeps them.
+type Encoding struct {
+	alphabet  string
+	base      uint64
+	decodeMap [256]int8
+
+	// a uint64 holds chunk digits, and bigChunk is base**chunk; big numbers
+	// are converted a chunk at a time
+	chunk    int
+	bigChunk *big.Int
+
+	// streams are encoded in blocks of up to blockSize bytes; blockWidth
+	// is the number of digits for a block of each length, and blockLen
+	// maps it back (-1 where no block has that width)
+	blockWidth [blockSize + 1]int
+	blockLen   [8*blockSize + 1]int8
+}
+
+// NewEncoding returns an Encoding for the given alphabet. The alphabet must
+// have between 2 and 128 distinct printable ASCII characters, and may not
+// contain '-'.
+func NewEncoding(alphabet string) *Encoding {
+	if len(alphabet) < 2 || len(alphabet) > 128 {
+		panic("base62: alphabet must have between 2 and 128 characters")
+	}
+	enc := &Encoding{alphabet: alphabet, base: uint64(len(alphabet))}
+	for i := range enc.decodeMap {
+		enc.decodeMap[i] = -1
+	}
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if c <= ' ' || c > '~' || c == '-' {
+			panic("base62: invalid character " + strconv.Quote(string(c)) + " in alphabet")
+		}
+		if enc.decodeMap[c] != -1 {
+			panic("base62: duplicate character " + strconv.Quote(string(c)) + " in alphabet")
+		}
+		enc.decodeMap[c] = int8(i)
+	}
+	max := uint64(math.MaxUint64) / enc.base
+	for p := uint64(1); p <= max; p *= enc.base {
+		enc.chunk++
+	}
+	enc.bigChunk = new(big.Int).Exp(big.NewInt(int64(enc.base)), big.NewInt(int64(enc.chunk)), nil)
+	for i := range enc.blockLen {
+		enc.blockLen[i] = -1
+	}
+	for k := 1; k <= blockSize; k++ {
+		max := uint64(math.MaxUint64) >> uint(64-8*k)
+		enc.blockWidth[k] = len(enc.EncodeUint64(max))
+		enc.blockLen[enc.blockWidth[k]] = int8(k)
+	}
+	return enc
+}
+
+// alias makes from decode to the same value as to, for alphabets that accept
+// several spellings of a digit.
+func (enc *Encoding) alias(from, to byte) *Encoding {
+	enc.decodeMap[from] = enc.decodeMap[to]
+	return enc
+}
+
+// foldCase makes the upper and lower case forms of every letter in the
+// alphabet decode to the same value.
+func (enc *Encoding) foldCase() *Encoding {
+	for i := 0; i < len(enc.alphabet); i++ {
+		c := enc.alphabet[i]
+		switch {
+		case 'a' <= c && c <= 'z':
+			enc.alias(c-'a'+'A', c)
+		case 'A' <= c && c <= 'Z':
+			enc.alias(c-'A'+'a', c)
+		}
+	}
+	return enc
+}
+
+// Alphabet returns the characters of the encoding, zero digit first.
+func (enc *Encoding) Alphabet() string {
+	return enc.alphabet
+}
+
+// EncodeUint64 returns the encoding of n.
+func (enc *Encoding) EncodeUint64(n uint64) string {
+	var buf [64]byte
+	return string(enc.appendUint64(buf[:0], n, 0))
+}
+
+// EncodeInt64 returns the encoding of n.
+func (enc *Encoding) EncodeInt64(n int64) string {
+	var buf [65]byte
+	if n >= 0 {
+		return string(enc.appendUint64(buf[:0], uint64(n), 0))
+	}
+	// negating in uint64 keeps math.MinInt64 intact
+	return string(enc.appendUint64(append(buf[:0], '-'), -uint64(n), 0))
+}
+
+// appendUint64 appends the digits of n to dst, left padded with zero digits to
+// at least width characters.
+func (enc *Encoding) appendUint64(dst []byte, n uint64, width int) []byte {
+	var buf [64]byte
+	i := len(buf)
+	for n > 0 || i == len(buf) || len(buf)-i < width {
+		i--
+		buf[i] = enc.alphabet[n%enc.base]
+		n /= enc.base
+	}
+	return append(dst, buf[i:]...)
+}
+
+// DecodeUint64 returns the number encoded by s.
+func (enc *Encoding) DecodeUint64(s string) (uint64, error) {
+	if len(s) == 0 {
+		return 0, ErrEmpty
+	}
+	return enc.decodeUint64(s, 0, math.MaxUint64)
+}
+
+// DecodeInt64 returns the number encoded by s.
+func (enc *Encoding) DecodeInt64(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, ErrEmpty
+	}
+	if s[0] != '-' {
+		n, err := enc.decodeUint64(s, 0, math.MaxInt64)
+		return int64(n), err
+	}
+	if len(s) == 1 {
+		return 0, CorruptInputError(1)
+	}
+	// |math.MinInt64| is one more than math.MaxInt64
+	n, err := enc.decodeUint64(s, 1, math.MaxInt64+1)
+	return -int64(n), err
+}
+
+// decodeUint64 decodes s[start:], failing with ErrOverflow above limit.
+func (enc *Encoding) decodeUint64(s string, start int, limit uint64) (uint64, error) {
+	var n uint64
+	for i := start; i < len(s); i++ {
+		d := enc.decodeMap[s[i]]
+		if d < 0 {
+			return 0, CorruptInputError(i)
+		}
+		if n > (limit-uint64(d))/enc.base {
+			return 0, ErrOverflow
+		}
+		n = n*enc.base + uint64(d)
+	}
+	return n, nil
+}
+
+// EncodeBig returns the encoding of n.
+func (enc *Encoding) EncodeBig(n *big.Int) string {
+	var dst []byte
+	if n.Sign() < 0 {
+		dst = append(dst, '-')
+	}
+	return string(enc.appendBig(dst, new(big.Int).Abs(n)))
+}
+
+// appendBig appends the digits of n, which must not be negative, to dst. n is
+// overwritten.
+func (enc *Encoding) appendBig(dst []byte, n *big.Int) []byte {
+	// peel off chunks from the least significant end, then write them out
+	// most significant first
+	var chunks []uint64
+	r := new(big.Int)
+	for n.Cmp(enc.bigChunk) >= 0 {
+		n.QuoRem(n, enc.bigChunk, r)
+		chunks = append(chunks, r.Uint64())
+	}
+	dst = enc.appendUint64(dst, n.Uint64(), 0)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		dst = enc.appendUint64(dst, chunks[i], enc.chunk)
+	}
+	return dst
+}
+
+// DecodeBig returns the number encoded by s.
+func (enc *Encoding) DecodeBig(s string) (*big.Int, error) {
+	if len(s) == 0 {
+		return nil, ErrEmpty
+	}
+	start := 0
+	if s[0] == '-' {
+		if len(s) == 1 {
+			return nil, CorruptInputError(1)
+		}
+		start = 1
+	}
+	n, err := enc.decodeBig(s, start)
+	if err != nil {
+		return nil, err
+	}
+	if start == 1 {
+		n.Neg(n)
+	}
+	return n, nil
+}
+
+// decodeBig decodes s[start:] a chunk of digits at a time.
+func (enc *Encoding) decodeBig(s string, start int) (*big.Int, error) {
+	n, word, scale := new(big.Int), new(big.Int), new(big.Int)
+	for i := start; i < len(s); i += enc.chunk {
+		end := i + enc.chunk
+		if end > len(s) {
+			end = len(s)
+		}
+		v, err := enc.decodeUint64(s[:end], i, math.MaxUint64)
+		if err != nil {
+			return nil, err
+		}
+		if end-i == enc.chunk {
+			scale.Set(enc.bigChunk)
+		} else {
+			scale.Exp(big.NewInt(int64(enc.base)), big.NewInt(int64(end-i)), nil)
+		}
+		n.Mul(n, scale)
+		n.Add(n, word.SetUint64(v))
+	}
+	return n, nil
+}
+
+// EncodeToString returns the encoding of src.
+func (enc *Encoding) EncodeToString(src []byte) string {
+	return string(enc.encode(nil, src))
+}
+
+// EncodedLen returns the maximum length of the encoding of n bytes.
+func (enc *Encoding) EncodedLen(n int) int {
+	return int(math.Ceil(float64(n)*8/math.Log2(float64(enc.base)))) + 1
+}
+
+// Encode encodes src into dst, which must hold at least EncodedLen(len(src))
+// bytes, and returns the number of bytes written.
+func (enc *Encoding) Encode(dst, src []byte) int {
+	return copy(dst, enc.encode(dst[:0], src))
+}
+
+func (enc *Encoding) encode(dst, src []byte) []byte {
+	zeros := 0
+	for zeros < len(src) && src[zeros] == 0 {
+		dst = append(dst, enc.alphabet[0])
+		zeros++
+	}
+	if zeros == len(src) {
+		return dst
+	}
+	return enc.appendBig(dst, new(big.Int).SetBytes(src[zeros:]))
+}
+
+// DecodeString returns the bytes encoded by s.
+func (enc *Encoding) DecodeString(s string) ([]byte, error) {
+	return enc.decode(nil, s)
+}
+
+// DecodedLen returns the maximum number of bytes decoded from n characters.
+func (enc *Encoding) DecodedLen(n int) int {
+	return n
+}
+
+// Decode decodes src into dst, which must hold at least
+// DecodedLen(len(src)) bytes, and returns the number of bytes written.
+func (enc *Encoding) Decode(dst, src []byte) (int, error) {
+	b, err := enc.decode(dst[:0], string(src))
+	if err != nil {
+		return 0, err
+	}
+	return copy(dst, b), nil
+}
+
+func (enc *Encoding) decode(dst []byte, s string) ([]byte, error) {
+	zeros := 0
+	for zeros < len(s) && enc.decodeMap[s[zeros]] == 0 {
+		dst = append(dst, 0)
+		zeros++
+	}
+	if zeros == len(s) {
+		return dst, nil
+	}
+	n, err := enc.decodeBig(s, zeros)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, n.Bytes()...), nil
+}
@@ -0,0 +1,179 @@
+package base62
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"math/big"
+	"testing"
+	"testing/quick"
+)
+
+var encodings = map[string]*Encoding{
+	"Base62":      Base62,
+	"Base58":      Base58,
+	"Base36":      Base36,
+	"Crockford32": Crockford32,
+	"binary":      NewEncoding("01"),
+}
+
+// Test vectors from Bitcoin Core's base58_encode_decode.json.
+var base58Vectors = []struct{ hex, enc string }{
+	{"", ""},
+	{"61", "2g"},
+	{"626262", "a3gV"},
+	{"636363", "aPEr"},
+	{"73696d706c792061206c6f6e6720737472696e67", "2cFupjhnEsSn59qHXstmK2ffpLv2"},
+	{"00eb15231dfceb60925886b67d065299925915aeb172c06647", "1NS17iag9jJgTHD1VXjvLCEnZuQ3rJDE9L"},
+	{"516b6fcd0f", "ABnLTmg"},
+	{"bf4f89001e670274dd", "3SEo3LWLoPntC"},
+	{"572e4794", "3EFU7m"},
+	{"ecac89cad93923c02321", "EJDM8drfXA6uyA"},
+	{"10c8511e", "Rt5zm"},
+	{"00000000000000000000", "1111111111"},
+}
+
+func TestBase58Vectors(t *testing.T) {
+	for _, v := range base58Vectors {
+		src, _ := hex.DecodeString(v.hex)
+		if got := Base58.EncodeToString(src); got != v.enc {
+			t.Errorf("EncodeToString(%s)=%q, want %q", v.hex, got, v.enc)
+		}
+		got, err := Base58.DecodeString(v.enc)
+		if err != nil || !bytes.Equal(got, src) {
+			t.Errorf("DecodeString(%q)=%x, %v, want %s", v.enc, got, err, v.hex)
+		}
+
+		dst := make([]byte, Base58.EncodedLen(len(src)))
+		n := Base58.Encode(dst, src)
+		if string(dst[:n]) != v.enc {
+			t.Errorf("Encode(%s)=%q, want %q", v.hex, dst[:n], v.enc)
+		}
+		out := make([]byte, Base58.DecodedLen(n))
+		m, err := Base58.Decode(out, dst[:n])
+		if err != nil || !bytes.Equal(out[:m], src) {
+			t.Errorf("Decode(%q)=%x, %v, want %s", dst[:n], out[:m], err, v.hex)
+		}
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	for _, c := range []struct {
+		enc *Encoding
+		n   uint64
+		s   string
+	}{
+		{Base36, 35, "z"},
+		{Base36, 36, "10"},
+		{Crockford32, 31, "Z"},
+		{Crockford32, 32, "10"},
+		{Base58, 0, "1"},
+		{Base58, 57, "z"},
+		{Base62, math.MaxUint64, "lYGhA16ahyf"},
+		{NewEncoding("01"), 5, "101"},
+	} {
+		if got := c.enc.EncodeUint64(c.n); got != c.s {
+			t.Errorf("%s: EncodeUint64(%d)=%q, want %q", c.enc.Alphabet(), c.n, got, c.s)
+		}
+		if got, err := c.enc.DecodeUint64(c.s); err != nil || got != c.n {
+			t.Errorf("%s: DecodeUint64(%q)=%d, %v, want %d", c.enc.Alphabet(), c.s, got, err, c.n)
+		}
+	}
+	if _, err := Base62.DecodeUint64("lYGhA16ahyg"); err != ErrOverflow {
+		t.Errorf("DecodeUint64 past math.MaxUint64 err=%v, want ErrOverflow", err)
+	}
+	if _, err := Base62.DecodeUint64("-1"); err != CorruptInputError(0) {
+		t.Errorf("DecodeUint64 of a negative number err=%v, want CorruptInputError(0)", err)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	for _, c := range []struct {
+		enc       *Encoding
+		canonical string
+		aliases   []string
+	}{
+		{Base36, "zz9", []string{"ZZ9", "Zz9"}},
+		{Crockford32, "1001", []string{"IOOL", "iool", "1o0l"}},
+		{Crockford32, "ABC", []string{"abc"}},
+	} {
+		want, _ := c.enc.DecodeUint64(c.canonical)
+		for _, a := range c.aliases {
+			if got, err := c.enc.DecodeUint64(a); err != nil || got != want {
+				t.Errorf("DecodeUint64(%q)=%d, %v, want %d like %q", a, got, err, want, c.canonical)
+			}
+		}
+	}
+	if _, err := Crockford32.DecodeUint64("U"); err != CorruptInputError(0) {
+		t.Errorf("Crockford32 should reject U, err=%v", err)
+	}
+	if _, err := Base58.DecodeUint64("0"); err != CorruptInputError(0) {
+		t.Errorf("Base58 should reject 0, err=%v", err)
+	}
+}
+
+func TestBig(t *testing.T) {
+	huge := new(big.Int).Exp(big.NewInt(7), big.NewInt(300), nil)
+	for name, enc := range encodings {
+		for _, n := range []*big.Int{
+			big.NewInt(0),
+			big.NewInt(-1),
+			new(big.Int).SetUint64(math.MaxUint64),
+			new(big.Int).Add(new(big.Int).SetUint64(math.MaxUint64), big.NewInt(1)),
+			huge,
+			new(big.Int).Neg(huge),
+		} {
+			s := enc.EncodeBig(n)
+			got, err := enc.DecodeBig(s)
+			if err != nil || got.Cmp(n) != 0 {
+				t.Errorf("%s: DecodeBig(EncodeBig(%s))=%s, %v", name, n, got, err)
+			}
+			if n.Sign() >= 0 && n.BitLen() <= 64 && s != enc.EncodeUint64(n.Uint64()) {
+				t.Errorf("%s: EncodeBig(%s)=%q disagrees with EncodeUint64", name, n, s)
+			}
+		}
+	}
+	if _, err := Base62.DecodeBig("12_3"); err != CorruptInputError(2) {
+		t.Errorf("DecodeBig err=%v, want CorruptInputError(2)", err)
+	}
+}
+
+func TestQuickEncodings(t *testing.T) {
+	for name, enc := range encodings {
+		bytesRoundTrip := func(src []byte) bool {
+			got, err := enc.DecodeString(enc.EncodeToString(src))
+			return err == nil && bytes.Equal(got, src)
+		}
+		if err := quick.Check(bytesRoundTrip, nil); err != nil {
+			t.Errorf("%s bytes: %v", name, err)
+		}
+		intRoundTrip := func(n int64, u uint64) bool {
+			i, err1 := enc.DecodeInt64(enc.EncodeInt64(n))
+			v, err2 := enc.DecodeUint64(enc.EncodeUint64(u))
+			return err1 == nil && err2 == nil && i == n && v == u
+		}
+		if err := quick.Check(intRoundTrip, nil); err != nil {
+			t.Errorf("%s integers: %v", name, err)
+		}
+	}
+}
+
+func TestNewEncodingPanics(t *testing.T) {
+	for _, alphabet := range []string{"", "0", "0120", "01-", "01 ", "01\xff"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewEncoding(%q) should panic", alphabet)
+				}
+			}()
+			NewEncoding(alphabet)
+		}()
+	}
+}
+
+func BenchmarkBase58Encode32(b *testing.B) {
+	src := bytes.Repeat([]byte{0xa5}, 32)
+	for i := 0; i < b.N; i++ {
+		Base58.EncodeToString(src)
+	}
+}
@@ -0,0 +1,188 @@
+package base62
+
+import (
+	"io"
+)
+
+// Streams are cut into blocks of blockSize bytes, each written as a fixed
+// number of digits: 11 for base62. Only the last block may be shorter, and
+// its width tells the decoder how many bytes it holds, so no padding is
+// needed. This costs about 2% more output than treating the whole stream as
+// one number, but works in constant memory.
+const blockSize = 8
+
+// NewEncoder returns a stream encoder using StdEncoding. See
+// Encoding.NewEncoder.
+func NewEncoder(w io.Writer) io.WriteCloser {
+	return StdEncoding.NewEncoder(w)
+}
+
+// NewDecoder returns a stream decoder using StdEncoding. See
+// Encoding.NewDecoder.
+func NewDecoder(r io.Reader) io.Reader {
+	return StdEncoding.NewDecoder(r)
+}
+
+// NewEncoder returns a stream encoder. Data written to the returned writer is
+// encoded and written to w. The caller must Close the encoder to flush the
+// last partial block. Stream encoding is not compatible with EncodeToString.
+func (enc *Encoding) NewEncoder(w io.Writer) io.WriteCloser {
+	return &encoder{enc: enc, w: w}
+}
+
+// NewDecoder returns a stream decoder reading the output of an encoder from
+// r. Newlines in the input are ignored.
+func (enc *Encoding) NewDecoder(r io.Reader) io.Reader {
+	return &decoder{enc: enc, r: r}
+}
+
+// blocksPerWrite bounds the output buffered by the encoder.
+const blocksPerWrite = 512
+
+type encoder struct {
+	enc  *Encoding
+	w    io.Writer
+	err  error
+	buf  [blockSize]byte // leftover input, less than a block
+	nbuf int
+	out  []byte
+}
+
+func (e *encoder) Write(p []byte) (n int, err error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	if e.nbuf > 0 {
+		i := copy(e.buf[e.nbuf:], p)
+		e.nbuf += i
+		n += i
+		p = p[i:]
+		if e.nbuf < blockSize {
+			return n, nil
+		}
+		e.out = e.enc.appendBlock(e.out[:0], e.buf[:])
+		e.nbuf = 0
+		if e.err = e.flush(); e.err != nil {
+			return n, e.err
+		}
+	}
+	for len(p) >= blockSize {
+		blocks := len(p) / blockSize
+		if blocks > blocksPerWrite {
+			blocks = blocksPerWrite
+		}
+		e.out = e.out[:0]
+		for i := 0; i < blocks; i++ {
+			e.out = e.enc.appendBlock(e.out, p[:blockSize])
+			p = p[blockSize:]
+			n += blockSize
+		}
+		if e.err = e.flush(); e.err != nil {
+			return n, e.err
+		}
+	}
+	e.nbuf = copy(e.buf[:], p)
+	return n + e.nbuf, nil
+}
+
+func (e *encoder) flush() error {
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// Close writes the last partial block, if any. It does not close the
+// underlying writer.
+func (e *encoder) Close() error {
+	if e.err == nil && e.nbuf > 0 {
+		e.out = e.enc.appendBlock(e.out[:0], e.buf[:e.nbuf])
+		e.nbuf = 0
+		e.err = e.flush()
+	}
+	return e.err
+}
+
+// appendBlock appends the digits of b, a block of at most blockSize bytes.
+func (enc *Encoding) appendBlock(dst, b []byte) []byte {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return enc.appendUint64(dst, v, enc.blockWidth[len(b)])
+}
+
+type decoder struct {
+	enc   *Encoding
+	r     io.Reader
+	err   error
+	pos   int64  // offset of the next input byte
+	start int64  // offset of in[0]
+	in    []byte // digits of the block being read
+	out   []byte // decoded bytes not yet returned
+	rbuf  [4096]byte
+	obuf  [4096]byte
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		n, err := d.r.Read(d.rbuf[:])
+		d.out = d.obuf[:0]
+		for _, c := range d.rbuf[:n] {
+			if c == '\n' || c == '\r' {
+				d.pos++
+				continue
+			}
+			if d.enc.decodeMap[c] < 0 {
+				d.err = CorruptInputError(d.pos)
+				break
+			}
+			if len(d.in) == 0 {
+				d.start = d.pos
+			}
+			d.in = append(d.in, c)
+			d.pos++
+			if len(d.in) == d.enc.blockWidth[blockSize] {
+				if d.err = d.decodeBlock(blockSize); d.err != nil {
+					break
+				}
+			}
+		}
+		if d.err == nil && err == io.EOF && len(d.in) > 0 {
+			// the last block is short, its width gives its length
+			if k := d.enc.blockLen[len(d.in)]; k > 0 {
+				d.err = d.decodeBlock(int(k))
+			} else {
+				d.err = io.ErrUnexpectedEOF
+			}
+		}
+		if d.err == nil {
+			d.err = err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// decodeBlock decodes d.in, the digits of a k byte block, onto d.out.
+func (d *decoder) decodeBlock(k int) error {
+	limit := uint64(1)<<uint(8*k) - 1
+	if k == blockSize {
+		limit = 1<<64 - 1
+	}
+	var v uint64
+	for _, c := range d.in {
+		x := uint64(d.enc.decodeMap[c])
+		if v > (limit-x)/d.enc.base {
+			return CorruptInputError(d.start)
+		}
+		v = v*d.enc.base + x
+	}
+	for i := k - 1; i >= 0; i-- {
+		d.out = append(d.out, byte(v>>uint(8*i)))
+	}
+	d.in = d.in[:0]
+	return nil
+}
@@ -0,0 +1,99 @@
+package base62
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"testing/quick"
+)
+
+func encodeStream(enc *Encoding, src []byte, chunk int) string {
+	var buf bytes.Buffer
+	e := enc.NewEncoder(&buf)
+	for len(src) > 0 {
+		n := chunk
+		if n > len(src) {
+			n = len(src)
+		}
+		e.Write(src[:n])
+		src = src[n:]
+	}
+	e.Close()
+	return buf.String()
+}
+
+func TestStreamBlocks(t *testing.T) {
+	// one full block of 0xff is math.MaxUint64
+	if got := encodeStream(Base62, bytes.Repeat([]byte{0xff}, 8), 8); got != "lYGhA16ahyf" {
+		t.Errorf("full block encodes to %q, want lYGhA16ahyf", got)
+	}
+	if got := encodeStream(Base62, []byte{0, 1}, 2); got != "001" {
+		t.Errorf("short block encodes to %q, want 001", got)
+	}
+	for k := 1; k <= blockSize; k++ {
+		w := Base62.blockWidth[k]
+		if k < blockSize && w >= Base62.blockWidth[k+1] {
+			t.Errorf("block widths must grow, %d bytes take %d digits", k, w)
+		}
+		if int(Base62.blockLen[w]) != k {
+			t.Errorf("blockLen[%d]=%d, want %d", w, Base62.blockLen[w], k)
+		}
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for name, enc := range encodings {
+		f := func(src []byte, chunk uint8) bool {
+			encoded := encodeStream(enc, src, int(chunk)+1)
+			got, err := ioutil.ReadAll(iotest.OneByteReader(enc.NewDecoder(strings.NewReader(encoded))))
+			return err == nil && bytes.Equal(got, src)
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestStreamLarge(t *testing.T) {
+	src := make([]byte, 100003)
+	for i := range src {
+		src[i] = byte(i * 7)
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	io.Copy(e, iotest.HalfReader(bytes.NewReader(src)))
+	e.Close()
+	got, err := ioutil.ReadAll(NewDecoder(iotest.DataErrReader(&buf)))
+	if err != nil || !bytes.Equal(got, src) {
+		t.Errorf("large round trip failed err=%v len=%d", err, len(got))
+	}
+}
+
+func TestStreamNewlines(t *testing.T) {
+	encoded := encodeStream(Base62, []byte("hello, streaming world"), 3)
+	wrapped := encoded[:5] + "\r\n" + encoded[5:20] + "\n" + encoded[20:]
+	got, err := ioutil.ReadAll(NewDecoder(strings.NewReader(wrapped)))
+	if err != nil || string(got) != "hello, streaming world" {
+		t.Errorf("decoding wrapped input got %q, %v", got, err)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		err error
+	}{
+		{"lYGhA16ahyf\nab_", CorruptInputError(14)},
+		{"lYGhA16ahyg", CorruptInputError(0)},
+		{"lYGhA16ahyf0000", io.ErrUnexpectedEOF},
+		{"zz", CorruptInputError(0)}, // more than one byte
+	} {
+		_, err := ioutil.ReadAll(NewDecoder(strings.NewReader(c.in)))
+		if err != c.err {
+			t.Errorf("decoding %q err=%v, want %v", c.in, err, c.err)
+		}
+	}
+}
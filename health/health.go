@@ -0,0 +1,66 @@
+// Package health serves liveness and readiness probes for load balancers.
+package health
+
+import (
+	"github.com/ryansb/legowebservices/log"
+	. "github.com/ryansb/legowebservices/util/m"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Check reports why a component is not ready, or nil if it is.
+type Check func() error
+
+var (
+	mu     sync.Mutex
+	checks = make(map[string]Check)
+)
+
+// Register adds a readiness check under name, replacing any previous check
+// with the same name. Services register their checks when they start.
+func Register(name string, check Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks[name] = check
+}
+
+// Healthz answers 200 as long as the process is able to serve HTTP.
+func Healthz(w http.ResponseWriter, r *http.Request) (int, string) {
+	return http.StatusOK, "ok\n"
+}
+
+// Readyz runs every registered check and answers 200 if they all pass, 503
+// otherwise. The body maps each check name to "ok" or its error.
+func Readyz(w http.ResponseWriter, r *http.Request) (int, []byte) {
+	status, res := run()
+	w.Header().Set("Content-Type", "application/json")
+	return status, res.JSON()
+}
+
+func run() (int, M) {
+	mu.Lock()
+	names := make([]string, 0, len(checks))
+	for n := range checks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	cs := make([]Check, len(names))
+	for i, n := range names {
+		cs[i] = checks[n]
+	}
+	mu.Unlock()
+
+	status := http.StatusOK
+	res := make(M, len(names))
+	for i, n := range names {
+		if err := cs[i](); err != nil {
+			log.Warningf("Readiness check failed check=%s err=%v", n, err)
+			status = http.StatusServiceUnavailable
+			res[n] = err.Error()
+		} else {
+			res[n] = "ok"
+		}
+	}
+	return status, res
+}
@@ -0,0 +1,30 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	checks = make(map[string]Check)
+	status, res := run()
+	if status != http.StatusOK || len(res) != 0 {
+		t.Errorf("no checks should be ready, got status=%d res=%v", status, res)
+	}
+
+	Register("good", func() error { return nil })
+	Register("bad", func() error { return errors.New("collection missing") })
+	status, res = run()
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("status=%d, want 503", status)
+	}
+	if res["good"] != "ok" || res["bad"] != "collection missing" {
+		t.Errorf("unexpected result %v", res)
+	}
+
+	Register("bad", func() error { return nil })
+	if status, _ = run(); status != http.StatusOK {
+		t.Errorf("status=%d after replacing the failing check, want 200", status)
+	}
+}
@@ -1,5 +1,144 @@
 package log
 
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Destinations of log lines, besides the sinks.
+const (
+	// Stderr writes every line to standard error.
+	Stderr = "stderr"
+	// Files writes per severity files in Config.Dir, and the lines at or
+	// above Config.StderrThreshold to standard error as well.
+	Files = "files"
+)
+
+// Config is the whole logging setup. Apply checks every field before
+// changing anything, so a bad Config leaves the current one in place.
+type Config struct {
+	Destination     string // Stderr or Files
+	AlsoToStderr    bool   // with Files, also write every line to standard error
+	Dir             string // directory of the log files, empty for the temp directory
+	V               int
+	VModule         string // comma-separated list of pattern=N
+	StderrThreshold string // INFO, WARNING, ERROR or FATAL
+	Format          string // text or json
+
+	// RateLimit bounds the INFO, WARNING and ERROR lines logged per second,
+	// each, with bursts of up to RateBurst lines (by default a second's
+	// worth). Lines over the limit are dropped and counted in Stats. Zero
+	// means no limit.
+	RateLimit float64
+	RateBurst int
+}
+
+// DevelConfig logs everything down to V(5) to standard error.
+var DevelConfig = Config{
+	Destination:     Stderr,
+	V:               5,
+	StderrThreshold: "ERROR",
+	Format:          "text",
+}
+
+// ProdConfig logs V(1) and up to files, and errors to standard error too.
+var ProdConfig = Config{
+	Destination:     Files,
+	V:               1,
+	StderrThreshold: "ERROR",
+	Format:          "text",
+}
+
+// CurrentConfig returns the logging setup in use.
+func CurrentConfig() Config {
+	// the flag types lock logging.mu themselves
+	vmodule := logging.vmodule.String()
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	c := Config{
+		Destination:     Files,
+		AlsoToStderr:    logging.alsoToStderr,
+		Dir:             *logDir,
+		V:               int(logging.verbosity.get()),
+		VModule:         vmodule,
+		StderrThreshold: severityName[logging.stderrThreshold.get()],
+		Format:          logging.format.String(),
+	}
+	c.RateLimit, c.RateBurst = logging.limits[infoLog].get()
+	if logging.toStderr {
+		c.Destination = Stderr
+	}
+	return c
+}
+
+// Apply makes c the logging setup. Log files already open are closed if the
+// directory changes, and new ones are created there on the next line.
+func (c Config) Apply() error {
+	var toStderr bool
+	switch c.Destination {
+	case Stderr:
+		toStderr = true
+	case Files:
+	default:
+		return fmt.Errorf("log: destination must be %s or %s, got %q", Stderr, Files, c.Destination)
+	}
+	if c.V < 0 {
+		return errors.New("log: negative verbosity")
+	}
+	filter, err := parseVModule(c.VModule)
+	if err != nil {
+		return fmt.Errorf("log: vmodule: %v", err)
+	}
+	threshold, ok := severityByName(c.StderrThreshold)
+	if !ok {
+		return fmt.Errorf("log: unknown stderr threshold %q", c.StderrThreshold)
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return errors.New("log: negative rate limit")
+	}
+	var format outputFormat
+	if c.Format != "" {
+		if err := format.Set(c.Format); err != nil {
+			return fmt.Errorf("log: %v", err)
+		}
+	}
+
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.toStderr = toStderr
+	logging.alsoToStderr = c.AlsoToStderr
+	if c.Dir != *logDir {
+		*logDir = c.Dir
+		logDirs = nil
+		onceLogDirs = sync.Once{}
+		logging.closeFiles()
+	}
+	logging.stderrThreshold.set(threshold)
+	logging.format.set(format.get())
+	logging.setVState(Level(c.V), filter, true)
+	logging.setRateLimit(c.RateLimit, c.RateBurst)
+	return nil
+}
+
+// closeFiles flushes and closes the log files, so the next line creates new
+// ones. l.mu is held.
+func (l *loggingT) closeFiles() {
+	for s := fatalLog; s >= infoLog; s-- {
+		file := l.file[s]
+		if file == nil {
+			continue
+		}
+		file.Flush() // ignore error
+		file.Sync()  // ignore error
+		if sb, ok := file.(*syncBuffer); ok {
+			sb.file.Close()
+		}
+		l.file[s] = nil
+	}
+}
+
+// SetV sets the verbosity, negative values count as 0.
 func SetV(v int) {
 	if v < 0 {
 		v = 0
@@ -7,20 +146,32 @@ func SetV(v int) {
 	logging.verbosity.setInt(v)
 }
 
+// SetVModule sets the per file verbosity, as with -vmodule.
 func SetVModule(vmod string) error {
 	return logging.vmodule.Set(vmod)
 }
 
+// UseStderr sends every line to standard error instead of the log files when
+// use is true, and back to the files otherwise.
 func UseStderr(use bool) {
-	logging.toStderr = true
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.toStderr = use
 }
 
+// DevelDefaults applies DevelConfig, keeping the log directory.
 func DevelDefaults() {
-	UseStderr(true)
-	SetV(5)
+	applyDefaults(DevelConfig)
 }
 
+// ProdDefaults applies ProdConfig, keeping the log directory.
 func ProdDefaults() {
-	UseStderr(false)
-	SetV(1)
+	applyDefaults(ProdConfig)
+}
+
+func applyDefaults(c Config) {
+	c.Dir = CurrentConfig().Dir
+	if err := c.Apply(); err != nil {
+		panic(err)
+	}
 }
@@ -1,7 +1,24 @@
 package log
 
-func FatalIfErr(err error, args ...interface{}) {
+import (
+	"fmt"
+)
+
+// FatalIfErr logs the message formatted from format and args, followed by
+// err, to the FATAL log and exits, if err is not nil:
+//
+//	log.FatalIfErr(err, "Failure opening collection name=%s err:", name)
+func FatalIfErr(err error, format string, args ...interface{}) {
 	if err != nil {
-		logging.print(fatalLog, append(args, err))
+		logging.printDepth(fatalLog, 0, nil, errMessage(err, format, args...))
+	}
+}
+
+// errMessage formats the message of FatalIfErr.
+func errMessage(err error, format string, args ...interface{}) string {
+	msg := fmt.Sprintf(format, args...)
+	if msg == "" {
+		return err.Error()
 	}
+	return msg + " " + err.Error()
 }
@@ -122,6 +122,9 @@ func (s *severity) set(val severity) {
 
 // String is part of the flag.Value interface.
 func (s *severity) String() string {
+	if v := s.get(); v >= 0 && v < numSeverity {
+		return severityName[v]
+	}
 	return strconv.FormatInt(int64(*s), 10)
 }
 
@@ -157,10 +160,12 @@ func severityByName(s string) (severity, bool) {
 	return 0, false
 }
 
-// OutputStats tracks the number of output lines and bytes written.
+// OutputStats tracks the number of output lines and bytes written, and of
+// lines dropped by the rate limit.
 type OutputStats struct {
-	lines int64
-	bytes int64
+	lines   int64
+	bytes   int64
+	dropped int64
 }
 
 // Lines returns the number of lines written.
@@ -173,6 +178,11 @@ func (s *OutputStats) Bytes() int64 {
 	return atomic.LoadInt64(&s.bytes)
 }
 
+// Dropped returns the number of lines dropped by the rate limit.
+func (s *OutputStats) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
 // Stats tracks the number of lines of output and number of bytes
 // per severity level. Values must be read with atomic.LoadInt64.
 var Stats struct {
@@ -282,6 +292,18 @@ var errVmoduleSyntax = errors.New("syntax error: expect comma-separated list of
 
 // Syntax: -vmodule=recordio=2,file=1,gfs*=3
 func (m *moduleSpec) Set(value string) error {
+	filter, err := parseVModule(value)
+	if err != nil {
+		return err
+	}
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.setVState(logging.verbosity, filter, true)
+	return nil
+}
+
+// parseVModule parses the value of the -vmodule flag.
+func parseVModule(value string) ([]modulePat, error) {
 	var filter []modulePat
 	for _, pat := range strings.Split(value, ",") {
 		if len(pat) == 0 {
@@ -290,15 +312,15 @@ func (m *moduleSpec) Set(value string) error {
 		}
 		patLev := strings.Split(pat, "=")
 		if len(patLev) != 2 || len(patLev[0]) == 0 || len(patLev[1]) == 0 {
-			return errVmoduleSyntax
+			return nil, errVmoduleSyntax
 		}
 		pattern := patLev[0]
 		v, err := strconv.Atoi(patLev[1])
 		if err != nil {
-			return errors.New("syntax error: expect comma-separated list of filename=N")
+			return nil, errors.New("syntax error: expect comma-separated list of filename=N")
 		}
 		if v < 0 {
-			return errors.New("negative value for vmodule level")
+			return nil, errors.New("negative value for vmodule level")
 		}
 		if v == 0 {
 			continue // Ignore. It's harmless but no point in paying the overhead.
@@ -306,10 +328,7 @@ func (m *moduleSpec) Set(value string) error {
 		// TODO: check syntax of filter?
 		filter = append(filter, modulePat{pattern, isLiteral(pattern), Level(v)})
 	}
-	logging.mu.Lock()
-	defer logging.mu.Unlock()
-	logging.setVState(logging.verbosity, filter, true)
-	return nil
+	return filter, nil
 }
 
 // isLiteral reports whether the pattern is a literal string, that is, has no metacharacters
@@ -347,6 +366,9 @@ func (t *traceLocation) String() string {
 	// Lock because the type is not atomic. TODO: clean this up.
 	logging.mu.Lock()
 	defer logging.mu.Unlock()
+	if !t.isSet() {
+		return ""
+	}
 	return fmt.Sprintf("%s:%d", t.file, t.line)
 }
 
@@ -361,31 +383,39 @@ var errTraceSyntax = errors.New("syntax error: expect file.go:234")
 // Syntax: -log_backtrace_at=gopherflakes.go:234
 // Note that unlike vmodule the file extension is included here.
 func (t *traceLocation) Set(value string) error {
+	file, line, err := parseTraceLocation(value)
+	if err != nil {
+		return err
+	}
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	t.line = line
+	t.file = file
+	return nil
+}
+
+// parseTraceLocation parses the value of the -log_backtrace_at flag. An empty
+// value unsets it, and gives a zero line.
+func parseTraceLocation(value string) (file string, line int, err error) {
 	if value == "" {
-		// Unset.
-		t.line = 0
-		t.file = ""
+		return "", 0, nil
 	}
 	fields := strings.Split(value, ":")
 	if len(fields) != 2 {
-		return errTraceSyntax
+		return "", 0, errTraceSyntax
 	}
-	file, line := fields[0], fields[1]
+	file = fields[0]
 	if !strings.Contains(file, ".") {
-		return errTraceSyntax
+		return "", 0, errTraceSyntax
 	}
-	v, err := strconv.Atoi(line)
+	line, err = strconv.Atoi(fields[1])
 	if err != nil {
-		return errTraceSyntax
+		return "", 0, errTraceSyntax
 	}
-	if v <= 0 {
-		return errors.New("negative or zero value for level")
+	if line <= 0 {
+		return "", 0, errors.New("negative or zero value for level")
 	}
-	logging.mu.Lock()
-	defer logging.mu.Unlock()
-	t.line = v
-	t.file = file
-	return nil
+	return file, line, nil
 }
 
 // flushSyncWriter is the interface satisfied by logging destinations.
@@ -402,6 +432,7 @@ func init() {
 	flag.Var(&logging.stderrThreshold, "stderrthreshold", "logs at or above this threshold go to stderr")
 	flag.Var(&logging.vmodule, "vmodule", "comma-separated list of pattern=N settings for file-filtered logging")
 	flag.Var(&logging.traceLocation, "log_backtrace_at", "when logging hits line file:N, emit a stack trace")
+	flag.Var(&logging.format, "log-format", "format of log lines: text or json")
 
 	// Default stderrThreshold is ERROR.
 	logging.stderrThreshold = errorLog
@@ -453,6 +484,17 @@ type loggingT struct {
 	// safely using atomic.LoadInt32.
 	vmodule   moduleSpec // The state of the -vmodule flag.
 	verbosity Level      // V logging level, the value of the -v flag/
+
+	// format is the -log-format flag. Handled atomically.
+	format outputFormat
+
+	// sinks receive every line after the files. Modified under mu.
+	sinks []Sink
+
+	// limits are the rate limits per severity, checked when limited is set.
+	// limited is handled atomically.
+	limits  [numSeverity]rateLimit
+	limited int32
 }
 
 // buffer holds a byte Buffer for reuse. The zero value is ready for use.
@@ -460,6 +502,17 @@ type buffer struct {
 	bytes.Buffer
 	tmp  [64]byte // temporary byte array for creating headers.
 	next *buffer
+
+	// header records the fields of the line here. When logging JSON it
+	// leaves the buffer empty, and finish writes them out into a buffer
+	// also marked json.
+	json bool
+	sev  severity
+	now  time.Time
+	file string
+	line int
+	// hdrLen is the length of the text header, where the message starts.
+	hdrLen int
 }
 
 var logging loggingT
@@ -496,6 +549,8 @@ func (l *loggingT) getBuffer() *buffer {
 		b = new(buffer)
 	} else {
 		b.next = nil
+		b.json = false
+		b.hdrLen = 0
 		b.Reset()
 	}
 	return b
@@ -530,10 +585,13 @@ where the fields are defined as follows:
 	line             The line number
 	msg              The user-supplied message
 */
-func (l *loggingT) header(s severity) *buffer {
+//
+// depth is the number of extra stack frames between the user's call and the
+// print function calling header.
+func (l *loggingT) header(s severity, depth int) *buffer {
 	// L[mm/dd] hh:mm:ss.uuuu file:line:
 	now := timeNow()
-	_, file, line, ok := runtime.Caller(3) // It's always the same number of frames to the user's call.
+	_, file, line, ok := runtime.Caller(3 + depth) // It's always the same number of frames to the user's call.
 	if !ok {
 		file = "???"
 		line = 1
@@ -550,6 +608,11 @@ func (l *loggingT) header(s severity) *buffer {
 		s = infoLog // for safety.
 	}
 	buf := l.getBuffer()
+	buf.sev, buf.now, buf.file, buf.line = s, now, file, line
+	if l.format.get() == jsonFormat {
+		buf.json = true
+		return buf
+	}
 
 	// Avoid Fprintf, for speed. The format is so simple that we can do it quickly by hand.
 	// It's worth about 3X. Fprintf is hard.
@@ -577,6 +640,7 @@ func (l *loggingT) header(s severity) *buffer {
 	buf.tmp[n+1] = ':'
 	buf.tmp[n+2] = ' '
 	buf.Write(buf.tmp[:n+3])
+	buf.hdrLen = buf.Len()
 	return buf
 }
 
@@ -616,35 +680,54 @@ func (buf *buffer) someDigits(i, d int) int {
 }
 
 func (l *loggingT) println(s severity, args ...interface{}) {
-	buf := l.header(s)
-	fmt.Fprintln(buf, args...)
-	l.output(s, buf)
+	l.printlnDepth(s, 1, nil, args...)
 }
 
 func (l *loggingT) print(s severity, args ...interface{}) {
-	buf := l.header(s)
-	fmt.Fprint(buf, args...)
-	if buf.Bytes()[buf.Len()-1] != '\n' {
-		buf.WriteByte('\n')
-	}
-	l.output(s, buf)
+	l.printDepth(s, 1, nil, args...)
 }
 
 func (l *loggingT) printf(s severity, format string, args ...interface{}) {
-	buf := l.header(s)
-	fmt.Fprintf(buf, format, args...)
-	if buf.Bytes()[buf.Len()-1] != '\n' {
-		buf.WriteByte('\n')
+	l.printfDepth(s, 1, nil, format, args...)
+}
+
+// The Depth variants take the number of extra stack frames to the user's
+// call, see header, and key/value fields to append to the message.
+
+func (l *loggingT) printlnDepth(s severity, depth int, fields []interface{}, args ...interface{}) {
+	if !l.allow(s) {
+		return
 	}
-	l.output(s, buf)
+	buf := l.header(s, depth)
+	fmt.Fprintln(buf, args...)
+	l.output(s, l.finish(buf, fields))
+}
+
+func (l *loggingT) printDepth(s severity, depth int, fields []interface{}, args ...interface{}) {
+	if !l.allow(s) {
+		return
+	}
+	buf := l.header(s, depth)
+	fmt.Fprint(buf, args...)
+	l.output(s, l.finish(buf, fields))
+}
+
+func (l *loggingT) printfDepth(s severity, depth int, fields []interface{}, format string, args ...interface{}) {
+	if !l.allow(s) {
+		return
+	}
+	buf := l.header(s, depth)
+	fmt.Fprintf(buf, format, args...)
+	l.output(s, l.finish(buf, fields))
 }
 
 // output writes the data to the log files and releases the buffer.
 func (l *loggingT) output(s severity, buf *buffer) {
 	l.mu.Lock()
-	if l.traceLocation.isSet() {
-		_, file, line, ok := runtime.Caller(3) // It's always the same number of frames to the user's call (same as header).
-		if ok && l.traceLocation.match(file, line) {
+	if l.traceLocation.isSet() && l.traceLocation.match(buf.file, buf.line) {
+		if buf.json {
+			addStack(buf, stacks(false))
+		} else {
 			buf.Write(stacks(false))
 		}
 	}
@@ -675,6 +758,9 @@ func (l *loggingT) output(s severity, buf *buffer) {
 			l.file[infoLog].Write(data)
 		}
 	}
+	if len(l.sinks) > 0 {
+		l.emit(buf)
+	}
 	if s == fatalLog {
 		// Make sure we see the trace for the current goroutine on standard error.
 		if !l.toStderr {
@@ -806,7 +892,11 @@ func (sb *syncBuffer) rotateFile(now time.Time) error {
 	fmt.Fprintf(&buf, "Log file created at: %s\n", now.Format("2006/01/02 15:04:05"))
 	fmt.Fprintf(&buf, "Running on machine: %s\n", host)
 	fmt.Fprintf(&buf, "Binary: Built with %s %s for %s/%s\n", runtime.Compiler, runtime.Version(), runtime.GOOS, runtime.GOARCH)
-	fmt.Fprintf(&buf, "Log line format: [IWEF]mmdd hh:mm:ss.uuuuuu threadid file:line] msg\n")
+	if sb.logger.format.get() == jsonFormat {
+		fmt.Fprintf(&buf, "Log line format: one JSON object per line\n")
+	} else {
+		fmt.Fprintf(&buf, "Log line format: [IWEF][mm/dd] hh:mm:ss.uuuu file:line: msg\n")
+	}
 	n, err := sb.file.Write(buf.Bytes())
 	sb.nbytes += uint64(n)
 	return err
@@ -863,6 +953,9 @@ func (l *loggingT) flushAll() {
 			file.Sync()  // ignore error
 		}
 	}
+	for _, s := range l.sinks {
+		s.Flush() // ignore error
+	}
 }
 
 // setV computes and remembers the V level for a given PC
@@ -910,32 +1003,38 @@ type Verbose bool
 // V is at least the value of -v, or of -vmodule for the source file containing the
 // call, the V call will log.
 func V(level Level) Verbose {
+	return Verbose(logging.vEnabled(level, 1))
+}
+
+// vEnabled implements V. depth is the number of stack frames between the
+// caller of vEnabled and the call site whose -vmodule setting applies.
+func (l *loggingT) vEnabled(level Level, depth int) bool {
 	// This function tries hard to be cheap unless there's work to do.
 	// The fast path is two atomic loads and compares.
 
 	// Here is a cheap but safe test to see if V logging is enabled globally.
-	if logging.verbosity.get() >= level {
-		return Verbose(true)
+	if l.verbosity.get() >= level {
+		return true
 	}
 
 	// It's off globally but it vmodule may still be set.
 	// Here is another cheap but safe test to see if vmodule is enabled.
-	if atomic.LoadInt32(&logging.filterLength) > 0 {
+	if atomic.LoadInt32(&l.filterLength) > 0 {
 		// Now we need a proper lock to use the logging structure. The pcs field
 		// is shared so we must lock before accessing it. This is fairly expensive,
 		// but if V logging is enabled we're slow anyway.
-		logging.mu.Lock()
-		defer logging.mu.Unlock()
-		if runtime.Callers(2, logging.pcs[:]) == 0 {
-			return Verbose(false)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if runtime.Callers(2+depth, l.pcs[:]) == 0 {
+			return false
 		}
-		v, ok := logging.vmap[logging.pcs[0]]
+		v, ok := l.vmap[l.pcs[0]]
 		if !ok {
-			v = logging.setV(logging.pcs[0])
+			v = l.setV(l.pcs[0])
 		}
-		return Verbose(v >= level)
+		return v >= level
 	}
-	return Verbose(false)
+	return false
 }
 
 // Info is equivalent to the global Info function, guarded by the value of v.
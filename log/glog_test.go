@@ -18,7 +18,11 @@ package log
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -326,8 +330,251 @@ func TestLogBacktraceAt(t *testing.T) {
 	}
 }
 
+// Test that in JSON the trace asked for by -log_backtrace_at is a field of
+// the line.
+func TestJSONBacktraceAt(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer logging.format.set(textFormat)
+	defer func() { logging.traceLocation = traceLocation{} }()
+	logging.format.set(jsonFormat)
+	_, file, line, _ := runtime.Caller(0)
+	logging.traceLocation.Set(fmt.Sprintf("%s:%d", filepath.Base(file), line+2)) // the Info call
+	Info("we want a stack trace here")
+	lines := strings.Split(contents(infoLog), "\n")
+	if len(lines) != 2 || lines[1] != "" {
+		t.Fatalf("expected a single line, got %q", contents(infoLog))
+	}
+	var got struct{ Msg, Stack string }
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("%v: %s", err, lines[0])
+	}
+	if got.Msg != "we want a stack trace here" || !strings.Contains(got.Stack, fmt.Sprintf("glog_test.go:%d", line+2)) {
+		t.Errorf("unexpected line %s", lines[0])
+	}
+}
+
+// Test that With and Infow append key=value fields to text lines.
+func TestWith(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	l := With("short", "1B")
+	l.Info("redirecting")
+	l.With("err", errors.New("not found")).Errorw("lookup failed", "hits", 3, "q", "")
+	Infow("odd", "dangling")
+	info := contents(infoLog)
+	for _, want := range []string{
+		": redirecting short=1B\n",
+		`: lookup failed short=1B err="not found" hits=3 q=""` + "\n",
+		": odd !BADKEY=dangling\n",
+	} {
+		if !strings.Contains(info, want) {
+			t.Errorf("missing %q in:\n%s", want, info)
+		}
+	}
+	if !contains(errorLog, "lookup failed", t) {
+		t.Error("Errorw did not reach the error log")
+	}
+}
+
+// Test that the JSON format writes one object per line with the header
+// fields and the key/value fields.
+func TestJSONFormat(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer logging.format.set(textFormat)
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	timeNow = func() time.Time {
+		return time.Date(2006, 1, 2, 15, 4, 5, .678901e9, time.UTC)
+	}
+	if err := logging.format.Set("json"); err != nil {
+		t.Fatal(err)
+	}
+	With("short", "1B").Warningw("slow \"lookup\"\n", "ms", 12.5, "ids", []int{1, 2})
+	lines := strings.Split(contents(infoLog), "\n")
+	if len(lines) != 2 || lines[1] != "" {
+		t.Fatalf("expected a single line, got %q", contents(infoLog))
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("%v: %s", err, lines[0])
+	}
+	for k, want := range map[string]interface{}{
+		"severity": "WARNING",
+		"time":     "2006-01-02T15:04:05.678901Z",
+		"msg":      `slow "lookup"`,
+		"short":    "1B",
+		"ms":       12.5,
+	} {
+		if got[k] != want {
+			t.Errorf("%s = %v, want %v", k, got[k], want)
+		}
+	}
+	if caller, _ := got["caller"].(string); !strings.HasPrefix(caller, "glog_test.go:") {
+		t.Errorf("caller = %q, want glog_test.go:N", caller)
+	}
+	if ids, _ := got["ids"].([]interface{}); len(ids) != 2 {
+		t.Errorf("ids = %v, want [1 2]", got["ids"])
+	}
+	if err := logging.format.Set("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+// Test that Logger.V honors -vmodule for the caller's file.
+func TestLoggerV(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	l := With("k", "v")
+	if l.V(2).Enabled() {
+		t.Error("V(2) enabled at -v=0")
+	}
+	l.V(2).Info("hidden")
+	logging.vmodule.Set("glog_test=2")
+	defer logging.vmodule.Set("")
+	l.V(2).Info("shown")
+	if contains(infoLog, "hidden", t) {
+		t.Error("V(2) logged at -v=0")
+	}
+	if !contains(infoLog, ": shown k=v\n", t) {
+		t.Errorf("V(2) did not log with vmodule: %q", contents(infoLog))
+	}
+}
+
+// Test that Apply sets every field of the Config.
+func TestConfigApply(t *testing.T) {
+	defer CurrentConfig().Apply()
+	want := Config{
+		Destination:     Files,
+		AlsoToStderr:    true,
+		Dir:             *logDir,
+		V:               3,
+		VModule:         "glog_test=4",
+		StderrThreshold: "WARNING",
+		Format:          "json",
+	}
+	if err := want.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if got := CurrentConfig(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if logging.toStderr || !logging.alsoToStderr {
+		t.Errorf("destination not applied: toStderr=%v alsoToStderr=%v", logging.toStderr, logging.alsoToStderr)
+	}
+	if logging.verbosity.get() != 3 || logging.filterLength != 1 {
+		t.Errorf("verbosity not applied: v=%d filters=%d", logging.verbosity.get(), logging.filterLength)
+	}
+	if logging.stderrThreshold.get() != warningLog {
+		t.Errorf("stderr threshold not applied: %v", logging.stderrThreshold.get())
+	}
+	if logging.format.get() != jsonFormat {
+		t.Errorf("format not applied: %v", logging.format.String())
+	}
+
+	want.Destination = Stderr
+	want.Format = "text"
+	if err := want.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if !logging.toStderr || logging.format.get() != textFormat {
+		t.Errorf("expected stderr and text, got %+v", CurrentConfig())
+	}
+}
+
+// Test that a Config with a bad field changes nothing.
+func TestConfigApplyInvalid(t *testing.T) {
+	before := CurrentConfig()
+	for _, bad := range []Config{
+		{Destination: "syslog", StderrThreshold: "ERROR"},
+		{Destination: Stderr, V: -1, StderrThreshold: "ERROR"},
+		{Destination: Stderr, VModule: "glog", StderrThreshold: "ERROR"},
+		{Destination: Stderr, StderrThreshold: "LOUD"},
+		{Destination: Stderr, StderrThreshold: "ERROR", Format: "xml"},
+	} {
+		if err := bad.Apply(); err == nil {
+			t.Errorf("expected an error applying %+v", bad)
+		}
+		if got := CurrentConfig(); got != before {
+			t.Errorf("applying %+v changed the config to %+v", bad, got)
+		}
+	}
+}
+
+// Test that log files are created in Dir, and moved when it changes.
+func TestConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	before := CurrentConfig()
+	defer before.Apply()
+	old := logging.swap([numSeverity]flushSyncWriter{})
+	defer logging.swap(old)
+
+	c := before
+	c.Destination, c.Dir = Files, dir
+	if err := c.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	Info("in the new dir")
+	Flush()
+	infos, _ := filepath.Glob(filepath.Join(dir, "*.log.INFO.*"))
+	if len(infos) != 1 {
+		t.Fatalf("expected one INFO log in %s, got %v", dir, infos)
+	}
+	data, err := ioutil.ReadFile(infos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "in the new dir") {
+		t.Errorf("log file is missing the line:\n%s", data)
+	}
+
+	c.Dir = filepath.Join(dir, "missing")
+	if err := c.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if logging.file[infoLog] != nil {
+		t.Error("expected the files in the old directory to be closed")
+	}
+}
+
+// Test that UseStderr and the defaults set the destination they ask for.
+func TestUseStderr(t *testing.T) {
+	defer CurrentConfig().Apply()
+	UseStderr(false)
+	if logging.toStderr {
+		t.Error("UseStderr(false) left stderr on")
+	}
+	UseStderr(true)
+	if !logging.toStderr {
+		t.Error("UseStderr(true) did not turn stderr on")
+	}
+	ProdDefaults()
+	if c := CurrentConfig(); c.Destination != Files || c.V != 1 {
+		t.Errorf("ProdDefaults gave %+v", c)
+	}
+	DevelDefaults()
+	if c := CurrentConfig(); c.Destination != Stderr || c.V != 5 {
+		t.Errorf("DevelDefaults gave %+v", c)
+	}
+}
+
+// Test that FatalIfErr formats its message and then adds the error.
+func TestErrMessage(t *testing.T) {
+	err := errors.New("disk full")
+	if got := errMessage(err, "Failure saving name=%s err:", "x"); got != "Failure saving name=x err: disk full" {
+		t.Errorf("got %q", got)
+	}
+	if got := errMessage(err, ""); got != "disk full" {
+		t.Errorf("got %q", got)
+	}
+}
+
 func BenchmarkHeader(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		logging.putBuffer(logging.header(infoLog))
+		logging.putBuffer(logging.header(infoLog, 0))
 	}
 }
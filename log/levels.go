@@ -0,0 +1,113 @@
+package log
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Levels is the verbosity state that can be changed at runtime: the -v,
+// -vmodule and -log_backtrace_at flags.
+type Levels struct {
+	V         int    `json:"v"`
+	VModule   string `json:"vmodule"`
+	TraceAt   string `json:"backtrace_at"`
+	Temporary bool   `json:"temporary"`
+	// RevertAt is when a temporary change is undone.
+	RevertAt time.Time `json:"revert_at"`
+}
+
+var (
+	levelsMu sync.Mutex
+	// saved is the state a temporary change reverts to, and revert its
+	// timer, nil when the current state is permanent. gen tells a timer
+	// that fires late whether it is still the current one.
+	saved    Levels
+	revert   *time.Timer
+	revertAt time.Time
+	gen      uint64
+)
+
+// CurrentLevels returns the current verbosity state.
+func CurrentLevels() Levels {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	return currentLevels()
+}
+
+// currentLevels reads the flags. levelsMu is held.
+func currentLevels() Levels {
+	l := Levels{
+		V:       int(logging.verbosity.get()),
+		VModule: logging.vmodule.String(),
+		TraceAt: logging.traceLocation.String(),
+	}
+	if revert != nil {
+		l.Temporary = true
+		l.RevertAt = revertAt
+	}
+	return l
+}
+
+// SetLevels changes the verbosity state to l, all at once or not at all. If
+// revertAfter is positive the change is temporary: it is undone after that
+// long, going back to the state before the first of a series of temporary
+// changes. Otherwise the change is permanent and cancels any pending revert.
+func SetLevels(l Levels, revertAfter time.Duration) error {
+	if l.V < 0 {
+		return errors.New("log: negative verbosity")
+	}
+	filter, err := parseVModule(l.VModule)
+	if err != nil {
+		return err
+	}
+	file, line, err := parseTraceLocation(l.TraceAt)
+	if err != nil {
+		return err
+	}
+
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	gen++
+	if revert != nil {
+		revert.Stop()
+		revert = nil
+	} else if revertAfter > 0 {
+		saved = currentLevels()
+	}
+	if revertAfter > 0 {
+		g := gen
+		revertAt = timeNow().Add(revertAfter)
+		revert = time.AfterFunc(revertAfter, func() { revertLevels(g) })
+	}
+	applyLevels(Level(l.V), filter, file, line)
+	return nil
+}
+
+// applyLevels sets the flags. levelsMu is held.
+func applyLevels(v Level, filter []modulePat, file string, line int) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.setVState(v, filter, true)
+	logging.traceLocation.file = file
+	logging.traceLocation.line = line
+}
+
+// revertLevels undoes the temporary change made as generation g, unless
+// another change came since.
+func revertLevels(g uint64) {
+	levelsMu.Lock()
+	if g != gen {
+		levelsMu.Unlock()
+		return
+	}
+	gen++
+	revert = nil
+	l := saved
+	// saved was read from the flags, so it parses
+	filter, _ := parseVModule(l.VModule)
+	file, line, _ := parseTraceLocation(l.TraceAt)
+	applyLevels(Level(l.V), filter, file, line)
+	levelsMu.Unlock()
+	Infof("Reverted log levels v=%d vmodule=%s backtrace_at=%s", l.V, l.VModule, l.TraceAt)
+}
@@ -0,0 +1,78 @@
+package log
+
+import (
+	"testing"
+	"time"
+)
+
+func resetLevels(t *testing.T) {
+	if err := SetLevels(Levels{}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that SetLevels applies every setting, or none if one is invalid.
+func TestSetLevels(t *testing.T) {
+	defer resetLevels(t)
+	want := Levels{V: 3, VModule: "glog=2,kv*=4", TraceAt: "levels.go:12"}
+	if err := SetLevels(want, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := CurrentLevels(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for _, bad := range []Levels{
+		{V: -1},
+		{V: 1, VModule: "glog"},
+		{V: 1, TraceAt: "levels.go"},
+	} {
+		if err := SetLevels(bad, 0); err == nil {
+			t.Errorf("expected an error setting %+v", bad)
+		}
+	}
+	if got := CurrentLevels(); got != want {
+		t.Errorf("failed SetLevels changed the state to %+v", got)
+	}
+}
+
+// Test that temporary changes revert to the state before the first one, and
+// that a permanent change cancels the revert.
+func TestSetLevelsRevert(t *testing.T) {
+	defer resetLevels(t)
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	base := Levels{V: 1, VModule: "glog=2"}
+	if err := SetLevels(base, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLevels(Levels{V: 9}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLevels(Levels{V: 7}, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if got := CurrentLevels(); got.V != 7 || !got.Temporary || got.RevertAt.IsZero() {
+		t.Errorf("expected a temporary V=7, got %+v", got)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for CurrentLevels().Temporary && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := CurrentLevels(); got != base {
+		t.Errorf("expected a revert to %+v, got %+v", base, got)
+	}
+	if !contains(infoLog, "Reverted log levels v=1", t) {
+		t.Errorf("revert was not logged: %q", contents(infoLog))
+	}
+
+	if err := SetLevels(Levels{V: 5}, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLevels(Levels{V: 4}, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := CurrentLevels(); got.V != 4 || got.Temporary {
+		t.Errorf("permanent change was reverted: %+v", got)
+	}
+}
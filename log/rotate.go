@@ -0,0 +1,295 @@
+package log
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions says when a RotatingFile starts a new file and what happens to
+// the old ones.
+type RotateOptions struct {
+	MaxSize  int64         // rotate once the file holds this many bytes, 0 for no limit
+	MaxAge   time.Duration // rotate once the file is this old, 0 for no limit
+	Keep     int           // number of rotated files kept, 0 keeps them all
+	Compress bool          // gzip rotated files
+}
+
+var errFileClosed = errors.New("log: rotating file is closed")
+
+// rotatedFormat is appended to the path of rotated files. It sorts in time
+// order.
+const rotatedFormat = "20060102-150405.000"
+
+// RotatingFile is a Sink writing to a single file, which is renamed to
+// path.<time> when it gets too large or too old, and then replaced by a new
+// one. Compression and removal of old files happen in the background.
+type RotatingFile struct {
+	path string
+	opts RotateOptions
+
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+
+	// cleanup serializes compression and pruning; pending tracks them for
+	// Close.
+	cleanup sync.Mutex
+	pending sync.WaitGroup
+}
+
+// NewRotatingFile opens path for appending, creating it and its directory
+// if needed.
+func NewRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f := &RotatingFile{path: path, opts: opts}
+	if err := f.open(timeNow()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file at f.path. f.mu is held.
+func (f *RotatingFile) open(now time.Time) error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.w = bufio.NewWriterSize(file, bufferSize)
+	f.size = info.Size()
+	f.opened = now
+	return nil
+}
+
+// Emit appends the line, rotating first if it is due.
+func (f *RotatingFile) Emit(e *Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return errFileClosed
+	}
+	if f.due(e.Time, len(e.Data)) {
+		if err := f.rotate(e.Time); err != nil {
+			return err
+		}
+	}
+	n, err := f.w.Write(e.Data)
+	f.size += int64(n)
+	return err
+}
+
+// due reports whether the file must be rotated before writing n bytes at now.
+// An empty file is never rotated. f.mu is held.
+func (f *RotatingFile) due(now time.Time, n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.opts.MaxSize > 0 && f.size+int64(n) > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.MaxAge > 0 && now.Sub(f.opened) >= f.opts.MaxAge
+}
+
+// Rotate starts a new file now, whatever its size and age.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return errFileClosed
+	}
+	return f.rotate(timeNow())
+}
+
+// rotate renames the current file and opens a new one. f.mu is held.
+func (f *RotatingFile) rotate(now time.Time) error {
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	name := f.path + "." + now.Format(rotatedFormat)
+	for i := 1; exists(name) || exists(name+".gz"); i++ {
+		name = fmt.Sprintf("%s.%s.%d", f.path, now.Format(rotatedFormat), i)
+	}
+	if err := os.Rename(f.path, name); err != nil {
+		// keep appending to the current file
+		if oerr := f.open(f.opened); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := f.open(now); err != nil {
+		return err
+	}
+	f.pending.Add(1)
+	go f.clean()
+	return nil
+}
+
+// clean compresses the rotated files that aren't yet, and prunes the old
+// ones. Runs are serialized, and each handles every file, so it doesn't
+// matter which rotation started it.
+func (f *RotatingFile) clean() {
+	defer f.pending.Done()
+	f.cleanup.Lock()
+	defer f.cleanup.Unlock()
+	if f.opts.Compress {
+		rotated, err := f.Rotated()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log: failure listing old logs of %s: %v\n", f.path, err)
+		}
+		for _, name := range rotated {
+			if strings.HasSuffix(name, ".gz") {
+				continue
+			}
+			if err := compress(name); err != nil {
+				fmt.Fprintf(os.Stderr, "log: failure compressing %s: %v\n", name, err)
+			}
+		}
+	}
+	if err := f.prune(); err != nil {
+		fmt.Fprintf(os.Stderr, "log: failure removing old logs of %s: %v\n", f.path, err)
+	}
+}
+
+// Rotated returns the paths of the rotated files, oldest first. Other files
+// whose name starts with the path, such as path.bak, are left out.
+func (f *RotatingFile) Rotated() ([]string, error) {
+	names, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, name := range names {
+		if isRotated(name[len(f.path)+1:]) {
+			rotated = append(rotated, name)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// isRotated tells whether suffix, what follows the path and a dot in a file
+// name, was given by rotate: a time in rotatedFormat, then maybe a number
+// telling apart files rotated in the same millisecond, then maybe .gz.
+func isRotated(suffix string) bool {
+	suffix = strings.TrimSuffix(suffix, ".gz")
+	if len(suffix) < len(rotatedFormat) {
+		return false
+	}
+	if _, err := time.Parse(rotatedFormat, suffix[:len(rotatedFormat)]); err != nil {
+		return false
+	}
+	rest := suffix[len(rotatedFormat):]
+	if rest == "" {
+		return true
+	}
+	if len(rest) < 2 || rest[0] != '.' {
+		return false
+	}
+	for _, c := range rest[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// prune removes the oldest rotated files beyond opts.Keep.
+func (f *RotatingFile) prune() error {
+	if f.opts.Keep <= 0 {
+		return nil
+	}
+	rotated, err := f.Rotated()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > f.opts.Keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// compress replaces name with name.gz.
+func compress(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := name + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(name)
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// Flush writes buffered lines to the file.
+func (f *RotatingFile) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.w.Flush()
+}
+
+// Close flushes and closes the file, and waits for background compression.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.w.Flush()
+		if cerr := f.file.Close(); err == nil {
+			err = cerr
+		}
+		f.file = nil
+	}
+	f.mu.Unlock()
+	f.pending.Wait()
+	return err
+}
@@ -0,0 +1,195 @@
+package log
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sampling thins out the lines logged from a busy call site. Every(n) and
+// Sometimes(d) return a Verbose that is true for some of the calls made from
+// the line they are called on:
+//
+//	log.Every(100).Infof("Served redirect short=%s", short)
+//	log.V(2).Sometimes(time.Second).Infof("Queue depth=%d", len(hits))
+//
+// Each call site keeps its own count, so sampling one doesn't affect others.
+
+type sampleSite struct {
+	n    uint64    // calls seen
+	last time.Time // when Sometimes last said yes
+}
+
+var sampling struct {
+	mu    sync.Mutex
+	sites map[uintptr]*sampleSite
+}
+
+// site returns the state of the call site depth frames above the caller of
+// the function calling site. sampling.mu is held.
+func site(depth int) *sampleSite {
+	var pcs [1]uintptr
+	runtime.Callers(3+depth, pcs[:])
+	if sampling.sites == nil {
+		sampling.sites = make(map[uintptr]*sampleSite)
+	}
+	s, ok := sampling.sites[pcs[0]]
+	if !ok {
+		s = new(sampleSite)
+		sampling.sites[pcs[0]] = s
+	}
+	return s
+}
+
+func every(n int, depth int) Verbose {
+	if n <= 1 {
+		return true
+	}
+	sampling.mu.Lock()
+	defer sampling.mu.Unlock()
+	s := site(depth)
+	s.n++
+	return (s.n-1)%uint64(n) == 0
+}
+
+func sometimes(d time.Duration, depth int) Verbose {
+	now := timeNow()
+	sampling.mu.Lock()
+	defer sampling.mu.Unlock()
+	s := site(depth)
+	if !s.last.IsZero() && now.Sub(s.last) < d {
+		return false
+	}
+	s.last = now
+	return true
+}
+
+// Every is true for the first call from its call site and then every n-th.
+func Every(n int) Verbose {
+	return every(n, 1)
+}
+
+// Sometimes is true for the first call from its call site and then for the
+// first call at least d after the last one it was true for.
+func Sometimes(d time.Duration) Verbose {
+	return sometimes(d, 1)
+}
+
+// Every is like the package level Every, but only counts calls when v is
+// true.
+func (v Verbose) Every(n int) Verbose {
+	if !v {
+		return false
+	}
+	return every(n, 1)
+}
+
+// Sometimes is like the package level Sometimes, but only counts calls when
+// v is true.
+func (v Verbose) Sometimes(d time.Duration) Verbose {
+	if !v {
+		return false
+	}
+	return sometimes(d, 1)
+}
+
+// Every returns l for the first call from its call site and then every
+// n-th, and a Logger that discards everything otherwise.
+func (l *Logger) Every(n int) *Logger {
+	if l.off || bool(every(n, 1)) {
+		return l
+	}
+	return &Logger{off: true}
+}
+
+// Sometimes returns l for the first call from its call site and then for
+// the first call at least d after the last one, and a Logger that discards
+// everything otherwise.
+func (l *Logger) Sometimes(d time.Duration) *Logger {
+	if l.off || bool(sometimes(d, 1)) {
+		return l
+	}
+	return &Logger{off: true}
+}
+
+// rateLimit is a token bucket bounding the lines per second of one severity.
+type rateLimit struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second, 0 for no limit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (r *rateLimit) set(rate float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if burst < 1 {
+		// a second's worth
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	r.rate, r.burst, r.tokens = rate, float64(burst), float64(burst)
+	r.last = time.Time{}
+}
+
+func (r *rateLimit) get() (rate float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate == 0 {
+		return 0, 0
+	}
+	return r.rate, int(r.burst)
+}
+
+func (r *rateLimit) allow(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate == 0 {
+		return true
+	}
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// setRateLimit limits INFO, WARNING and ERROR lines to rate per second each,
+// allowing bursts of up to burst lines. A zero rate removes the limit. FATAL
+// lines are never dropped.
+func (l *loggingT) setRateLimit(rate float64, burst int) {
+	for s := infoLog; s < fatalLog; s++ {
+		l.limits[s].set(rate, burst)
+	}
+	on := int32(0)
+	if rate > 0 {
+		on = 1
+	}
+	atomic.StoreInt32(&l.limited, on)
+}
+
+// allow reports whether a line of severity s may be logged, counting it as
+// dropped otherwise.
+func (l *loggingT) allow(s severity) bool {
+	if s >= fatalLog || atomic.LoadInt32(&l.limited) == 0 {
+		return true
+	}
+	if l.limits[s].allow(timeNow()) {
+		return true
+	}
+	if stats := severityStats[s]; stats != nil {
+		atomic.AddInt64(&stats.dropped, 1)
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package log
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	var a, b int
+	for i := 0; i < 10; i++ {
+		if Every(3) {
+			a++
+		}
+		if Every(5) {
+			b++
+		}
+	}
+	// calls 1, 4, 7 and 10, and calls 1 and 6
+	if a != 4 || b != 2 {
+		t.Errorf("expected 4 and 2 lines, got %d and %d", a, b)
+	}
+
+	n := 0
+	for i := 0; i < 10; i++ {
+		if Verbose(i%2 == 0).Every(2) {
+			n++
+		}
+	}
+	// only the 5 true calls count
+	if n != 3 {
+		t.Errorf("expected 3 lines, got %d", n)
+	}
+}
+
+func TestSometimes(t *testing.T) {
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	var got []bool
+	for _, step := range []time.Duration{0, 500 * time.Millisecond, 600 * time.Millisecond, 100 * time.Millisecond, time.Second} {
+		now = now.Add(step)
+		got = append(got, bool(Sometimes(time.Second)))
+	}
+	if want := []bool{true, false, true, false, true}; !equalBools(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func equalBools(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Test that Logger sampling is per call site and keeps the fields.
+func TestLoggerEvery(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	l := With("k", "v")
+	for i := 0; i < 4; i++ {
+		l.Every(2).Infof("line %d", i)
+	}
+	info := contents(infoLog)
+	if strings.Count(info, "k=v") != 2 || !strings.Contains(info, "line 2 k=v") || strings.Contains(info, "line 1") {
+		t.Errorf("expected lines 0 and 2, got:\n%s", info)
+	}
+}
+
+// Test that the rate limit drops lines over it and counts them.
+func TestRateLimit(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer CurrentConfig().Apply()
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	c := CurrentConfig()
+	c.RateLimit, c.RateBurst = 2, 3
+	if err := c.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if got := CurrentConfig(); got.RateLimit != 2 || got.RateBurst != 3 {
+		t.Errorf("rate limit not applied: %+v", got)
+	}
+	dropped := Stats.Info.Dropped()
+	for i := 0; i < 5; i++ {
+		Infof("burst %d", i)
+	}
+	now = now.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		Infof("later %d", i)
+	}
+	Warning("own bucket")
+
+	info := contents(infoLog)
+	if n := strings.Count(info, "burst"); n != 3 {
+		t.Errorf("expected the 3 line burst, got %d:\n%s", n, info)
+	}
+	if n := strings.Count(info, "later"); n != 2 {
+		t.Errorf("expected 2 lines a second later, got %d:\n%s", n, info)
+	}
+	if !strings.Contains(info, "own bucket") {
+		t.Error("a WARNING line was limited by the INFO rate")
+	}
+	if n := Stats.Info.Dropped() - dropped; n != 3 {
+		t.Errorf("expected 3 dropped lines, got %d", n)
+	}
+}
@@ -0,0 +1,136 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// An Entry is a log line as handed to a Sink.
+type Entry struct {
+	Severity string // INFO, WARNING, ERROR or FATAL
+	Time     time.Time
+	File     string // base name of the source file
+	Line     int
+
+	// Data is the line as written to the log files, ending in a newline.
+	// Msg is the same line without the text header and the newline; in
+	// JSON format it is the whole object. Both are only valid during Emit.
+	Data []byte
+	Msg  []byte
+}
+
+// A Sink receives every log line in addition to stderr and the log files.
+// Sinks are called in the order they were added, under the logging lock, so
+// they see lines in order but must not log themselves.
+type Sink interface {
+	Emit(e *Entry) error
+	Flush() error
+	Close() error
+}
+
+// AddSink starts sending log lines to s.
+func AddSink(s Sink) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.sinks = append(logging.sinks, s)
+}
+
+// RemoveSink stops sending log lines to s, flushing it first. It does not
+// close s.
+func RemoveSink(s Sink) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	for i, t := range logging.sinks {
+		if t == s {
+			s.Flush()
+			logging.sinks = append(logging.sinks[:i:i], logging.sinks[i+1:]...)
+			return
+		}
+	}
+}
+
+// emit passes the line in buf to every sink. l.mu is held.
+func (l *loggingT) emit(buf *buffer) {
+	data := buf.Bytes()
+	msg := data[buf.hdrLen:]
+	if n := len(msg); n > 0 && msg[n-1] == '\n' {
+		msg = msg[:n-1]
+	}
+	e := &Entry{
+		Severity: severityName[buf.sev],
+		Time:     buf.now,
+		File:     buf.file,
+		Line:     buf.line,
+		Data:     data,
+		Msg:      msg,
+	}
+	for _, s := range l.sinks {
+		if err := s.Emit(e); err != nil {
+			// can't log it, that would come back here
+			fmt.Fprintf(os.Stderr, "log: failure writing to sink %T: %v\n", s, err)
+		}
+	}
+}
+
+// Ring is a Sink keeping the last lines logged in memory, for showing them
+// in the admin UI. It is safe to read while logging.
+type Ring struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+// NewRing returns a Ring that keeps the last size lines.
+func NewRing(size int) *Ring {
+	if size < 1 {
+		size = 1
+	}
+	return &Ring{entries: make([]Entry, size)}
+}
+
+// Emit stores a copy of e, dropping the oldest line once the ring is full.
+func (r *Ring) Emit(e *Entry) error {
+	c := *e
+	c.Data = append([]byte(nil), e.Data...)
+	c.Msg = append([]byte(nil), e.Msg...)
+	r.mu.Lock()
+	r.entries[r.next] = c
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// Flush is a no-op.
+func (r *Ring) Flush() error { return nil }
+
+// Close is a no-op, the lines stay readable.
+func (r *Ring) Close() error { return nil }
+
+// Entries returns the lines held, oldest first.
+func (r *Ring) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Entry(nil), r.entries[:r.next]...)
+	}
+	out := make([]Entry, 0, len(r.entries))
+	out = append(out, r.entries[r.next:]...)
+	return append(out, r.entries[:r.next]...)
+}
+
+// Len returns the number of lines held.
+func (r *Ring) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		return len(r.entries)
+	}
+	return r.next
+}
@@ -0,0 +1,193 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that sinks get every line, and that the ring keeps the last ones.
+func TestRingSink(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	ring := NewRing(2)
+	AddSink(ring)
+	Info("one")
+	Warningw("two", "k", "v")
+	Error("three")
+	RemoveSink(ring)
+	Info("four")
+
+	entries := ring.Entries()
+	if len(entries) != 2 || ring.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Severity != "WARNING" || string(e.Msg) != "two k=v" || e.File != "sink_test.go" {
+		t.Errorf("unexpected first entry %+v", e)
+	}
+	if e := entries[1]; e.Severity != "ERROR" || string(e.Msg) != "three" {
+		t.Errorf("unexpected second entry %+v", e)
+	}
+	if data := string(entries[1].Data); !strings.HasPrefix(data, "E[") || !strings.HasSuffix(data, ": three\n") {
+		t.Errorf("unexpected line %q", data)
+	}
+}
+
+// Test that syslog gets the message with the severity mapped to a priority.
+func TestSyslogSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsyslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewSyslog("unixgram", sock, "lwstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Emit(&Entry{Severity: "ERROR", Msg: []byte("disk full")}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	// daemon facility (3) * 8 + err severity (3)
+	if !strings.HasPrefix(got, "<27>") || !strings.Contains(got, "lwstest[") || !strings.HasSuffix(got, "disk full\n") {
+		t.Errorf("unexpected syslog message %q", got)
+	}
+}
+
+func rotatingEntry(now time.Time, msg string) *Entry {
+	return &Entry{Severity: "INFO", Time: now, Data: []byte(msg + "\n"), Msg: []byte(msg)}
+}
+
+// Test that files rotate on size and age, are compressed and pruned.
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "lws.log")
+	f, err := NewRotatingFile(path, RotateOptions{MaxSize: 10, MaxAge: time.Hour, Keep: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i, e := range []*Entry{
+		rotatingEntry(start, "aaaa"),
+		rotatingEntry(start.Add(time.Second), "bbbb"),
+		rotatingEntry(start.Add(2*time.Second), "cccc"), // too large
+		rotatingEntry(start.Add(time.Minute), "dd"),
+		rotatingEntry(start.Add(2*time.Hour), "ee"), // too large and too old
+		rotatingEntry(start.Add(2*time.Hour+time.Second), "ffff"),
+		rotatingEntry(start.Add(4*time.Hour), "g"), // too old
+	} {
+		if err := f.Emit(e); err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "g\n" {
+		t.Errorf("current file holds %q", current)
+	}
+	rotated, err := f.Rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first rotated file, from 15:04:07, was pruned
+	want := []string{
+		path + ".20060102-170405.000.gz",
+		path + ".20060102-190405.000.gz",
+	}
+	if strings.Join(rotated, " ") != strings.Join(want, " ") {
+		t.Fatalf("rotated files %v, want %v", rotated, want)
+	}
+	for i, content := range []string{"cccc\ndd\n", "ee\nffff\n"} {
+		raw, err := ioutil.ReadFile(rotated[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("%s holds %q, want %q", rotated[i], got, content)
+		}
+	}
+	if err := f.Emit(rotatingEntry(start, "late")); err == nil {
+		t.Error("expected an error writing to a closed file")
+	}
+}
+
+// Test that files merely named like the log are neither compressed nor pruned.
+func TestRotatingFileOthers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lws.log")
+	others := []string{path + ".foo", path + ".bak", path + ".1", path + ".20060102-150405.000.x", path + ".json.gz"}
+	for _, name := range others {
+		if err := ioutil.WriteFile(name, []byte("keep\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := NewRotatingFile(path, RotateOptions{MaxSize: 10, Keep: 1, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if err := f.Emit(rotatingEntry(start.Add(time.Duration(i)*time.Second), "aaaaaaaaaa")); err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := f.Rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := path + ".20060102-150408.000.gz"; len(rotated) != 1 || rotated[0] != want {
+		t.Errorf("rotated files %v, want %s", rotated, want)
+	}
+	for _, name := range others {
+		if got, err := ioutil.ReadFile(name); err != nil || string(got) != "keep\n" {
+			t.Errorf("%s holds %q, err %v", name, got, err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// outputFormat is the state of the -log-format flag. Handled atomically.
+type outputFormat int32
+
+const (
+	// textFormat is the glog style header followed by the message and
+	// key=value fields.
+	textFormat outputFormat = iota
+	// jsonFormat writes one JSON object per line with severity, time,
+	// caller, msg and the fields as keys.
+	jsonFormat
+)
+
+var formatName = []string{
+	textFormat: "text",
+	jsonFormat: "json",
+}
+
+func (f *outputFormat) get() outputFormat {
+	return outputFormat(atomic.LoadInt32((*int32)(f)))
+}
+
+func (f *outputFormat) set(val outputFormat) {
+	atomic.StoreInt32((*int32)(f), int32(val))
+}
+
+// String is part of the flag.Value interface.
+func (f *outputFormat) String() string {
+	return formatName[f.get()]
+}
+
+// Get is part of the flag.Value interface.
+func (f *outputFormat) Get() interface{} {
+	return f.get()
+}
+
+// Set is part of the flag.Value interface.
+func (f *outputFormat) Set(value string) error {
+	for i, name := range formatName {
+		if strings.EqualFold(name, value) {
+			f.set(outputFormat(i))
+			return nil
+		}
+	}
+	return errors.New("log format must be text or json")
+}
+
+// badKey labels a trailing value that has no key.
+const badKey = "!BADKEY"
+
+// finish terminates the message in buf, appends the key/value fields and
+// returns the buffer to output. In JSON mode the whole line is built here
+// from the fields header recorded in buf.
+func (l *loggingT) finish(buf *buffer, fields []interface{}) *buffer {
+	msg := buf.Bytes()
+	if n := len(msg); n > 0 && msg[n-1] == '\n' {
+		buf.Truncate(n - 1)
+	}
+	if !buf.json {
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(' ')
+			if i+1 == len(fields) {
+				buf.WriteString(badKey)
+				buf.WriteByte('=')
+				writeTextValue(buf, fields[i])
+				break
+			}
+			buf.WriteString(fmt.Sprint(fields[i]))
+			buf.WriteByte('=')
+			writeTextValue(buf, fields[i+1])
+		}
+		buf.WriteByte('\n')
+		return buf
+	}
+
+	out := l.getBuffer()
+	out.json = true
+	out.sev, out.now, out.file, out.line = buf.sev, buf.now, buf.file, buf.line
+	out.WriteString(`{"severity":`)
+	writeJSONString(out, severityName[buf.sev])
+	out.WriteString(`,"time":`)
+	writeJSONString(out, buf.now.Format("2006-01-02T15:04:05.000000Z07:00"))
+	out.WriteString(`,"caller":`)
+	writeJSONString(out, buf.file+":"+strconv.Itoa(buf.line))
+	out.WriteString(`,"msg":`)
+	writeJSONString(out, buf.String())
+	for i := 0; i < len(fields); i += 2 {
+		out.WriteByte(',')
+		if i+1 == len(fields) {
+			writeJSONString(out, badKey)
+			out.WriteByte(':')
+			writeJSONValue(out, fields[i])
+			break
+		}
+		writeJSONString(out, fmt.Sprint(fields[i]))
+		out.WriteByte(':')
+		writeJSONValue(out, fields[i+1])
+	}
+	out.WriteString("}\n")
+	l.putBuffer(buf)
+	return out
+}
+
+// addStack adds trace to the JSON line finished in buf, as its stack field.
+func addStack(buf *buffer, trace []byte) {
+	buf.Truncate(buf.Len() - len("}\n"))
+	buf.WriteString(`,"stack":`)
+	writeJSONString(buf, string(trace))
+	buf.WriteString("}\n")
+}
+
+// writeTextValue writes v, quoted if it would otherwise be ambiguous in a
+// key=value list.
+func writeTextValue(buf *buffer, v interface{}) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		s = strconv.Quote(s)
+	}
+	buf.WriteString(s)
+}
+
+func writeJSONString(buf *buffer, s string) {
+	j, _ := json.Marshal(s) // strings always marshal
+	buf.Write(j)
+}
+
+func writeJSONValue(buf *buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		writeJSONString(buf, err.Error())
+		return
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		writeJSONString(buf, fmt.Sprint(v))
+		return
+	}
+	buf.Write(bytes.TrimSpace(j))
+}
+
+// A Logger logs like the package level functions, adding its key/value
+// fields to every line:
+//
+//	l := log.With("short", slug)
+//	l.Info("redirecting")           // ... redirecting short=1B
+//	l.Infow("saved", "hits", 42)     // ... saved short=1B hits=42
+//
+// The fields are alternating keys and values. Keys are printed with
+// fmt.Sprint; a trailing value without a key is logged as !BADKEY.
+type Logger struct {
+	fields []interface{}
+	off    bool // set by V when the level is disabled
+}
+
+// With returns a Logger that adds the given key/value fields to every line.
+func With(kv ...interface{}) *Logger {
+	return &Logger{fields: append([]interface{}(nil), kv...)}
+}
+
+// With returns a Logger with the fields of l followed by kv.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{fields: fields, off: l.off}
+}
+
+// V returns l if verbosity at the call site is at least level, and a Logger
+// that discards everything otherwise. See the package level V.
+func (l *Logger) V(level Level) *Logger {
+	if l.off || logging.vEnabled(level, 1) {
+		return l
+	}
+	return &Logger{off: true}
+}
+
+// Enabled reports whether l logs anything, which is false only for Loggers
+// returned by a V call whose level is disabled.
+func (l *Logger) Enabled() bool {
+	return !l.off
+}
+
+// Info logs to the INFO log. Arguments are handled in the manner of
+// fmt.Print.
+func (l *Logger) Info(args ...interface{}) {
+	if !l.off {
+		logging.printDepth(infoLog, 0, l.fields, args...)
+	}
+}
+
+// Infof logs to the INFO log. Arguments are handled in the manner of
+// fmt.Printf.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	if !l.off {
+		logging.printfDepth(infoLog, 0, l.fields, format, args...)
+	}
+}
+
+// Infow logs msg and the fields of l followed by kv to the INFO log.
+func (l *Logger) Infow(msg string, kv ...interface{}) {
+	if !l.off {
+		logging.printDepth(infoLog, 0, l.join(kv), msg)
+	}
+}
+
+// Warning logs to the WARNING and INFO logs. Arguments are handled in the
+// manner of fmt.Print.
+func (l *Logger) Warning(args ...interface{}) {
+	if !l.off {
+		logging.printDepth(warningLog, 0, l.fields, args...)
+	}
+}
+
+// Warningf logs to the WARNING and INFO logs. Arguments are handled in the
+// manner of fmt.Printf.
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	if !l.off {
+		logging.printfDepth(warningLog, 0, l.fields, format, args...)
+	}
+}
+
+// Warningw logs msg and the fields of l followed by kv to the WARNING and
+// INFO logs.
+func (l *Logger) Warningw(msg string, kv ...interface{}) {
+	if !l.off {
+		logging.printDepth(warningLog, 0, l.join(kv), msg)
+	}
+}
+
+// Error logs to the ERROR, WARNING, and INFO logs. Arguments are handled in
+// the manner of fmt.Print.
+func (l *Logger) Error(args ...interface{}) {
+	if !l.off {
+		logging.printDepth(errorLog, 0, l.fields, args...)
+	}
+}
+
+// Errorf logs to the ERROR, WARNING, and INFO logs. Arguments are handled in
+// the manner of fmt.Printf.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	if !l.off {
+		logging.printfDepth(errorLog, 0, l.fields, format, args...)
+	}
+}
+
+// Errorw logs msg and the fields of l followed by kv to the ERROR, WARNING,
+// and INFO logs.
+func (l *Logger) Errorw(msg string, kv ...interface{}) {
+	if !l.off {
+		logging.printDepth(errorLog, 0, l.join(kv), msg)
+	}
+}
+
+// Fatal logs to the FATAL, ERROR, WARNING, and INFO logs, then exits like
+// the package level Fatal. Arguments are handled in the manner of fmt.Print.
+func (l *Logger) Fatal(args ...interface{}) {
+	logging.printDepth(fatalLog, 0, l.fields, args...)
+}
+
+// Fatalf logs to the FATAL, ERROR, WARNING, and INFO logs, then exits like
+// the package level Fatal. Arguments are handled in the manner of fmt.Printf.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	logging.printfDepth(fatalLog, 0, l.fields, format, args...)
+}
+
+// Fatalw logs msg and the fields of l followed by kv to the FATAL, ERROR,
+// WARNING, and INFO logs, then exits like the package level Fatal.
+func (l *Logger) Fatalw(msg string, kv ...interface{}) {
+	logging.printDepth(fatalLog, 0, l.join(kv), msg)
+}
+
+func (l *Logger) join(kv []interface{}) []interface{} {
+	if len(l.fields) == 0 {
+		return kv
+	}
+	return append(append(make([]interface{}, 0, len(l.fields)+len(kv)), l.fields...), kv...)
+}
+
+// Infow logs msg followed by the key/value fields kv to the INFO log.
+func Infow(msg string, kv ...interface{}) {
+	logging.printDepth(infoLog, 0, kv, msg)
+}
+
+// Warningw logs msg followed by the key/value fields kv to the WARNING and
+// INFO logs.
+func Warningw(msg string, kv ...interface{}) {
+	logging.printDepth(warningLog, 0, kv, msg)
+}
+
+// Errorw logs msg followed by the key/value fields kv to the ERROR, WARNING,
+// and INFO logs.
+func Errorw(msg string, kv ...interface{}) {
+	logging.printDepth(errorLog, 0, kv, msg)
+}
+
+// Fatalw logs msg followed by the key/value fields kv to the FATAL, ERROR,
+// WARNING, and INFO logs, then exits like Fatal.
+func Fatalw(msg string, kv ...interface{}) {
+	logging.printDepth(fatalLog, 0, kv, msg)
+}
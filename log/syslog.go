@@ -0,0 +1,49 @@
+package log
+
+import (
+	"log/syslog"
+)
+
+// Syslog is a Sink sending log lines to a syslog daemon, with the INFO,
+// WARNING, ERROR and FATAL severities mapped to the syslog ones of the same
+// names. The header is left out, syslog adds its own.
+type Syslog struct {
+	w *syslog.Writer
+}
+
+// NewSyslog connects to the syslog daemon at addr over network, or to the
+// local one over its unix socket if network is empty, logging under the
+// daemon facility with the given tag. If tag is empty the program name is
+// used.
+func NewSyslog(network, addr, tag string) (*Syslog, error) {
+	if tag == "" {
+		tag = program
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &Syslog{w: w}, nil
+}
+
+// Emit sends the message of e with its severity.
+func (s *Syslog) Emit(e *Entry) error {
+	m := string(e.Msg)
+	switch e.Severity {
+	case "FATAL":
+		return s.w.Crit(m)
+	case "ERROR":
+		return s.w.Err(m)
+	case "WARNING":
+		return s.w.Warning(m)
+	}
+	return s.w.Info(m)
+}
+
+// Flush is a no-op, lines are sent as they are logged.
+func (s *Syslog) Flush() error { return nil }
+
+// Close closes the connection to the daemon.
+func (s *Syslog) Close() error {
+	return s.w.Close()
+}
@@ -3,42 +3,234 @@ package main
 // See LICENSE for licensing info
 
 import (
+	"errors"
 	"flag"
 	"github.com/codegangsta/martini"
+	"github.com/ryansb/legowebservices/config"
+	"github.com/ryansb/legowebservices/health"
 	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/metrics"
+	"github.com/ryansb/legowebservices/persist"
 	"github.com/ryansb/legowebservices/persist/kv"
+	"github.com/ryansb/legowebservices/reqlog"
+	"github.com/ryansb/legowebservices/services/admin"
 	"github.com/ryansb/legowebservices/services/short"
 	"net/http"
 	"regexp"
+	"strings"
+	"time"
 )
 
-var host = flag.String("host", "localhost", "Bind address to listen on")
-var port = flag.String("port", ":3000", "Port to listen on")
-var useShort = flag.Bool("short", false, "Whether to run the URL shortener")
+type serverConfig struct {
+	Host string `config:"host" usage:"Bind address to listen on"`
+	Port string `config:"port" usage:"Port to listen on"`
+	DB   string `config:"db" usage:"Directory holding the tiedot database"`
 
-func main() {
+	MigrateDryRun    bool `config:"migrate_dry_run" usage:"Log the pending schema migrations and exit without applying them"`
+	DropStaleIndexes bool `config:"drop_stale_indexes" usage:"Drop the indexes no service declares"`
+
+	SlowQuery    time.Duration `config:"slow_query" usage:"Log kv queries taking longer than this, 0 to log none"`
+	CompactEvery time.Duration `config:"compact_every" usage:"Compact every collection this often, 0 to only compact from the admin UI"`
+}
+
+// logConfig mirrors the log package's flags so they can also be set from the
+// config file and environment.
+type logConfig struct {
+	V               int     `config:"v" flag:"v"`
+	VModule         string  `config:"vmodule" flag:"vmodule"`
+	ToStderr        bool    `config:"logtostderr" flag:"logtostderr"`
+	AlsoToStderr    bool    `config:"alsologtostderr" flag:"alsologtostderr"`
+	StderrThreshold string  `config:"stderrthreshold" flag:"stderrthreshold"`
+	Dir             string  `config:"dir" flag:"log_dir"`
+	Format          string  `config:"format" flag:"log-format"`
+	RateLimit       float64 `config:"rate_limit" usage:"Most INFO, WARNING and ERROR lines logged per second, each; 0 for no limit"`
+	RateBurst       int     `config:"rate_burst" usage:"Lines logged in a burst over the rate limit"`
+
+	Syslog       string        `config:"syslog" usage:"Also log to syslog: local, or network:address such as udp:loghost:514"`
+	File         string        `config:"file" usage:"Also log to this file, rotated by size and age"`
+	FileMaxSize  int64         `config:"file_max_size" usage:"Rotate the log file at this many bytes"`
+	FileMaxAge   time.Duration `config:"file_max_age" usage:"Rotate the log file once this old"`
+	FileKeep     int           `config:"file_keep" usage:"Number of rotated log files kept"`
+	FileCompress bool          `config:"file_compress" usage:"Gzip rotated log files"`
+	Ring         int           `config:"ring" usage:"Number of recent log lines shown in the admin UI"`
+}
+
+var server = &serverConfig{
+	Host: "localhost",
+	Port: ":3000",
+	DB:   "./tiedotdb",
+
+	SlowQuery: kv.SlowQuery,
+}
+
+var logConf = &logConfig{
+	FileMaxSize:  100 << 20,
+	FileMaxAge:   24 * time.Hour,
+	FileKeep:     7,
+	FileCompress: true,
+	Ring:         1000,
+}
+
+func init() {
+	// the server logs to stderr unless configured otherwise; set before
+	// registering so it becomes the default of log.logtostderr
 	log.UseStderr(true)
-	log.SetV(9)
-	flag.Parse()
+	config.Register("", server)
+	config.Register("log", logConf)
+}
+
+// apply makes the log settings take effect together, once the config is
+// loaded.
+func (c *logConfig) apply() error {
+	lc := log.Config{
+		Destination:     log.Files,
+		AlsoToStderr:    c.AlsoToStderr,
+		Dir:             c.Dir,
+		V:               c.V,
+		VModule:         c.VModule,
+		StderrThreshold: c.StderrThreshold,
+		Format:          c.Format,
+		RateLimit:       c.RateLimit,
+		RateBurst:       c.RateBurst,
+	}
+	if c.ToStderr {
+		lc.Destination = log.Stderr
+	}
+	return lc.Apply()
+}
+
+func main() {
+	err := config.Parse()
+	log.FatalIfErr(err, "Failure loading configuration err:")
+	err = logConf.apply()
+	log.FatalIfErr(err, "Failure applying log configuration err:")
+	ring, err := addLogSinks(logConf)
+	log.FatalIfErr(err, "Failure setting up logging err:")
+	switch flag.Arg(0) {
+	case "":
+	case "restore":
+		err = restore(server.DB, flag.Arg(1), flag.Arg(2))
+		log.FatalIfErr(err, "Failure restoring into %s err:", server.DB)
+		return
+	default:
+		log.Fatalf("Unknown command %q, the only one is restore", flag.Arg(0))
+	}
 	m := martini.New()
-	m.Use(martini.Logger())
+	m.Use(reqlog.Logger())
+	m.Use(metrics.Requests(routeName))
 	m.Use(martini.Recovery())
 	r := martini.NewRouter()
+	r.Get("/healthz", health.Healthz)
+	r.Get("/readyz", health.Readyz)
+	r.Get("/metrics", metrics.Handler)
 
-	tde := kv.NewTiedotEngine("./tiedotdb", []string{"short.url", "short.counter"}, kv.KeepIfExist)
-	tde.AddIndex("short.url", kv.Path{"Short"})
-	tde.AddIndex("short.counter", kv.Path{"Count"})
+	kv.SlowQuery = server.SlowQuery
+	tde := kv.NewTiedotEngine(server.DB, nil, kv.KeepIfExist)
+	var specs []kv.CollectionSpec
+	specs = append(specs, persist.Collections...)
+	specs = append(specs, short.Collections...)
+	_, err = tde.Reconcile(specs, server.DropStaleIndexes)
+	log.FatalIfErr(err, "Failure setting up collections err:")
+	applied, err := persist.Migrate(tde, server.MigrateDryRun)
+	log.FatalIfErr(err, "Failure migrating the database err:")
+	if server.MigrateDryRun {
+		log.Infof("Dry run done, migrations pending=%d", len(applied))
+		return
+	}
+	health.Register("kv", func() error { return tde.Check() })
+	if server.CompactEvery > 0 {
+		go compactEvery(tde, server.CompactEvery)
+	}
+
+	var a *admin.Admin
+	if admin.Conf.Enabled {
+		log.Info("Starting LWS.admin")
+		a = admin.New(tde, admin.Conf)
+		if ring != nil {
+			a.AddLogs(ring)
+		}
+		r.Any(admin.Prefix, stripper(admin.Prefix), a.ServeHTTP)
+		r.Any(admin.Prefix+"/.*", stripper(admin.Prefix), a.ServeHTTP)
+	}
 
-	if *useShort {
+	if short.Conf.Enabled {
 		log.Info("Starting LWS.short")
-		s := short.NewShortener(tde)
+		s := short.NewShortener(tde, short.Conf)
 		r.Any("/s", stripper("/s"), s.ServeHTTP)
 		r.Any("/s/.*", stripper("/s"), s.ServeHTTP)
+		if a != nil {
+			short.AdminPages(a, short.Conf)
+		}
 	}
 
 	m.Action(r.Handle)
-	http.ListenAndServe(*port, m)
+	http.ListenAndServe(server.Port, m)
 }
+
+// addLogSinks adds the log outputs set up in conf, and returns the ring
+// buffer shown in the admin UI if there is one.
+func addLogSinks(conf *logConfig) (*log.Ring, error) {
+	if conf.Syslog != "" {
+		network, addr := "", ""
+		if conf.Syslog != "local" {
+			i := strings.Index(conf.Syslog, ":")
+			if i < 0 {
+				return nil, errors.New("log.syslog: must be local or network:address, got " + conf.Syslog)
+			}
+			network, addr = conf.Syslog[:i], conf.Syslog[i+1:]
+		}
+		s, err := log.NewSyslog(network, addr, "")
+		if err != nil {
+			return nil, err
+		}
+		log.AddSink(s)
+	}
+	if conf.File != "" {
+		f, err := log.NewRotatingFile(conf.File, log.RotateOptions{
+			MaxSize:  conf.FileMaxSize,
+			MaxAge:   conf.FileMaxAge,
+			Keep:     conf.FileKeep,
+			Compress: conf.FileCompress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.AddSink(f)
+	}
+	if conf.Ring <= 0 {
+		return nil, nil
+	}
+	ring := log.NewRing(conf.Ring)
+	log.AddSink(ring)
+	return ring, nil
+}
+
+// routeName names the route of r in the request metrics: the endpoint, the
+// shortener's handler, or the service for the other paths under a prefix.
+func routeName(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case p == "/healthz" || p == "/readyz" || p == "/metrics":
+		return p[1:]
+	case p == admin.Prefix || strings.HasPrefix(p, admin.Prefix+"/"):
+		return "admin"
+	case p == "/s" || strings.HasPrefix(p, "/s/"):
+		rest := strings.Trim(p[len("/s"):], "/")
+		switch {
+		case rest == "" && r.Method == "GET":
+			return "short.root"
+		case rest == "" && r.Method == "POST":
+			return "short.new"
+		case rest != "" && !strings.Contains(rest, "/") && r.Method == "GET":
+			return "short.retrieve"
+		case rest != "" && !strings.Contains(rest, "/") && r.Method == "DELETE":
+			return "short.remove"
+		}
+		return "short"
+	}
+	return "other"
+}
+
 func stripper(p string) func(http.ResponseWriter, *http.Request) {
 	re := regexp.MustCompile("^" + p)
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"github.com/codegangsta/martini"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var requests = NewCounterVec("lws_http_requests_total",
+	"HTTP requests served, by route, method and status code.",
+	"route", "method", "code")
+
+var latency = NewHistogramVec("lws_http_request_duration_seconds",
+	"Time taken to serve HTTP requests, by route and method.",
+	nil, "route", "method")
+
+// Requests returns a martini middleware that counts and times every request
+// under the route name returns for it, as it came in. Use it once, before
+// the router:
+//
+//	m.Use(metrics.Requests(routeName))
+func Requests(route func(*http.Request) string) martini.Handler {
+	return func(c martini.Context, w martini.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		name, method := route(r), r.Method
+		c.Next()
+		observe(name, method, w.Status(), time.Since(start))
+	}
+}
+
+// observe records a request to route that got status after d.
+func observe(route, method string, status int, d time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	requests.With(route, method, strconv.Itoa(status)).Inc()
+	latency.Observe(d.Seconds(), route, method)
+}
@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"github.com/ryansb/legowebservices/log"
+)
+
+func init() {
+	NewFunc("lws_log_lines_total", "Lines written by the log package, by severity.", CounterType,
+		func() []Sample { return logStats((*log.OutputStats).Lines) })
+	NewFunc("lws_log_bytes_total", "Bytes written by the log package, by severity.", CounterType,
+		func() []Sample { return logStats((*log.OutputStats).Bytes) })
+	NewFunc("lws_log_dropped_total", "Lines dropped by the log rate limit, by severity.", CounterType,
+		func() []Sample { return logStats((*log.OutputStats).Dropped) })
+}
+
+func logStats(f func(*log.OutputStats) int64) []Sample {
+	return []Sample{
+		{Labels: []Label{{"severity", "info"}}, Value: float64(f(&log.Stats.Info))},
+		{Labels: []Label{{"severity", "warning"}}, Value: float64(f(&log.Stats.Warning))},
+		{Labels: []Label{{"severity", "error"}}, Value: float64(f(&log.Stats.Error))},
+	}
+}
@@ -0,0 +1,365 @@
+// Package metrics keeps process wide counters, gauges and histograms and
+// exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types as written on the # TYPE line.
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+)
+
+// Label is a single name="value" pair attached to a sample.
+type Label struct {
+	Name, Value string
+}
+
+// Sample is one line of output. Suffix is appended to the metric name, and is
+// used by histograms for their _bucket, _sum and _count series.
+type Sample struct {
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+// Collector is anything that can be registered and scraped.
+type Collector interface {
+	Describe() (name, help, typ string)
+	Collect() []Sample
+}
+
+var (
+	mu         sync.Mutex
+	collectors = make(map[string]Collector)
+)
+
+// Register adds c to the set of exported metrics. It panics if a metric with
+// the same name is already registered.
+func Register(c Collector) {
+	name, _, _ := c.Describe()
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := collectors[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+	collectors[name] = c
+}
+
+// Unregister removes the metric called name, if any.
+func Unregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(collectors, name)
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteText(w)
+}
+
+// WriteText writes every registered metric to w, sorted by name.
+func WriteText(w io.Writer) error {
+	mu.Lock()
+	names := make([]string, 0, len(collectors))
+	for n := range collectors {
+		names = append(names, n)
+	}
+	cs := make([]Collector, len(names))
+	sort.Strings(names)
+	for i, n := range names {
+		cs[i] = collectors[n]
+	}
+	mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range cs {
+		name, help, typ := c.Describe()
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, typ)
+		for _, s := range c.Collect() {
+			buf.WriteString(name)
+			buf.WriteString(s.Suffix)
+			writeLabels(&buf, s.Labels)
+			buf.WriteByte(' ')
+			buf.WriteString(formatFloat(s.Value))
+			buf.WriteByte('\n')
+		}
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func writeLabels(buf *bytes.Buffer, labels []Label) {
+	if len(labels) == 0 {
+		return
+	}
+	buf.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(l.Name)
+		buf.WriteString(`="`)
+		buf.WriteString(labelEscaper.Replace(l.Value))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	name, help string
+	n          uint64
+}
+
+// NewCounter registers and returns a new counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	Register(c)
+	return c
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+func (c *Counter) Describe() (string, string, string) {
+	return c.name, c.help, CounterType
+}
+
+func (c *Counter) Collect() []Sample {
+	return []Sample{{Value: float64(c.Value())}}
+}
+
+// CounterVec is a family of counters told apart by their label values.
+type CounterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	counters   map[string]*Counter
+	values     map[string][]string
+}
+
+// NewCounterVec registers and returns a counter family with the given label
+// names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		counters: make(map[string]*Counter),
+		values:   make(map[string][]string),
+	}
+	Register(v)
+	return v
+}
+
+// With returns the counter for the given label values, creating it if needed.
+// The values must be in the same order as the label names.
+func (v *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[key]
+	if !ok {
+		c = &Counter{name: v.name}
+		v.counters[key] = c
+		v.values[key] = values
+	}
+	return c
+}
+
+func (v *CounterVec) Describe() (string, string, string) {
+	return v.name, v.help, CounterType
+}
+
+func (v *CounterVec) Collect() []Sample {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var out []Sample
+	for _, key := range sortedKeys(v.values) {
+		out = append(out, Sample{
+			Labels: pairs(v.labels, v.values[key]),
+			Value:  float64(v.counters[key].Value()),
+		})
+	}
+	return out
+}
+
+// DefBuckets are the default histogram buckets, in seconds, suited to HTTP
+// request latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a family of histograms told apart by their label values.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	hists      map[string]*histogram
+	values     map[string][]string
+}
+
+// NewHistogramVec registers and returns a histogram family. A nil buckets
+// slice uses DefBuckets.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	v := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		hists:   make(map[string]*histogram),
+		values:  make(map[string][]string),
+	}
+	Register(v)
+	return v
+}
+
+// Observe records x in the histogram for the given label values.
+func (v *HistogramVec) Observe(x float64, values ...string) {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.hists[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.hists[key] = h
+		v.values[key] = values
+	}
+	if i := sort.SearchFloat64s(v.buckets, x); i < len(v.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += x
+}
+
+func (v *HistogramVec) Describe() (string, string, string) {
+	return v.name, v.help, HistogramType
+}
+
+func (v *HistogramVec) Collect() []Sample {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var out []Sample
+	for _, key := range sortedKeys(v.values) {
+		h, labels := v.hists[key], pairs(v.labels, v.values[key])
+		var cumulative uint64
+		for i, b := range v.buckets {
+			cumulative += h.counts[i]
+			out = append(out, Sample{
+				Suffix: "_bucket",
+				Labels: append(labels[:len(labels):len(labels)], Label{"le", formatFloat(b)}),
+				Value:  float64(cumulative),
+			})
+		}
+		out = append(out,
+			Sample{Suffix: "_bucket", Labels: append(labels[:len(labels):len(labels)], Label{"le", "+Inf"}), Value: float64(h.count)},
+			Sample{Suffix: "_sum", Labels: labels, Value: h.sum},
+			Sample{Suffix: "_count", Labels: labels, Value: float64(h.count)},
+		)
+	}
+	return out
+}
+
+// Func is a metric whose samples are computed at scrape time.
+type Func struct {
+	name, help, typ string
+	f               func() []Sample
+}
+
+// NewFunc registers a metric of type typ whose samples are returned by f.
+func NewFunc(name, help, typ string, f func() []Sample) *Func {
+	fn := &Func{name: name, help: help, typ: typ, f: f}
+	Register(fn)
+	return fn
+}
+
+// NewGaugeFunc registers a gauge whose single value is returned by f.
+func NewGaugeFunc(name, help string, f func() float64) *Func {
+	return NewFunc(name, help, GaugeType, func() []Sample {
+		return []Sample{{Value: f()}}
+	})
+}
+
+func (f *Func) Describe() (string, string, string) {
+	return f.name, f.help, f.typ
+}
+
+func (f *Func) Collect() []Sample {
+	return f.f()
+}
+
+func pairs(names, values []string) []Label {
+	labels := make([]Label, len(names))
+	for i := range names {
+		labels[i] = Label{names[i], values[i]}
+	}
+	return labels
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func expect(t *testing.T, out string, lines ...string) {
+	for _, l := range lines {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("missing line %q in output:\n%s", l, out)
+		}
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A test counter.")
+	defer Unregister("test_counter_total")
+	c.Inc()
+	c.Add(2)
+	expect(t, scrape(t),
+		"# HELP test_counter_total A test counter.",
+		"# TYPE test_counter_total counter",
+		"test_counter_total 3",
+	)
+}
+
+func TestCounterVec(t *testing.T) {
+	v := NewCounterVec("test_vec_total", "A test family.", "route", "code")
+	defer Unregister("test_vec_total")
+	v.With("short.new", "200").Inc()
+	v.With("short.new", "200").Inc()
+	v.With(`we"ird`, "500").Inc()
+	expect(t, scrape(t),
+		`test_vec_total{route="short.new",code="200"} 2`,
+		`test_vec_total{route="we\"ird",code="500"} 1`,
+	)
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "route")
+	defer Unregister("test_seconds")
+	h.Observe(0.05, "a")
+	h.Observe(0.5, "a")
+	h.Observe(5, "a")
+	expect(t, scrape(t),
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{route="a",le="0.1"} 1`,
+		`test_seconds_bucket{route="a",le="1"} 2`,
+		`test_seconds_bucket{route="a",le="+Inf"} 3`,
+		`test_seconds_sum{route="a"} 5.55`,
+		`test_seconds_count{route="a"} 3`,
+	)
+}
+
+func TestFunc(t *testing.T) {
+	depth := 7
+	NewGaugeFunc("test_depth", "A test gauge.", func() float64 { return float64(depth) })
+	defer Unregister("test_depth")
+	expect(t, scrape(t), "# TYPE test_depth gauge", "test_depth 7")
+	depth = 2
+	expect(t, scrape(t), "test_depth 2")
+}
+
+func TestLogStats(t *testing.T) {
+	expect(t, scrape(t), "# TYPE lws_log_lines_total counter")
+	if !strings.Contains(scrape(t), `lws_log_bytes_total{severity="error"}`) {
+		t.Error("log byte counts missing")
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	NewCounter("test_twice", "")
+	defer Unregister("test_twice")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering the same name twice should panic")
+		}
+	}()
+	NewCounter("test_twice", "")
+}
+
+func TestObserve(t *testing.T) {
+	observe("test.route", "GET", 0, 50*time.Millisecond)
+	observe("test.route", "GET", 404, time.Second)
+	expect(t, scrape(t),
+		`lws_http_requests_total{route="test.route",method="GET",code="200"} 1`,
+		`lws_http_requests_total{route="test.route",method="GET",code="404"} 1`,
+		`lws_http_request_duration_seconds_count{route="test.route",method="GET"} 2`,
+	)
+}
@@ -0,0 +1,280 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tiedot "github.com/HouzuoGuo/tiedot/db"
+	"github.com/ryansb/legowebservices/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A dump is newline-delimited JSON. The first line gives the format version,
+// then each collection has a line naming it and its indexes, followed by one
+// line per document:
+//
+//	{"version":1}
+//	{"collection":"short.url","indexes":[["Short"]]}
+//	{"collection":"short.url","id":3,"doc":{"Original":"http://example.com","Short":1}}
+const DumpVersion = 1
+
+type dumpHeader struct {
+	Version int `json:"version"`
+}
+
+type dumpCollection struct {
+	Collection string `json:"collection"`
+	Indexes    []Path `json:"indexes"`
+}
+
+type dumpDoc struct {
+	Collection string                 `json:"collection"`
+	ID         uint64                 `json:"id"`
+	Doc        map[string]interface{} `json:"doc"`
+}
+
+// dumpRecord is any line of a dump.
+type dumpRecord struct {
+	Version    int             `json:"version"`
+	Collection string          `json:"collection"`
+	Indexes    []Path          `json:"indexes"`
+	ID         *uint64         `json:"id"`
+	Doc        json.RawMessage `json:"doc"`
+}
+
+// Renumbered is a line Restore writes for a document tiedot gave another ID
+// than the one it had in the dump.
+type Renumbered struct {
+	Collection string `json:"collection"`
+	ID         uint64 `json:"id"`
+	NewID      uint64 `json:"new_id"`
+}
+
+// ErrRenumbered is returned by Restore, without a place for the new IDs,
+// when a document of the dump got a new one.
+type ErrRenumbered struct {
+	Line int
+	Renumbered
+}
+
+func (e *ErrRenumbered) Error() string {
+	return fmt.Sprintf("legowebservices/persist/kv: Dump line %d: document %d of collection %s was restored as %d", e.Line, e.ID, e.Collection, e.NewID)
+}
+
+// Dump writes every collection, with its indexes and documents, to w. The
+// dump is consistent across collections: it is taken with Snapshot, so
+// changes made through the engine only wait for the disk and not for w.
+func (t *TiedotEngine) Dump(w io.Writer) error {
+	f, _, err := t.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Snapshot dumps the database into a temporary file, while changes made
+// through the engine wait, and returns it rewound to the start along with
+// its size. The caller closes and removes the file.
+func (t *TiedotEngine) Snapshot() (*os.File, int64, error) {
+	f, err := ioutil.TempFile("", "lws-dump")
+	if err != nil {
+		return nil, 0, err
+	}
+	t.writes.Lock()
+	err = t.dump(f)
+	t.writes.Unlock()
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, os.SEEK_CUR)
+	}
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// dump writes the database to w. t.writes is held.
+func (t *TiedotEngine) dump(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(dumpHeader{Version: DumpVersion}); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(t.tiedot.StrCol))
+	for name := range t.tiedot.StrCol {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	docs := 0
+	for _, name := range names {
+		col := t.tiedot.StrCol[name]
+		if err := enc.Encode(dumpCollection{Collection: name, Indexes: indexes(col)}); err != nil {
+			return err
+		}
+		var err error
+		col.ForAll(func(id uint64, doc map[string]interface{}) bool {
+			err = enc.Encode(dumpDoc{Collection: name, ID: id, Doc: doc})
+			docs++
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	log.V(1).Infof("Dumped collections=%d documents=%d", len(names), docs)
+	return nil
+}
+
+// indexes returns the indexed paths of col, sorted.
+func indexes(col *tiedot.Col) []Path {
+	keys := make([]string, 0, len(col.SecIndexes))
+	for k := range col.SecIndexes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	paths := make([]Path, len(keys))
+	for i, k := range keys {
+		paths[i] = Path(strings.Split(k, tiedot.INDEX_PATH_SEP))
+	}
+	return paths
+}
+
+// Restore reads a dump written by Dump and adds its collections, indexes and
+// documents to the database. Collections that don't exist are created, and
+// those that do must be empty.
+//
+// tiedot picks the ID of each document it inserts, and gives documents their
+// old IDs back only when their collection had none deleted. Anything holding
+// an ID, from stored documents to links into the admin UI, would then find
+// another document or none, so Restore fails on the first document getting a
+// new ID, keeping those restored so far, unless renumbered is given. In that
+// case each document restored under a new ID is written to renumbered as a
+// line of JSON, see Renumbered, for the holders of IDs to be fixed.
+func (t *TiedotEngine) Restore(r io.Reader, renumbered io.Writer) error {
+	t.writes.Lock()
+	defer t.writes.Unlock()
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var head dumpRecord
+	if err := dec.Decode(&head); err != nil {
+		return fmt.Errorf("legowebservices/persist/kv: Reading dump header: %v", err)
+	}
+	if head.Version < 1 || head.Version > DumpVersion {
+		return fmt.Errorf("legowebservices/persist/kv: Unsupported dump version %d", head.Version)
+	}
+	seen := make(map[string]bool)
+	defer func() {
+		// the documents went in without events
+		for c := range seen {
+			t.refillText(c)
+		}
+	}()
+	var ids *json.Encoder
+	var bw *bufio.Writer
+	if renumbered != nil {
+		bw = bufio.NewWriter(renumbered)
+		ids = json.NewEncoder(bw)
+	}
+	docs, renumberedDocs := 0, 0
+	for line := 2; ; line++ {
+		var rec dumpRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("legowebservices/persist/kv: Dump line %d: %v", line, err)
+		}
+		if rec.Doc == nil {
+			if seen[rec.Collection] {
+				return fmt.Errorf("legowebservices/persist/kv: Dump line %d: collection %s appears twice", line, rec.Collection)
+			}
+			seen[rec.Collection] = true
+			if err := t.restoreCollection(rec.Collection, rec.Indexes); err != nil {
+				return fmt.Errorf("legowebservices/persist/kv: Dump line %d: %v", line, err)
+			}
+			continue
+		}
+		if !seen[rec.Collection] {
+			return fmt.Errorf("legowebservices/persist/kv: Dump line %d: document of undeclared collection %s", line, rec.Collection)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(rec.Doc, &doc); err != nil || doc == nil {
+			return fmt.Errorf("legowebservices/persist/kv: Dump line %d: document is not an object", line)
+		}
+		if rec.ID == nil {
+			return fmt.Errorf("legowebservices/persist/kv: Dump line %d: document has no id", line)
+		}
+		id, err := t.tiedot.Use(rec.Collection).Insert(doc)
+		if err != nil {
+			return fmt.Errorf("legowebservices/persist/kv: Dump line %d: %v", line, err)
+		}
+		docs++
+		if id == *rec.ID {
+			continue
+		}
+		moved := Renumbered{Collection: rec.Collection, ID: *rec.ID, NewID: id}
+		if ids == nil {
+			return &ErrRenumbered{Line: line, Renumbered: moved}
+		}
+		if err := ids.Encode(moved); err != nil {
+			return err
+		}
+		renumberedDocs++
+	}
+	if bw != nil {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	if renumberedDocs > 0 {
+		log.Warningf("Restored collections=%d documents=%d renumbered=%d", len(seen), docs, renumberedDocs)
+	} else {
+		log.Infof("Restored collections=%d documents=%d", len(seen), docs)
+	}
+	return nil
+}
+
+// restoreCollection creates the named collection unless it exists empty, and
+// adds the missing indexes. t.writes is held.
+func (t *TiedotEngine) restoreCollection(name string, paths []Path) error {
+	if name == "" {
+		return errors.New("collection has no name")
+	}
+	if _, ok := t.tiedot.StrCol[name]; ok {
+		r := make(map[uint64]struct{})
+		if err := tiedot.EvalQuery("all", t.tiedot.Use(name), &r); err != nil {
+			return err
+		}
+		if len(r) > 0 {
+			return fmt.Errorf("collection %s is not empty", name)
+		}
+	} else if err := t.tiedot.Create(name, 1); err != nil {
+		return err
+	}
+	col := t.tiedot.Use(name)
+	for _, p := range paths {
+		if _, ok := col.SecIndexes[strings.Join(p, tiedot.INDEX_PATH_SEP)]; ok {
+			continue
+		}
+		if err := col.Index(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
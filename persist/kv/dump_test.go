@@ -0,0 +1,144 @@
+package kv
+
+import (
+	"bytes"
+	. "github.com/ryansb/legowebservices/util/m"
+	. "launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+type DumpS struct{}
+
+var _ = Suite(&DumpS{})
+
+func (s *DumpS) engine(c *C, collections ...string) *TiedotEngine {
+	return NewTiedotEngine(c.MkDir(), collections, KeepIfExist)
+}
+
+func (s *DumpS) TestRoundTrip(c *C) {
+	src := s.engine(c, "short.url", "short.counter")
+	src.AddIndex("short.url", Path{"Short"})
+	for _, doc := range []M{
+		{"Original": "http://example.com/a", "Short": 1},
+		{"Original": "http://example.com/b", "Short": 2},
+	} {
+		_, err := src.Insert("short.url", doc)
+		c.Assert(err, IsNil)
+	}
+	_, err := src.Insert("short.counter", M{"Count": 2})
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(src.Dump(&buf), IsNil)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 6)
+	c.Check(lines[0], Equals, `{"version":1}`)
+	c.Check(lines[1], Equals, `{"collection":"short.counter","indexes":[]}`)
+	c.Check(lines[2], Equals, `{"collection":"short.counter","id":1,"doc":{"Count":2}}`)
+	c.Check(lines[3], Equals, `{"collection":"short.url","indexes":[["Short"]]}`)
+
+	dst := s.engine(c, "short.url")
+	c.Assert(dst.Restore(&buf, nil), IsNil)
+	c.Check(dst.Check("short.url", "short.counter"), IsNil)
+	c.Check(dst.DB().Use("short.url").SecIndexes, HasLen, 1)
+	var got struct{ Original string }
+	_, err = dst.Query("short.url").Equals(Path{"Short"}, 2).OneInto(&got)
+	c.Assert(err, IsNil)
+	c.Check(got.Original, Equals, "http://example.com/b")
+	all, err := dst.All("short.counter")
+	c.Assert(err, IsNil)
+	c.Check(all, HasLen, 1)
+}
+
+// stalled is a writer that blocks until release is closed, saying so on
+// started.
+type stalled struct {
+	started, release chan bool
+	once             bool
+}
+
+func (w *stalled) Write(b []byte) (int, error) {
+	if !w.once {
+		w.once = true
+		close(w.started)
+	}
+	<-w.release
+	return len(b), nil
+}
+
+func (s *DumpS) TestSlowWriter(c *C) {
+	e := s.engine(c, "a")
+	e.Insert("a", M{"N": 1})
+	w := &stalled{started: make(chan bool), release: make(chan bool)}
+	done := make(chan error)
+	go func() { done <- e.Dump(w) }()
+	<-w.started
+
+	// writes go on while the dump is stuck sending
+	inserted := make(chan bool)
+	go func() {
+		e.Insert("a", M{"N": 2})
+		close(inserted)
+	}()
+	select {
+	case <-inserted:
+	case <-time.After(5 * time.Second):
+		c.Error("insert waited for the dump to be sent")
+	}
+	close(w.release)
+	c.Check(<-done, IsNil)
+}
+
+func (s *DumpS) TestRestoreErrors(c *C) {
+	full := s.engine(c, "short.url")
+	_, err := full.Insert("short.url", M{"Short": 1})
+	c.Assert(err, IsNil)
+
+	for _, t := range []struct {
+		dump, err string
+		e         *TiedotEngine
+	}{
+		{``, ".*Reading dump header: EOF", nil},
+		{`{"version":2}`, ".*Unsupported dump version 2", nil},
+		{"{\"version\":1}\n{\"collection\":\"a\"}\n{\"collection\":\"a\"}", ".*line 3: collection a appears twice", nil},
+		{"{\"version\":1}\n{\"collection\":\"a\",\"doc\":{}}", ".*line 2: document of undeclared collection a", nil},
+		{"{\"version\":1}\n{\"collection\":\"a\"}\n{\"collection\":\"a\",\"doc\":null}", ".*line 3: document is not an object", nil},
+		{"{\"version\":1}\n{\"collection\":\"a\"}\n{\"coll", ".*line 3: unexpected EOF", nil},
+		{"{\"version\":1}\n{\"collection\":\"a\"}\n{\"collection\":\"a\",\"doc\":{}}", ".*line 3: document has no id", nil},
+		{"{\"version\":1}\n{\"collection\":\"short.url\"}", ".*line 2: collection short.url is not empty", full},
+	} {
+		e := t.e
+		if e == nil {
+			e = s.engine(c)
+		}
+		c.Check(e.Restore(strings.NewReader(t.dump), nil), ErrorMatches, t.err, Commentf("dump %q", t.dump))
+	}
+}
+
+func (s *DumpS) TestRenumbered(c *C) {
+	src := s.engine(c, "a")
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		id, _ := src.Insert("a", M{"N": i})
+		ids = append(ids, id)
+	}
+	src.Delete("a", ids[0])
+	var buf bytes.Buffer
+	c.Assert(src.Dump(&buf), IsNil)
+	dump := buf.String()
+
+	// without a place for the new IDs, restoring stops at the first
+	err := s.engine(c).Restore(strings.NewReader(dump), nil)
+	c.Check(err, ErrorMatches, ".*line 3: document 2 of collection a was restored as 1")
+
+	var renumbered bytes.Buffer
+	dst := s.engine(c)
+	c.Assert(dst.Restore(strings.NewReader(dump), &renumbered), IsNil)
+	c.Check(renumbered.String(), Equals, `{"collection":"a","id":2,"new_id":1}
+{"collection":"a","id":3,"new_id":2}
+`)
+	var doc M
+	c.Assert(dst.Read("a", 2, &doc), IsNil)
+	c.Check(doc["N"], Equals, 2.0)
+}
@@ -0,0 +1,127 @@
+package kv
+
+import (
+	"encoding/json"
+	tiedot "github.com/HouzuoGuo/tiedot/db"
+	"github.com/ryansb/legowebservices/log"
+	"strings"
+	"time"
+)
+
+// SlowQuery is how long a query may take before it is logged, with its
+// collection and JSON. Zero logs none.
+var SlowQuery = 100 * time.Millisecond
+
+// How tiedot runs a clause.
+const (
+	// IndexLookup reads the documents an index holds for the value.
+	IndexLookup = "index lookup"
+	// IndexScan goes through every entry of an index.
+	IndexScan = "index scan"
+	// TextSearch searches a text index, for Match.
+	TextSearch = "text search"
+	// NoIndex means the clause fails, as its path isn't indexed.
+	NoIndex = "no index"
+)
+
+// Plan says how a query runs, see Query.Explain.
+type Plan struct {
+	Collection string
+	Clauses    []ClausePlan
+	// Estimate is how many documents the query may return: the clauses
+	// match a union, so it is their sum, up to Docs.
+	Estimate int
+	Docs     int // in the collection
+}
+
+// ClausePlan says how one clause of a query runs.
+type ClausePlan struct {
+	Clause string // as in Query.JSON
+	Path   Path
+	Access string // IndexLookup, IndexScan, TextSearch or NoIndex
+	// Estimate is exact for index lookups and text searches, which Explain
+	// runs, and the number of documents in the collection for scans and
+	// Params.
+	Estimate int
+}
+
+func (p *Plan) String() string {
+	s := make([]string, len(p.Clauses))
+	for i, c := range p.Clauses {
+		s[i] = c.Access + " on " + strings.Join(c.Path, tiedot.INDEX_PATH_SEP)
+	}
+	return strings.Join(s, ", ")
+}
+
+// Explain reports how each clause of q uses the indexes of the collection,
+// and how many documents it may match. Only index lookups and text searches
+// are run.
+func (q *Query) Explain() (*Plan, error) {
+	q.t.scrub.RLock()
+	defer q.t.scrub.RUnlock()
+	col := q.use()
+	all := make(map[uint64]struct{})
+	if err := tiedot.EvalQuery("all", col, &all); err != nil {
+		return nil, err
+	}
+	p := &Plan{Collection: q.name, Docs: len(all)}
+	for i, c := range q.q {
+		j, _ := json.Marshal(c)
+		cp := ClausePlan{Clause: string(j), Estimate: len(all)}
+		path, ok := c["in"].(Path)
+		if !ok {
+			path, _ = c["has"].(Path)
+		}
+		cp.Path = path
+		if m, ok := q.native[i].(matchClause); ok {
+			cp.Access, cp.Estimate = NoIndex, 0
+			if idx := q.t.textIndex(q.name, m.path); idx != nil {
+				cp.Access, cp.Estimate = TextSearch, len(idx.Search(m.text))
+			}
+			p.Estimate += cp.Estimate
+			p.Clauses = append(p.Clauses, cp)
+			continue
+		}
+		clause := q.native[i].(map[string]interface{})
+		_, isParam := clause["eq"].(Param)
+		_, eq := c["eq"]
+		_, between := c["int from"]
+		switch {
+		case !indexed(col, path):
+			cp.Access, cp.Estimate = NoIndex, 0
+		case eq || between:
+			cp.Access = IndexLookup
+			if isParam {
+				break
+			}
+			res := make(map[uint64]struct{})
+			if err := tiedot.EvalQuery(clause, col, &res); err != nil {
+				return nil, err
+			}
+			cp.Estimate = len(res)
+		default:
+			cp.Access = IndexScan
+		}
+		p.Estimate += cp.Estimate
+		p.Clauses = append(p.Clauses, cp)
+	}
+	if p.Estimate > p.Docs {
+		p.Estimate = p.Docs
+	}
+	return p, nil
+}
+
+func indexed(col *tiedot.Col, p Path) bool {
+	_, ok := col.SecIndexes[strings.Join(p, tiedot.INDEX_PATH_SEP)]
+	return ok
+}
+
+// logSlow logs q if it took longer than SlowQuery since start.
+func (q *Query) logSlow(start time.Time) {
+	if SlowQuery <= 0 {
+		return
+	}
+	if d := time.Since(start); d >= SlowQuery {
+		log.Warningf("Slow query collection=%s duration=%s query=%s", q.name, d, q.JSON())
+	}
+}
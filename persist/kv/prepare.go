@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/ryansb/legowebservices/util/m"
+)
+
+// ErrUnboundParam is returned by queries run with a Param in place of a
+// value, instead of through Prepare and With.
+var ErrUnboundParam = errors.New("legowebservices/persist/kv: Query has a Param without a value")
+
+// Param stands in a query for the value given to Prepared.With. Params are
+// numbered from 0, in the order of the arguments of With.
+type Param int
+
+// Prepared is a query built once and run many times with different values,
+// see Query.Prepare. It is safe for concurrent use.
+type Prepared struct {
+	q      Query
+	params []boundParam
+	n      int // number of values With takes
+}
+
+// boundParam says where Param n sits in the query.
+type boundParam struct {
+	clause int
+	n      Param
+}
+
+// Prepare returns q for running again with the values of its Params, as in
+//
+//	byShort := tde.Query("short.url").Equals(kv.Path{"Short"}, kv.Param(0)).Prepare()
+//	id, err := byShort.With(n).OneInto(out)
+//
+// It panics if the Params aren't numbered 0, 1, ... as that can't work.
+func (q *Query) Prepare() *Prepared {
+	p := &Prepared{q: *q}
+	// full slices, so that appending to q or to the queries of With copies
+	p.q.q = q.q[:len(q.q):len(q.q)]
+	p.q.native = q.native[:len(q.native):len(q.native)]
+	seen := make(map[Param]bool)
+	for i, c := range q.native {
+		clause, _ := c.(map[string]interface{})
+		if n, ok := clause["eq"].(Param); ok {
+			p.params = append(p.params, boundParam{clause: i, n: n})
+			seen[n] = true
+		}
+	}
+	p.n = len(seen)
+	for n := range seen {
+		if n < 0 || int(n) >= p.n {
+			panic(fmt.Sprintf("legowebservices/persist/kv: Params of query=%s must be numbered from 0 without gaps", q.JSON()))
+		}
+	}
+	p.q.params = 0
+	return p
+}
+
+// With returns the prepared query with values in place of its Params. It
+// panics if it isn't given one value per Param.
+func (p *Prepared) With(values ...interface{}) *Query {
+	if len(values) != p.n {
+		panic(fmt.Sprintf("legowebservices/persist/kv: Prepared query wants %d values, got %d", p.n, len(values)))
+	}
+	q := p.q
+	if len(p.params) == 0 {
+		return &q
+	}
+	q.q = append([]M(nil), q.q...)
+	q.native = append([]interface{}(nil), q.native...)
+	for _, b := range p.params {
+		v := values[b.n]
+		q.q[b.clause] = M{"in": p.q.q[b.clause]["in"], "eq": v}
+		q.native[b.clause] = map[string]interface{}{
+			"in": p.q.native[b.clause].(map[string]interface{})["in"],
+			"eq": nativeValue(v),
+		}
+	}
+	return &q
+}
@@ -5,32 +5,92 @@ import (
 	tiedot "github.com/HouzuoGuo/tiedot/db"
 	"github.com/ryansb/legowebservices/log"
 	. "github.com/ryansb/legowebservices/util/m"
+	"time"
 )
 
+// Equals matches documents whose value at p is v. v may be a Param, for a
+// query to Prepare.
 func (q *Query) Equals(p Path, v interface{}) *Query {
-	log.V(6).Infof("QueryBuilder: Path=%v Term=%v Value=%v", p, "Equals", v)
+	log.V(6).Every(100).Infof("QueryBuilder: Path=%v Term=%v Value=%v", p, "Equals", v)
 	q.q = append(q.q, M{"in": p, "eq": v})
+	if _, ok := v.(Param); ok {
+		q.params++
+	} else {
+		v = nativeValue(v)
+	}
+	q.native = append(q.native, map[string]interface{}{"in": p.native(), "eq": v})
 	return q
 }
 
 func (q *Query) Between(p Path, start, end int64) *Query {
-	log.V(6).Infof("QueryBuilder: Path=%v Between %d and %d", p, start, end)
+	log.V(6).Every(100).Infof("QueryBuilder: Path=%v Between %d and %d", p, start, end)
 	q.q = append(q.q, M{"in": p, "int from": start, "int to": end})
+	q.native = append(q.native, map[string]interface{}{"in": p.native(), "int from": float64(start), "int to": float64(end)})
 	return q
 }
 
 func (q *Query) Regexp(p Path, expr string) *Query {
-	log.V(6).Infof("QueryBuilder: Path=%v Regexp=%s", p, expr)
+	log.V(6).Every(100).Infof("QueryBuilder: Path=%v Regexp=%s", p, expr)
 	q.q = append(q.q, M{"in": p, "re": expr})
+	q.native = append(q.native, map[string]interface{}{"in": p.native(), "re": expr})
 	return q
 }
 
 func (q *Query) Has(p Path) *Query {
-	log.V(6).Infof("QueryBuilder: HasPath=%v", p)
+	log.V(6).Every(100).Infof("QueryBuilder: HasPath=%v", p)
 	q.q = append(q.q, M{"has": p})
+	q.native = append(q.native, map[string]interface{}{"has": p.native()})
 	return q
 }
 
+// native returns p the way tiedot takes paths in queries.
+func (p Path) native() []interface{} {
+	n := make([]interface{}, len(p))
+	for i, s := range p {
+		n[i] = s
+	}
+	return n
+}
+
+// nativeValue returns v as it would be after a JSON round trip, since tiedot
+// compares it with documents decoded from JSON: numbers become float64.
+func nativeValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case nil, bool, string, float64:
+		return v
+	case int:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint:
+		return float64(n)
+	case uint8:
+		return float64(n)
+	case uint16:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Failure serializing query value=%v err=%v", v, err)
+		return nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(j, &out); err != nil {
+		log.Errorf("Failure deserializing query value=%s err=%v", j, err)
+	}
+	return out
+}
+
 func (q *Query) All() (res ResultSet, err error) {
 	r, err := q.eval()
 	if err != nil {
@@ -55,14 +115,19 @@ func (q *Query) OneInto(out interface{}) (uint64, error) {
 		return 0, err
 	}
 	for k, _ := range r {
-		log.V(2).Infof("Found id=%d kv.Query.OneInto()", k)
-		if _, err := q.col.Read(k, out); err != nil {
+		log.V(2).Every(100).Infof("Found id=%d kv.Query.OneInto()", k)
+		q.t.scrub.RLock()
+		_, err := q.use().Read(k, out)
+		q.t.scrub.RUnlock()
+		if err != nil {
 			log.Errorf("Failure reading id=%d err=%s", k, err.Error())
 			return 0, err
 		}
 		return k, nil
 	}
-	log.V(1).Infof("Nothing found for query=%s", q.JSON())
+	if log.V(1).Sometimes(time.Second) {
+		log.Infof("Nothing found for query=%s", q.JSON())
+	}
 	return 0, ErrNotFound
 }
 
@@ -78,10 +143,12 @@ func (q *Query) One() (uint64, interface{}, error) {
 			log.Errorf("Failure reading id=%d err=%v", id, err)
 			return id, nil, err
 		}
-		log.V(2).Infof("Found id=%d val=%v for kv.Query.One()", id, v)
+		log.V(2).Every(100).Infof("Found id=%d val=%v for kv.Query.One()", id, v)
 		return id, v, nil
 	}
-	log.V(1).Infof("Nothing found for query=%v", q.JSON())
+	if log.V(1).Sometimes(time.Second) {
+		log.Infof("Nothing found for query=%s", q.JSON())
+	}
 	return 0, nil, ErrNotFound
 }
 
@@ -91,28 +158,44 @@ func (q *Query) Delete() (int, error) {
 		log.Errorf("Error executing kv.Query.Delete() query=%s err=%s", q.JSON(), err.Error())
 		return -1, err
 	}
+	if q.tx != nil {
+		for id, _ := range res {
+			if err := q.tx.Delete(q.name, id); err != nil {
+				return -1, err
+			}
+		}
+		return len(res), nil
+	}
+	q.t.writes.RLock()
+	defer q.t.writes.RUnlock()
+	q.t.writeMu.Lock()
+	defer q.t.writeMu.Unlock()
+	col := q.use()
 	for id, _ := range res {
-		q.col.Delete(id)
-		log.V(6).Info("Deleted id=%d")
+		col.Delete(id)
+		q.t.changed(nil, Deleted, q.name, id, nil)
+		log.V(6).Infof("Deleted id=%d", id)
 	}
-	log.V(5).Info("Deleted %d objects for query=%s", len(res), q.JSON())
+	log.V(5).Infof("Deleted %d objects for query=%s", len(res), q.JSON())
 	return len(res), nil
 }
 
 func (q Query) JSON() string {
 	j, err := json.Marshal(q.q)
 	if err != nil {
-		log.Error("Failure JSONifying query err=%s query=%v", err.Error(), q.q)
+		log.Errorf("Failure JSONifying query err=%s query=%v", err.Error(), q.q)
 	}
 	return string(j)
 }
 
 func (q *Query) read(id uint64) (interface{}, error) {
 	v := new(interface{})
+	q.t.scrub.RLock()
+	defer q.t.scrub.RUnlock()
 	if q.ReadLock == NoLock {
-		q.col.ReadNoLock(id, v)
+		q.use().ReadNoLock(id, v)
 	} else if q.ReadLock == MustLock {
-		q.col.Read(id, v)
+		q.use().Read(id, v)
 	} else {
 		log.Errorf("Read preference (NoLock or MustLock) not set for query=%s", q.JSON())
 		return nil, ErrReadPreference
@@ -120,21 +203,42 @@ func (q *Query) read(id uint64) (interface{}, error) {
 	return *v, nil
 }
 
+// use returns the collection of q as it is now, since Compact replaces it.
+// t.scrub is held.
+func (q *Query) use() *tiedot.Col {
+	return q.t.tiedot.Use(q.name)
+}
+
 func (q *Query) eval() (RawResultSet, error) {
-	query := prepQuery(q.q)
-	res := make(map[uint64]struct{})
-	err := tiedot.EvalQuery(query, q.col, &res)
+	res, _, err := q.run()
 	return res, err
 }
 
-func prepQuery(q interface{}) (query interface{}) {
-	j, err := json.Marshal(q)
-	if err != nil {
-		log.Errorf("Failure serializing query err=%v", err)
+// run evaluates q, and returns the scores its Match clauses give the
+// documents found, if it has any.
+func (q *Query) run() (RawResultSet, map[uint64]float64, error) {
+	if q.params > 0 {
+		return nil, nil, ErrUnboundParam
 	}
-	err = json.Unmarshal(j, &query)
+	defer q.logSlow(time.Now())
+	q.t.scrub.RLock()
+	defer q.t.scrub.RUnlock()
+	res := make(map[uint64]struct{})
+	if q.matches == 0 {
+		err := tiedot.EvalQuery(q.native, q.use(), &res)
+		return res, nil, err
+	}
+	scores, native, err := q.search()
 	if err != nil {
-		log.Errorf("Failure deserializing query err=%v", err)
+		return nil, nil, err
 	}
-	return
+	if len(native) > 0 {
+		if err := tiedot.EvalQuery(native, q.use(), &res); err != nil {
+			return nil, nil, err
+		}
+	}
+	for id := range scores {
+		res[id] = struct{}{}
+	}
+	return res, scores, nil
 }
@@ -1,8 +1,16 @@
 package kv
 
 import (
+	"encoding/json"
+	tiedot "github.com/HouzuoGuo/tiedot/db"
+	"github.com/ryansb/legowebservices/log"
+	. "github.com/ryansb/legowebservices/util/m"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -19,3 +27,175 @@ func (s *TS) TestNewCollection(c *C) {
 	c.Check(q.q[0]["eq"], Equals, "bob")
 	c.Check(len(q.q[0]["in"].(Path)), Equals, 2)
 }
+
+// jsonQuery is how queries were handed to tiedot before they were built in
+// its native form, through a JSON round trip.
+func jsonQuery(q interface{}) (query interface{}) {
+	j, _ := json.Marshal(q)
+	json.Unmarshal(j, &query)
+	return
+}
+
+func (s *TS) TestNative(c *C) {
+	type point struct{ X, Y int }
+	q := new(Query)
+	q.Equals(Path{"Short"}, int64(1)<<60).
+		Equals(Path{"a", "b"}, "bob").
+		Equals(Path{"f"}, float32(0.1)).
+		Equals(Path{"u"}, uint8(7)).
+		Equals(Path{"p"}, point{1, 2}).
+		Equals(Path{"n"}, nil).
+		Between(Path{"Age"}, -3, 40).
+		Regexp(Path{"Original"}, "^http").
+		Has(Path{"Count"})
+	c.Check(q.native, DeepEquals, jsonQuery(q.q))
+}
+
+func (s *TS) TestPrepare(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	e.AddIndex("a", Path{"N"})
+	e.AddIndex("a", Path{"S"})
+	one, _ := e.Insert("a", M{"N": 1, "S": "x"})
+	two, _ := e.Insert("a", M{"N": 2, "S": "x"})
+
+	byN := e.Query("a").Equals(Path{"N"}, Param(0)).Prepare()
+	for n, want := range map[int]uint64{1: one, 2: two} {
+		id, _, err := byN.With(n).One()
+		c.Check(err, IsNil)
+		c.Check(id, Equals, want)
+	}
+	_, _, err := byN.With(3).One()
+	c.Check(err, Equals, ErrNotFound)
+	c.Check(byN.With(1).JSON(), Equals, `[{"eq":1,"in":["N"]}]`)
+
+	// queries of With can be built on without changing the prepared one
+	both := e.Query("a").Equals(Path{"S"}, Param(1)).Equals(Path{"N"}, Param(0)).Prepare()
+	res, err := both.With(1, "x").All()
+	c.Check(err, IsNil)
+	c.Check(res, HasLen, 2)
+	res, err = both.With(1, "y").Has(Path{"N"}).All()
+	c.Check(err, IsNil)
+	c.Check(res, HasLen, 2)
+	res, err = both.With(3, "y").All()
+	c.Check(err, IsNil)
+	c.Check(res, HasLen, 0)
+
+	_, err = e.Query("a").Equals(Path{"N"}, Param(0)).All()
+	c.Check(err, Equals, ErrUnboundParam)
+	c.Check(func() { byN.With() }, Panics, "legowebservices/persist/kv: Prepared query wants 1 values, got 0")
+	c.Check(func() { e.Query("a").Equals(Path{"N"}, Param(1)).Prepare() }, PanicMatches, ".*numbered from 0.*")
+}
+
+// shortEngine holds n documents shaped like the shortener's, with the same
+// index, for benchmarking its Equals(Short) lookup.
+func shortEngine(b *testing.B, n int) (*TiedotEngine, func()) {
+	dir, err := ioutil.TempDir("", "kvbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	e := NewTiedotEngine(dir, []string{"short.url"}, KeepIfExist)
+	e.AddIndex("short.url", Path{"Short"})
+	for i := 0; i < n; i++ {
+		e.Insert("short.url", M{"Original": "http://example.com/" + strconv.Itoa(i), "Short": int64(i), "HitCount": uint64(0)})
+	}
+	return e, func() { os.RemoveAll(dir) }
+}
+
+func BenchmarkEqualsShortJSON(b *testing.B) {
+	e, done := shortEngine(b, 1000)
+	defer done()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q := e.Query("short.url").Equals(Path{"Short"}, int64(i%1000))
+		res := make(map[uint64]struct{})
+		tiedot.EvalQuery(jsonQuery(q.q), q.use(), &res)
+	}
+}
+
+func BenchmarkEqualsShort(b *testing.B) {
+	e, done := shortEngine(b, 1000)
+	defer done()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Query("short.url").Equals(Path{"Short"}, int64(i%1000)).eval()
+	}
+}
+
+func BenchmarkEqualsShortPrepared(b *testing.B) {
+	e, done := shortEngine(b, 1000)
+	defer done()
+	byShort := e.Query("short.url").Equals(Path{"Short"}, Param(0)).Prepare()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		byShort.With(int64(i % 1000)).eval()
+	}
+}
+
+// The Build benchmarks leave out tiedot, to show the cost of building the
+// query alone.
+
+func BenchmarkBuildEqualsShortJSON(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		q := new(Query).Equals(Path{"Short"}, int64(i))
+		jsonQuery(q.q)
+	}
+}
+
+func BenchmarkBuildEqualsShort(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		new(Query).Equals(Path{"Short"}, int64(i))
+	}
+}
+
+func BenchmarkBuildEqualsShortPrepared(b *testing.B) {
+	e, done := shortEngine(b, 0)
+	defer done()
+	byShort := e.Query("short.url").Equals(Path{"Short"}, Param(0)).Prepare()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		byShort.With(int64(i))
+	}
+}
+
+func (s *TS) TestExplain(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	e.AddIndex("a", Path{"N"})
+	e.AddIndex("a", Path{"S"})
+	for i := 0; i < 5; i++ {
+		e.Insert("a", M{"N": i % 2, "S": "x"})
+	}
+	p, err := e.Query("a").Equals(Path{"N"}, 1).Explain()
+	c.Assert(err, IsNil)
+	c.Check(p, DeepEquals, &Plan{
+		Collection: "a",
+		Clauses:    []ClausePlan{{Clause: `{"eq":1,"in":["N"]}`, Path: Path{"N"}, Access: IndexLookup, Estimate: 2}},
+		Estimate:   2,
+		Docs:       5,
+	})
+	c.Check(p.String(), Equals, "index lookup on N")
+
+	p, err = e.Query("a").Between(Path{"N"}, 0, 0).Regexp(Path{"S"}, "x").Has(Path{"T"}).Explain()
+	c.Assert(err, IsNil)
+	c.Check(p.String(), Equals, "index lookup on N, index scan on S, no index on T")
+	c.Check(p.Clauses[0].Estimate, Equals, 3)
+	c.Check(p.Clauses[1].Estimate, Equals, 5)
+	c.Check(p.Clauses[2].Estimate, Equals, 0)
+	c.Check(p.Estimate, Equals, 5)
+}
+
+func (s *TS) TestSlowQuery(c *C) {
+	defer func(d time.Duration) { SlowQuery = d }(SlowQuery)
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	e.AddIndex("a", Path{"N"})
+	warnings := log.Stats.Warning.Lines()
+
+	SlowQuery = time.Hour
+	e.Query("a").Equals(Path{"N"}, 1).All()
+	c.Check(log.Stats.Warning.Lines(), Equals, warnings)
+	SlowQuery = time.Nanosecond
+	e.Query("a").Equals(Path{"N"}, 1).All()
+	c.Check(log.Stats.Warning.Lines(), Equals, warnings+1)
+	SlowQuery = 0
+	e.Query("a").Equals(Path{"N"}, 1).All()
+	c.Check(log.Stats.Warning.Lines(), Equals, warnings+1)
+}
@@ -0,0 +1,167 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	tiedot "github.com/HouzuoGuo/tiedot/db"
+	"github.com/ryansb/legowebservices/log"
+	"sort"
+	"strings"
+)
+
+// CollectionSpec declares a collection and the indexes it needs. Services
+// keep theirs next to the code using the collections, and the server hands
+// them all to Reconcile on startup:
+//
+//	var Collections = []kv.CollectionSpec{{
+//		Name:    "short.url",
+//		Indexes: []kv.IndexSpec{{Paths: []kv.Path{{"Short"}}, Unique: true}},
+//	}}
+type CollectionSpec struct {
+	Name    string
+	Indexes []IndexSpec
+}
+
+// IndexSpec declares an index on one path, or a compound index on several.
+// tiedot indexes each path on its own, and a compound index matters for
+// Unique: only documents equal on every path conflict. Documents missing one
+// of the paths are not checked.
+//
+// With Text set, each path gets a text index for Query.Match instead, see
+// AddTextIndex. A path needing both kinds is declared in two IndexSpecs.
+type IndexSpec struct {
+	Paths  []Path
+	Unique bool
+	Text   bool
+}
+
+func (i IndexSpec) String() string {
+	s := make([]string, len(i.Paths))
+	for n, p := range i.Paths {
+		s[n] = strings.Join(p, tiedot.INDEX_PATH_SEP)
+	}
+	return strings.Join(s, "+")
+}
+
+// Reconciled says what Reconcile found and did. Indexes are written
+// collection:path.
+type Reconciled struct {
+	Created []string // collections created
+	Indexed []string // indexes created
+	Text    []string // text indexes built
+	Dropped []string // stale indexes dropped
+	Extra   []string // collections and indexes that exist but weren't declared
+}
+
+// Reconcile makes the database match specs: it creates the missing
+// collections and indexes, and enforces the unique ones from then on. Other
+// collections and indexes are reported in Extra and left alone, except that
+// indexes of declared collections are dropped when dropStale is set.
+func (t *TiedotEngine) Reconcile(specs []CollectionSpec, dropStale bool) (*Reconciled, error) {
+	declared := make(map[string]map[string]bool)
+	for _, spec := range specs {
+		if spec.Name == "" {
+			return nil, errors.New("legowebservices/persist/kv: Collection spec without a name")
+		}
+		if declared[spec.Name] != nil {
+			return nil, fmt.Errorf("legowebservices/persist/kv: Collection %s declared twice", spec.Name)
+		}
+		paths := make(map[string]bool)
+		for _, idx := range spec.Indexes {
+			if len(idx.Paths) == 0 {
+				return nil, fmt.Errorf("legowebservices/persist/kv: Index without paths on collection %s", spec.Name)
+			}
+			if idx.Text && idx.Unique {
+				return nil, fmt.Errorf("legowebservices/persist/kv: Text index %s on collection %s can't be unique", idx, spec.Name)
+			}
+			for _, p := range idx.Paths {
+				if len(p) == 0 {
+					return nil, fmt.Errorf("legowebservices/persist/kv: Empty index path on collection %s", spec.Name)
+				}
+				if !idx.Text {
+					paths[strings.Join(p, tiedot.INDEX_PATH_SEP)] = true
+				}
+			}
+		}
+		declared[spec.Name] = paths
+	}
+
+	t.writes.RLock()
+	defer t.writes.RUnlock()
+	res := new(Reconciled)
+	for _, spec := range specs {
+		if _, ok := t.tiedot.StrCol[spec.Name]; !ok {
+			if err := t.tiedot.Create(spec.Name, 1); err != nil {
+				return res, err
+			}
+			res.Created = append(res.Created, spec.Name)
+		}
+		col := t.tiedot.Use(spec.Name)
+		for k := range declared[spec.Name] {
+			if _, ok := col.SecIndexes[k]; ok {
+				continue
+			}
+			if err := col.Index(strings.Split(k, tiedot.INDEX_PATH_SEP)); err != nil {
+				return res, err
+			}
+			res.Indexed = append(res.Indexed, spec.Name+":"+k)
+		}
+		for _, p := range indexes(col) {
+			k := strings.Join(p, tiedot.INDEX_PATH_SEP)
+			if declared[spec.Name][k] {
+				continue
+			}
+			if !dropStale {
+				res.Extra = append(res.Extra, spec.Name+":"+k)
+				continue
+			}
+			if err := col.Unindex(p); err != nil {
+				return res, err
+			}
+			res.Dropped = append(res.Dropped, spec.Name+":"+k)
+		}
+		for _, idx := range spec.Indexes {
+			if idx.Unique {
+				t.addUnique(spec.Name, idx)
+			}
+			if !idx.Text {
+				continue
+			}
+			for _, p := range idx.Paths {
+				if t.textIndex(spec.Name, p) != nil {
+					continue
+				}
+				if err := t.addText(spec.Name, p); err != nil {
+					return res, err
+				}
+				res.Text = append(res.Text, spec.Name+":"+strings.Join(p, tiedot.INDEX_PATH_SEP))
+			}
+		}
+	}
+	for name := range t.tiedot.StrCol {
+		if declared[name] == nil {
+			res.Extra = append(res.Extra, name)
+		}
+	}
+	sort.Strings(res.Indexed)
+	sort.Strings(res.Text)
+	sort.Strings(res.Dropped)
+	sort.Strings(res.Extra)
+
+	for _, c := range res.Created {
+		log.Infof("Created collection %s", c)
+	}
+	for _, i := range res.Indexed {
+		log.Infof("Created index %s", i)
+	}
+	for _, i := range res.Text {
+		log.Infof("Built text index %s", i)
+	}
+	for _, i := range res.Dropped {
+		log.Infof("Dropped stale index %s", i)
+	}
+	for _, e := range res.Extra {
+		log.Warningf("Undeclared collection or index %s", e)
+	}
+	return res, nil
+}
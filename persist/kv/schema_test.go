@@ -0,0 +1,58 @@
+package kv
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type SchemaS struct{}
+
+var _ = Suite(&SchemaS{})
+
+func (s *SchemaS) TestReconcile(c *C) {
+	dir := c.MkDir()
+	e := NewTiedotEngine(dir, []string{"short.url", "old"}, KeepIfExist)
+	e.AddIndex("short.url", Path{"Original"})
+	specs := []CollectionSpec{
+		{Name: "short.url", Indexes: []IndexSpec{
+			{Paths: []Path{{"Short"}}, Unique: true},
+			{Paths: []Path{{"Owner"}, {"Meta", "Tag"}}},
+		}},
+		{Name: "short.counter", Indexes: []IndexSpec{{Paths: []Path{{"Count"}}}}},
+	}
+
+	res, err := e.Reconcile(specs, false)
+	c.Assert(err, IsNil)
+	c.Check(res.Created, DeepEquals, []string{"short.counter"})
+	c.Check(res.Indexed, DeepEquals, []string{"short.counter:Count", "short.url:Meta,Tag", "short.url:Owner", "short.url:Short"})
+	c.Check(res.Dropped, IsNil)
+	c.Check(res.Extra, DeepEquals, []string{"old", "short.url:Original"})
+
+	// a second run only reports, until asked to drop
+	res, err = e.Reconcile(specs, false)
+	c.Assert(err, IsNil)
+	c.Check(res.Created, IsNil)
+	c.Check(res.Indexed, IsNil)
+	res, err = e.Reconcile(specs, true)
+	c.Assert(err, IsNil)
+	c.Check(res.Dropped, DeepEquals, []string{"short.url:Original"})
+	c.Check(res.Extra, DeepEquals, []string{"old"})
+	c.Check(e.DB().Use("short.url").SecIndexes, HasLen, 3)
+}
+
+func (s *SchemaS) TestReconcileInvalid(c *C) {
+	e := NewTiedotEngine(c.MkDir(), nil, KeepIfExist)
+	for _, t := range []struct {
+		specs []CollectionSpec
+		err   string
+	}{
+		{[]CollectionSpec{{}}, ".*Collection spec without a name"},
+		{[]CollectionSpec{{Name: "a"}, {Name: "a"}}, ".*Collection a declared twice"},
+		{[]CollectionSpec{{Name: "a", Indexes: []IndexSpec{{}}}}, ".*Index without paths on collection a"},
+		{[]CollectionSpec{{Name: "a", Indexes: []IndexSpec{{Paths: []Path{{}}}}}}, ".*Empty index path on collection a"},
+		{[]CollectionSpec{{Name: "a", Indexes: []IndexSpec{{Paths: []Path{{"T"}}, Unique: true, Text: true}}}}, ".*Text index T on collection a can't be unique"},
+	} {
+		_, err := e.Reconcile(t.specs, false)
+		c.Check(err, ErrorMatches, t.err)
+	}
+	c.Check(e.Check("a"), NotNil)
+}
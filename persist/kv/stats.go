@@ -0,0 +1,174 @@
+package kv
+
+import (
+	"fmt"
+	tiedot "github.com/HouzuoGuo/tiedot/db"
+	"github.com/ryansb/legowebservices/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CollectionStats describes a collection, see Stats.
+type CollectionStats struct {
+	Name    string
+	Docs    int
+	Bytes   int64 // in the files of the collection, indexes included
+	Indexes []IndexStats
+	Text    []TextStats
+	// Stale counts the documents deleted or replaced through the engine
+	// since it was opened or the collection compacted. tiedot may keep their
+	// old space until the collection is compacted.
+	Stale int
+}
+
+// Reclaimable tells whether compacting the collection may give back space
+// or drop dangling index entries.
+func (s *CollectionStats) Reclaimable() bool {
+	if s.Stale > 0 {
+		return true
+	}
+	for _, is := range s.Indexes {
+		if is.Dangling > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexStats describes an index of a collection.
+type IndexStats struct {
+	Path    Path
+	Entries int // documents the index lists
+	// Dangling entries list documents that are gone, which tiedot leaves
+	// behind on deletes until the collection is compacted.
+	Dangling int
+}
+
+// TextStats describes a text index, see AddTextIndex.
+type TextStats struct {
+	Path  Path
+	Docs  int
+	Terms int // distinct
+}
+
+// Stats describes every collection of the database, by name. Counting the
+// entries of the indexes scans them, as a Has query would.
+func (t *TiedotEngine) Stats() ([]*CollectionStats, error) {
+	t.scrub.RLock()
+	defer t.scrub.RUnlock()
+	names := make([]string, 0, len(t.tiedot.StrCol))
+	for name := range t.tiedot.StrCol {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := make([]*CollectionStats, 0, len(names))
+	for _, name := range names {
+		s, err := t.collectionStats(name)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// CollectionStats describes one collection, like Stats.
+func (t *TiedotEngine) CollectionStats(collection string) (*CollectionStats, error) {
+	t.scrub.RLock()
+	defer t.scrub.RUnlock()
+	return t.collectionStats(collection)
+}
+
+// collectionStats is CollectionStats with t.scrub held.
+func (t *TiedotEngine) collectionStats(collection string) (*CollectionStats, error) {
+	col := t.tiedot.Use(collection)
+	if col == nil {
+		return nil, fmt.Errorf("legowebservices/persist/kv: Collection %s does not exist", collection)
+	}
+	all := make(map[uint64]struct{})
+	if err := tiedot.EvalQuery("all", col, &all); err != nil {
+		return nil, err
+	}
+	t.staleMu.Lock()
+	s := &CollectionStats{Name: collection, Docs: len(all), Stale: t.stale[collection]}
+	t.staleMu.Unlock()
+	var err error
+	if s.Bytes, err = diskUsage(col.BaseDir); err != nil {
+		return nil, err
+	}
+	for _, p := range indexes(col) {
+		listed := make(map[uint64]struct{})
+		if err := tiedot.EvalQuery(map[string]interface{}{"has": p.native()}, col, &listed); err != nil {
+			return nil, err
+		}
+		is := IndexStats{Path: p, Entries: len(listed)}
+		for id := range listed {
+			if _, ok := all[id]; !ok {
+				is.Dangling++
+			}
+		}
+		s.Indexes = append(s.Indexes, is)
+	}
+
+	t.textMu.RLock()
+	defer t.textMu.RUnlock()
+	keys := make([]string, 0, len(t.texts[collection]))
+	for k := range t.texts[collection] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		idx := t.texts[collection][k]
+		s.Text = append(s.Text, TextStats{Path: idx.path, Docs: idx.Len(), Terms: idx.Terms()})
+	}
+	return s, nil
+}
+
+// diskUsage returns the bytes in the files under dir.
+func diskUsage(dir string) (int64, error) {
+	var n int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Compact rewrites collection through tiedot's scrub, which gives back the
+// space of deleted and replaced documents and rebuilds the indexes without
+// their dangling entries. Documents keep their IDs. Writes and reads wait for
+// it, as the files of the collection are replaced. It returns the stats of
+// the collection before and after.
+func (t *TiedotEngine) Compact(collection string) (before, after *CollectionStats, err error) {
+	t.writes.Lock()
+	defer t.writes.Unlock()
+	t.scrub.Lock()
+	defer t.scrub.Unlock()
+	start := time.Now()
+	if before, err = t.collectionStats(collection); err != nil {
+		return nil, nil, err
+	}
+	if err = t.tiedot.Scrub(collection); err != nil {
+		return before, nil, err
+	}
+	t.staleMu.Lock()
+	delete(t.stale, collection)
+	t.staleMu.Unlock()
+	if after, err = t.collectionStats(collection); err != nil {
+		return before, nil, err
+	}
+	dangling := 0
+	for _, is := range before.Indexes {
+		dangling += is.Dangling
+	}
+	log.Infof("Compacted collection=%s documents=%d bytes=%d freed=%d dangling=%d duration=%s",
+		collection, after.Docs, after.Bytes, before.Bytes-after.Bytes, dangling, time.Since(start))
+	return before, after, nil
+}
@@ -0,0 +1,96 @@
+package kv
+
+import (
+	. "github.com/ryansb/legowebservices/util/m"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"path/filepath"
+	"sync"
+)
+
+type StatsS struct{}
+
+var _ = Suite(&StatsS{})
+
+func (s *StatsS) TestStats(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"b", "a"}, KeepIfExist)
+	e.AddIndex("a", Path{"N"})
+	c.Assert(e.AddTextIndex("a", Path{"T"}), IsNil)
+	for i := 0; i < 3; i++ {
+		e.Insert("a", M{"N": i, "T": "some words"})
+	}
+	e.Insert("a", M{"T": "other"})
+	// the files of the collection count
+	c.Assert(ioutil.WriteFile(filepath.Join(e.DB().Use("a").BaseDir, "data"), make([]byte, 100), 0600), IsNil)
+
+	stats, err := e.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 2)
+	c.Check(stats[0], DeepEquals, &CollectionStats{
+		Name:    "a",
+		Docs:    4,
+		Bytes:   100,
+		Indexes: []IndexStats{{Path: Path{"N"}, Entries: 3}},
+		Text:    []TextStats{{Path: Path{"T"}, Docs: 4, Terms: 3}},
+	})
+	c.Check(stats[1], DeepEquals, &CollectionStats{Name: "b"})
+
+	// updates and deletes leave stale documents behind
+	id, _ := e.Insert("b", M{"N": 1})
+	c.Assert(e.Update("b", id, M{"N": 2}), IsNil)
+	b, err := e.CollectionStats("b")
+	c.Assert(err, IsNil)
+	c.Check(b.Stale, Equals, 1)
+
+	_, err = e.CollectionStats("nope")
+	c.Check(err, ErrorMatches, ".*Collection nope does not exist")
+}
+
+func (s *StatsS) TestCompact(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	e.AddIndex("a", Path{"N"})
+	var ids []uint64
+	for i := 0; i < 10; i++ {
+		id, _ := e.Insert("a", M{"N": i})
+		ids = append(ids, id)
+	}
+	e.Delete("a", ids[0])
+
+	// reads go on, waiting while the collection is replaced
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var doc M
+			c.Check(e.Read("a", ids[1], &doc), IsNil)
+			_, err := e.Query("a").Equals(Path{"N"}, 5).All()
+			c.Check(err, IsNil)
+		}
+	}()
+	before, after, err := e.Compact("a")
+	close(stop)
+	wg.Wait()
+	c.Assert(err, IsNil)
+	c.Check(before.Docs, Equals, 9)
+	c.Check(before.Stale, Equals, 1)
+	c.Check(before.Reclaimable(), Equals, true)
+	c.Check(after.Docs, Equals, 9)
+	c.Check(after.Stale, Equals, 0)
+	c.Check(after.Reclaimable(), Equals, false)
+	c.Check(after.Indexes, DeepEquals, []IndexStats{{Path: Path{"N"}, Entries: 9}})
+
+	// IDs are kept
+	var doc M
+	c.Assert(e.Read("a", ids[9], &doc), IsNil)
+	c.Check(doc["N"], Equals, 9.0)
+
+	_, _, err = e.Compact("nope")
+	c.Check(err, ErrorMatches, ".*Collection nope does not exist")
+}
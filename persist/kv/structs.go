@@ -4,6 +4,7 @@ import (
 	tiedot "github.com/HouzuoGuo/tiedot/db"
 	"github.com/ryansb/legowebservices/log"
 	"github.com/ryansb/legowebservices/util/m"
+	"sync"
 )
 
 type DropPreference uint8
@@ -22,7 +23,12 @@ const (
 
 type Query struct {
 	q        []m.M
-	col      *tiedot.Col
+	native   []interface{} // q the way tiedot.EvalQuery takes it
+	params   int           // Params in q, see Prepare
+	matches  int           // Match clauses in q
+	t        *TiedotEngine
+	tx       *Tx // set for queries of a transaction
+	name     string
 	ReadLock LockPreference
 }
 
@@ -33,6 +39,27 @@ type RawResultSet map[uint64]struct{}
 // Implemented the KVEngine interface
 type TiedotEngine struct {
 	tiedot *tiedot.DB
+	closed int32 // set atomically by Close
+	// writes is held shared by every change to the data and exclusively by
+	// Dump, so a dump sees no half done changes.
+	writes sync.RWMutex
+	// writeMu serializes the changes to documents, so they are checked
+	// against unique, the unique indexes of each collection, and sent to the
+	// watchers of feed in order.
+	writeMu sync.Mutex
+	unique  map[string][]IndexSpec
+	feed    feed
+	// texts holds the text indexes of each collection by path, changed
+	// under textMu as well as writeMu so queries can read it.
+	textMu sync.RWMutex
+	texts  map[string]map[string]*textIndex
+	// scrub is held shared by reads and exclusively by Compact while it
+	// replaces the files of a collection.
+	scrub sync.RWMutex
+	// stale counts the documents of each collection deleted or replaced
+	// since it was opened or compacted, see CollectionStats.Stale.
+	staleMu sync.Mutex
+	stale   map[string]int
 }
 
 // Create a new LevelDBEngine with the given file and options
@@ -41,16 +68,16 @@ func NewTiedotEngine(directory string, collections []string, dropPref DropPrefer
 	log.FatalIfErr(err, "Failure opening tiedot basedir err:")
 	for _, c := range collections {
 		if _, ok := db.StrCol[c]; ok {
-			log.V(4).Info("Collection %s already exists")
+			log.V(4).Infof("Collection %s already exists", c)
 			if dropPref == DropIfExist {
-				log.Info("Dropping collection %s due to dropIfExist option")
+				log.Infof("Dropping collection %s due to dropIfExist option", c)
 				err = db.Drop(c)
 				log.FatalIfErr(err, "Failure dropping collection with name:%s err:", c)
 				err = db.Create(c, 1) // partition DB for use by up to 1 goroutines at a time
 				log.FatalIfErr(err, "Failure creating collection with name:%s err:", c)
 			}
 		} else {
-			log.V(4).Info("Creating collection %s")
+			log.V(4).Infof("Creating collection %s", c)
 			err = db.Create(c, 1) // partition DB for use by up to 1 goroutines at a time
 			log.FatalIfErr(err, "Failure creating collection with name:%s err:", c)
 		}
@@ -58,5 +85,9 @@ func NewTiedotEngine(directory string, collections []string, dropPref DropPrefer
 	tde := &TiedotEngine{
 		tiedot: db,
 	}
+	err = tde.recoverJournal()
+	log.FatalIfErr(err, "Failure recovering transaction journal err:")
+	err = tde.feed.open(tde.seqPath())
+	log.FatalIfErr(err, "Failure loading event sequence err:")
 	return tde
 }
@@ -0,0 +1,192 @@
+package kv
+
+import (
+	"fmt"
+	tiedot "github.com/HouzuoGuo/tiedot/db"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/text"
+	. "github.com/ryansb/legowebservices/util/m"
+	"strings"
+)
+
+// textIndex is the text index of a collection on a path, see AddTextIndex.
+type textIndex struct {
+	path Path
+	*text.Index
+}
+
+// AddTextIndex indexes the text at path in the documents of collection, for
+// Query.Match: a string, or the strings of a list. Text indexes are held in
+// memory and kept up to date with every write, so they are built again from
+// the documents each time the engine is opened, when Reconcile is given
+// IndexSpecs with Text set.
+func (t *TiedotEngine) AddTextIndex(collection string, path Path) error {
+	t.writes.RLock()
+	defer t.writes.RUnlock()
+	return t.addText(collection, path)
+}
+
+// addText builds the text index of collection on path unless it exists.
+// t.writes is held.
+func (t *TiedotEngine) addText(collection string, path Path) error {
+	if _, ok := t.tiedot.StrCol[collection]; !ok {
+		return fmt.Errorf("legowebservices/persist/kv: Collection %s does not exist", collection)
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.textIndex(collection, path) != nil {
+		return nil
+	}
+	idx := &textIndex{path: path, Index: text.NewIndex()}
+	if err := t.fillText(collection, idx); err != nil {
+		return err
+	}
+	t.textMu.Lock()
+	if t.texts == nil {
+		t.texts = make(map[string]map[string]*textIndex)
+	}
+	if t.texts[collection] == nil {
+		t.texts[collection] = make(map[string]*textIndex)
+	}
+	t.texts[collection][strings.Join(path, tiedot.INDEX_PATH_SEP)] = idx
+	t.textMu.Unlock()
+	log.V(2).Infof("Built text index collection=%s path=%v documents=%d", collection, path, idx.Len())
+	return nil
+}
+
+// fillText indexes the documents of collection in idx. No writes are made
+// meanwhile.
+func (t *TiedotEngine) fillText(collection string, idx *textIndex) error {
+	col := t.tiedot.Use(collection)
+	r := make(map[uint64]struct{})
+	if err := tiedot.EvalQuery("all", col, &r); err != nil {
+		return err
+	}
+	idx.Reset()
+	for id := range r {
+		var doc M
+		if _, err := col.Read(id, &doc); err != nil {
+			log.Errorf("Failure reading id=%d collection=%s for text index err=%v", id, collection, err)
+			continue
+		}
+		idx.Add(id, textAt(doc, idx.path)...)
+	}
+	return nil
+}
+
+// refillText builds the text indexes of collection again, after its
+// documents changed without events. All of t.writes is held.
+func (t *TiedotEngine) refillText(collection string) {
+	t.textMu.RLock()
+	defer t.textMu.RUnlock()
+	for _, idx := range t.texts[collection] {
+		if err := t.fillText(collection, idx); err != nil {
+			log.Errorf("Failure rebuilding text index collection=%s path=%v err=%v", collection, idx.path, err)
+		}
+	}
+}
+
+// textIndex returns the text index of collection on path, or nil.
+func (t *TiedotEngine) textIndex(collection string, path Path) *textIndex {
+	t.textMu.RLock()
+	defer t.textMu.RUnlock()
+	return t.texts[collection][strings.Join(path, tiedot.INDEX_PATH_SEP)]
+}
+
+// indexText updates the text indexes of collection for a write. t.writeMu or
+// all of t.writes is held.
+func (t *TiedotEngine) indexText(op, collection string, id uint64, doc M) {
+	t.textMu.RLock()
+	defer t.textMu.RUnlock()
+	for _, idx := range t.texts[collection] {
+		if op == Deleted {
+			idx.Remove(id)
+		} else {
+			idx.Add(id, textAt(doc, idx.path)...)
+		}
+	}
+}
+
+// textAt returns the text at path p of doc: the string there, or the strings
+// of the list there.
+func textAt(doc M, p Path) []string {
+	v, ok := valueAt(doc, p)
+	if !ok {
+		return nil
+	}
+	switch s := v.(type) {
+	case string:
+		return []string{s}
+	case []string:
+		return s
+	case []interface{}:
+		var texts []string
+		for _, e := range s {
+			if str, ok := e.(string); ok {
+				texts = append(texts, str)
+			}
+		}
+		return texts
+	}
+	return nil
+}
+
+// matchClause is a Match clause of a query, run on a text index instead of
+// by tiedot.
+type matchClause struct {
+	path Path
+	text string
+}
+
+// Match matches documents whose text at p holds every word and every phrase
+// in double quotes of query, as the text index on p finds them: words match
+// those with the same stem, so "connection" matches "connected". The
+// collection needs a text index on p, see AddTextIndex, and Ranked orders the
+// documents found by relevance. The index holds what is committed, so in a
+// transaction Match doesn't see the writes made so far.
+func (q *Query) Match(p Path, query string) *Query {
+	log.V(6).Every(100).Infof("QueryBuilder: Path=%v Match=%s", p, query)
+	q.q = append(q.q, M{"in": p, "match": query})
+	q.native = append(q.native, matchClause{path: p, text: query})
+	q.matches++
+	return q
+}
+
+// Ranked runs q and returns the documents it matches with their scores, best
+// first: a document's score adds up those the Match clauses give it. The
+// documents only other clauses match come last, by ID.
+func (q *Query) Ranked() ([]text.Hit, error) {
+	res, scores, err := q.run()
+	if err != nil {
+		log.Errorf("Error executing kv.Query.Ranked() query=%s err=%v", q.JSON(), err)
+		return nil, err
+	}
+	hits := make([]text.Hit, 0, len(res))
+	for id := range res {
+		hits = append(hits, text.Hit{ID: id, Score: scores[id]})
+	}
+	text.Sort(hits)
+	return hits, nil
+}
+
+// search runs the Match clauses of q, and returns the score each gives the
+// documents it matches, added up, and the other clauses for tiedot.
+func (q *Query) search() (map[uint64]float64, []interface{}, error) {
+	scores := make(map[uint64]float64)
+	native := make([]interface{}, 0, len(q.native)-q.matches)
+	for _, c := range q.native {
+		m, ok := c.(matchClause)
+		if !ok {
+			native = append(native, c)
+			continue
+		}
+		idx := q.t.textIndex(q.name, m.path)
+		if idx == nil {
+			return nil, nil, fmt.Errorf("legowebservices/persist/kv: No text index on %s in collection %s", strings.Join(m.path, tiedot.INDEX_PATH_SEP), q.name)
+		}
+		for _, h := range idx.Search(m.text) {
+			scores[h.ID] += h.Score
+		}
+	}
+	return scores, native, nil
+}
@@ -0,0 +1,119 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ryansb/legowebservices/persist/text"
+	. "github.com/ryansb/legowebservices/util/m"
+	. "launchpad.net/gocheck"
+)
+
+type TextS struct{}
+
+var _ = Suite(&TextS{})
+
+func ids(hits []text.Hit) []uint64 {
+	var ids []uint64
+	for _, h := range hits {
+		ids = append(ids, h.ID)
+	}
+	return ids
+}
+
+func (s *TextS) TestMatch(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"docs"}, KeepIfExist)
+	// documents already there are indexed
+	a, _ := e.Insert("docs", M{"T": "Connecting the dots", "N": 1})
+	res, err := e.Reconcile([]CollectionSpec{{Name: "docs", Indexes: []IndexSpec{
+		{Paths: []Path{{"N"}}},
+		{Paths: []Path{{"T"}, {"Tags"}}, Text: true},
+	}}}, false)
+	c.Assert(err, IsNil)
+	c.Check(res.Text, DeepEquals, []string{"docs:T", "docs:Tags"})
+	c.Check(res.Extra, IsNil)
+
+	// the index follows inserts, updates and deletes
+	b, _ := e.Insert("docs", M{"T": "Dots connected, then the lines", "N": 2, "Tags": []string{"go", "search"}})
+	d, _ := e.Insert("docs", M{"T": "nothing", "N": 3})
+	got, err := e.Query("docs").Match(Path{"T"}, "connection").All()
+	c.Assert(err, IsNil)
+	c.Check(got, HasLen, 2)
+	hits, err := e.Query("docs").Match(Path{"T"}, `connection "the dots"`).Ranked()
+	c.Assert(err, IsNil)
+	c.Check(ids(hits), DeepEquals, []uint64{a})
+	hits, err = e.Query("docs").Match(Path{"Tags"}, "searching").Ranked()
+	c.Assert(err, IsNil)
+	c.Check(ids(hits), DeepEquals, []uint64{b})
+
+	c.Assert(e.Update("docs", a, M{"T": "something else", "N": 1}), IsNil)
+	e.Delete("docs", b)
+	hits, err = e.Query("docs").Match(Path{"T"}, "dots").Ranked()
+	c.Assert(err, IsNil)
+	c.Check(hits, HasLen, 0)
+
+	// other clauses are a union, ranked last
+	hits, err = e.Query("docs").Match(Path{"T"}, "else").Equals(Path{"N"}, 3).Ranked()
+	c.Assert(err, IsNil)
+	c.Check(ids(hits), DeepEquals, []uint64{a, d})
+	c.Check(hits[0].Score > 0, Equals, true)
+	c.Check(hits[1].Score, Equals, 0.0)
+
+	_, err = e.Query("docs").Match(Path{"N"}, "x").All()
+	c.Check(err, ErrorMatches, ".*No text index on N in collection docs")
+	c.Check(e.AddTextIndex("nope", Path{"T"}), ErrorMatches, ".*Collection nope does not exist")
+
+	p, err := e.Query("docs").Match(Path{"T"}, "else").Match(Path{"N"}, "x").Explain()
+	c.Assert(err, IsNil)
+	c.Check(p.String(), Equals, "text search on T, no index on N")
+	c.Check(p.Clauses[0].Estimate, Equals, 1)
+	c.Check(p.Clauses[0].Clause, Equals, `{"in":["T"],"match":"else"}`)
+
+	prepared := e.Query("docs").Match(Path{"T"}, "else").Equals(Path{"N"}, Param(0)).Prepare()
+	got, err = prepared.With(3).All()
+	c.Assert(err, IsNil)
+	c.Check(got, HasLen, 2)
+}
+
+func (s *TextS) TestTransaction(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"docs"}, KeepIfExist)
+	c.Assert(e.AddTextIndex("docs", Path{"T"}), IsNil)
+	a, _ := e.Insert("docs", M{"T": "kept"})
+	e.Transact(func(tx *Tx) error {
+		tx.Insert("docs", M{"T": "undone"})
+		tx.Delete("docs", a)
+		return errors.New("rollback")
+	})
+	got, _ := e.Query("docs").Match(Path{"T"}, "undone").All()
+	c.Check(got, HasLen, 0)
+	got, _ = e.Query("docs").Match(Path{"T"}, "kept").All()
+	c.Check(got, HasLen, 1)
+
+	var b uint64
+	err := e.Transact(func(tx *Tx) error {
+		var err error
+		b, err = tx.Insert("docs", M{"T": "committed"})
+		if err != nil {
+			return err
+		}
+		return tx.Delete("docs", a)
+	})
+	c.Assert(err, IsNil)
+	hits, _ := e.Query("docs").Match(Path{"T"}, "commit").Ranked()
+	c.Check(ids(hits), DeepEquals, []uint64{b})
+	got, _ = e.Query("docs").Match(Path{"T"}, "kept").All()
+	c.Check(got, HasLen, 0)
+}
+
+func (s *TextS) TestRestore(c *C) {
+	src := NewTiedotEngine(c.MkDir(), []string{"docs"}, KeepIfExist)
+	src.Insert("docs", M{"T": "restored text"})
+	var buf bytes.Buffer
+	c.Assert(src.Dump(&buf), IsNil)
+
+	dst := NewTiedotEngine(c.MkDir(), []string{"docs"}, KeepIfExist)
+	c.Assert(dst.AddTextIndex("docs", Path{"T"}), IsNil)
+	c.Assert(dst.Restore(&buf, nil), IsNil)
+	got, err := dst.Query("docs").Match(Path{"T"}, "restore").All()
+	c.Assert(err, IsNil)
+	c.Check(got, HasLen, 1)
+}
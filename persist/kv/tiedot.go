@@ -2,15 +2,32 @@ package kv
 
 import (
 	"errors"
+	"fmt"
 	tiedot "github.com/HouzuoGuo/tiedot/db"
 	"github.com/ryansb/legowebservices/log"
+	. "github.com/ryansb/legowebservices/util/m"
 	"strings"
+	"sync/atomic"
 )
 
 var ErrNotFound = errors.New("legowebservices/persist/kv: Error not found")
 var ErrReadPreference = errors.New("legowebservices/persist/kv: Readpreference not set")
+var ErrClosed = errors.New("legowebservices/persist/kv: Engine closed")
+
+// AddCollection creates the collection unless it already exists.
+func (t *TiedotEngine) AddCollection(collection string) error {
+	t.writes.RLock()
+	defer t.writes.RUnlock()
+	if _, ok := t.tiedot.StrCol[collection]; ok {
+		return nil
+	}
+	log.V(4).Infof("Creating collection %s", collection)
+	return t.tiedot.Create(collection, 1)
+}
 
 func (t *TiedotEngine) AddIndex(collection string, path Path) {
+	t.writes.RLock()
+	defer t.writes.RUnlock()
 	c := t.tiedot.Use(collection)
 	tdPath := strings.Join(path, tiedot.INDEX_PATH_SEP)
 	if _, ok := c.SecIndexes[tdPath]; ok {
@@ -19,7 +36,7 @@ func (t *TiedotEngine) AddIndex(collection string, path Path) {
 	}
 	log.V(3).Infof("Adding index on path:%v to collection:%s", tdPath, collection)
 	err := c.Index(path)
-	log.FatalIfErr(err, "Failure creating index on collection:"+collection)
+	log.FatalIfErr(err, "Failure creating index on collection:%s err:", collection)
 }
 
 func (t *TiedotEngine) Collection(collection string) *tiedot.Col {
@@ -30,8 +47,29 @@ func (t *TiedotEngine) DB() *tiedot.DB {
 	return t.tiedot
 }
 
+// Check returns an error unless the engine is open and every one of the
+// given collections exists. It is meant for readiness probes.
+func (t *TiedotEngine) Check(collections ...string) error {
+	if atomic.LoadInt32(&t.closed) != 0 {
+		return ErrClosed
+	}
+	for _, c := range collections {
+		if _, ok := t.tiedot.StrCol[c]; !ok {
+			return fmt.Errorf("legowebservices/persist/kv: Collection %s does not exist", c)
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes the underlying database.
+func (t *TiedotEngine) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	t.feed.close()
+	return t.tiedot.Close()
+}
+
 func (t *TiedotEngine) Query(collectionName string) *Query {
-	return &Query{col: t.tiedot.Use(collectionName)}
+	return &Query{t: t, name: collectionName}
 }
 
 func (t *TiedotEngine) Insert(collectionName string, item Insertable) (uint64, error) {
@@ -42,7 +80,7 @@ func (t *TiedotEngine) Insert(collectionName string, item Insertable) (uint64, e
 		log.V(3).Infof("Insertion into collection=%s item=%v",
 			collectionName, item.ToM())
 	}
-	id, err := t.tiedot.Use(collectionName).Insert(item.ToM())
+	id, err := t.insert(collectionName, item.ToM())
 	if err != nil {
 		log.Errorf("Failure inserting item=%v err=%s", item.ToM(), err.Error())
 		return 0, err
@@ -53,7 +91,7 @@ func (t *TiedotEngine) Insert(collectionName string, item Insertable) (uint64, e
 }
 
 func (t *TiedotEngine) Update(collectionName string, id uint64, item Insertable) error {
-	err := t.tiedot.Use(collectionName).Update(id, item.ToM())
+	err := t.update(collectionName, id, item.ToM())
 	if err != nil {
 		log.Errorf("Failure updating item=%s err=%s", item.ToM().JSON(), err.Error())
 	} else {
@@ -62,10 +100,101 @@ func (t *TiedotEngine) Update(collectionName string, id uint64, item Insertable)
 	return err
 }
 
+// insert adds doc to collection, enforcing its unique indexes.
+func (t *TiedotEngine) insert(collection string, doc M) (uint64, error) {
+	t.writes.RLock()
+	defer t.writes.RUnlock()
+	return t.doInsert(collection, doc, nil)
+}
+
+// doInsert is insert without locking t.writes, which is held. The event goes
+// to the watchers, or waits in tx until it commits.
+func (t *TiedotEngine) doInsert(collection string, doc M, tx *Tx) (uint64, error) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := t.checkUnique(collection, 0, doc); err != nil {
+		return 0, err
+	}
+	id, err := t.tiedot.Use(collection).Insert(doc)
+	if err == nil {
+		t.changed(tx, Inserted, collection, id, doc)
+	}
+	return id, err
+}
+
+// update replaces document id of collection, enforcing its unique indexes.
+func (t *TiedotEngine) update(collection string, id uint64, doc M) error {
+	t.writes.RLock()
+	defer t.writes.RUnlock()
+	return t.doUpdate(collection, id, doc, nil)
+}
+
+// doUpdate is update without locking t.writes, which is held, see doInsert.
+func (t *TiedotEngine) doUpdate(collection string, id uint64, doc M, tx *Tx) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := t.checkUnique(collection, id, doc); err != nil {
+		return err
+	}
+	err := t.tiedot.Use(collection).Update(id, doc)
+	if err == nil {
+		t.changed(tx, Updated, collection, id, doc)
+	}
+	return err
+}
+
+// changed applies a write to the text indexes and sends its event to the
+// watchers, or keeps it in tx until it commits. t.writeMu or all of t.writes
+// is held.
+func (t *TiedotEngine) changed(tx *Tx, op, collection string, id uint64, doc M) {
+	if op != Inserted {
+		t.staleMu.Lock()
+		if t.stale == nil {
+			t.stale = make(map[string]int)
+		}
+		t.stale[collection]++
+		t.staleMu.Unlock()
+	}
+	doc = stored(doc)
+	if tx != nil {
+		tx.events = append(tx.events, Event{Op: op, Collection: collection, ID: id, Doc: doc})
+		return
+	}
+	t.committed(op, collection, id, doc)
+}
+
+// committed follows a write that is there to stay.
+func (t *TiedotEngine) committed(op, collection string, id uint64, doc M) {
+	t.indexText(op, collection, id, doc)
+	t.feed.publish(op, collection, id, doc)
+}
+
+func (t *TiedotEngine) Read(collectionName string, id uint64, out interface{}) error {
+	t.scrub.RLock()
+	defer t.scrub.RUnlock()
+	if _, err := t.tiedot.Use(collectionName).Read(id, out); err != nil {
+		log.Errorf("Failure reading id=%d collection=%s err=%s", id, collectionName, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (t *TiedotEngine) Delete(collectionName string, id uint64) {
+	t.writes.RLock()
+	t.writeMu.Lock()
+	t.tiedot.Use(collectionName).Delete(id)
+	t.changed(nil, Deleted, collectionName, id, nil)
+	t.writeMu.Unlock()
+	t.writes.RUnlock()
+	log.V(3).Infof("Deleted id=%d from collection=%s", id, collectionName)
+}
+
 func (t *TiedotEngine) All(collectionName string) (map[uint64]struct{}, error) {
+	t.scrub.RLock()
+	defer t.scrub.RUnlock()
 	r := make(map[uint64]struct{})
 	if err := tiedot.EvalQuery("all", t.tiedot.Use(collectionName), &r); err != nil {
-		log.Error("Error executing TiedotEngine.All() err=%s", err.Error())
+		log.Errorf("Error executing TiedotEngine.All() err=%s", err.Error())
 		return nil, err
 	}
 	return r, nil
@@ -0,0 +1,270 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/ryansb/legowebservices/log"
+	. "github.com/ryansb/legowebservices/util/m"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journalName is the file in the database directory where a transaction
+// records how to undo its writes, until it is over.
+const journalName = "lws.journal"
+
+// Journal operations.
+const (
+	opPending = "pending" // undone by deleting the documents holding Mark
+	opInsert  = "insert"  // undone by deleting ID
+	opUpdate  = "update"  // undone by writing Old back
+	opDelete  = "delete"  // done on commit
+	opCommit  = "commit"  // the deletes are due, nothing is undone
+)
+
+// txMark is the field a transaction puts in the documents it inserts, until
+// the journal has their IDs.
+const txMark = "lws.tx"
+
+type journalEntry struct {
+	Op         string `json:"op"`
+	Collection string `json:"collection,omitempty"`
+	ID         uint64 `json:"id,omitempty"`
+	Mark       string `json:"mark,omitempty"`
+	Old        M      `json:"old"`
+}
+
+// Tx makes the writes of a transaction, see Transact.
+type Tx struct {
+	t       *TiedotEngine
+	journal *os.File
+	entries []journalEntry
+	events  []Event // sent to the watchers on commit
+}
+
+// Transact runs fn in a transaction: the writes fn makes through tx are kept
+// if it returns nil, and undone if it returns an error or panics. Deletes
+// take effect once fn returns, so fn still reads what it deleted.
+//
+// Transactions run one at a time and other writes wait for them. Reads don't,
+// and may see writes that are then undone. fn must only write through tx:
+// calling the engine's own write methods deadlocks.
+//
+// Each write is recorded in a journal in the database directory before it is
+// made, so a transaction cut short by a crash is undone when the engine is
+// next opened. Inserts can't be recorded by ID before tiedot picks it: the
+// journal gets a mark that the document holds until its ID is recorded.
+func (t *TiedotEngine) Transact(fn func(tx *Tx) error) (err error) {
+	t.writes.Lock()
+	defer t.writes.Unlock()
+	tx := &Tx{t: t}
+	tx.journal, err = os.OpenFile(t.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	done := false
+	defer func() {
+		if done {
+			return
+		}
+		r := recover()
+		tx.journal.Close()
+		t.undo(tx.entries)
+		os.Remove(t.journalPath())
+		if r != nil {
+			panic(r)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		log.V(2).Infof("Rolling back transaction writes=%d err=%v", len(tx.entries), err)
+		return err
+	}
+	if err = tx.record(journalEntry{Op: opCommit}); err != nil {
+		return err
+	}
+	done = true
+	tx.journal.Close()
+	t.redo(tx.entries)
+	for _, e := range tx.events {
+		t.committed(e.Op, e.Collection, e.ID, e.Doc)
+	}
+	return os.Remove(t.journalPath())
+}
+
+func (t *TiedotEngine) journalPath() string {
+	return filepath.Join(t.tiedot.BaseDir, journalName)
+}
+
+// record appends e to the journal and waits for it to reach the disk.
+func (tx *Tx) record(e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.journal.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := tx.journal.Sync(); err != nil {
+		return err
+	}
+	tx.entries = append(tx.entries, e)
+	return nil
+}
+
+// Insert adds item to collection, like TiedotEngine.Insert.
+func (tx *Tx) Insert(collection string, item Insertable) (uint64, error) {
+	mark := fmt.Sprintf("%d.%d", time.Now().UnixNano(), len(tx.entries))
+	if err := tx.record(journalEntry{Op: opPending, Collection: collection, Mark: mark}); err != nil {
+		return 0, err
+	}
+	doc := item.ToM()
+	marked := make(M, len(doc)+1)
+	for k, v := range doc {
+		marked[k] = v
+	}
+	marked[txMark] = mark
+	id, err := tx.t.doInsert(collection, marked, tx)
+	if err != nil {
+		// nothing to look for when undoing
+		tx.entries = tx.entries[:len(tx.entries)-1]
+		return 0, err
+	}
+	delete(tx.events[len(tx.events)-1].Doc, txMark)
+	err = tx.record(journalEntry{Op: opInsert, Collection: collection, ID: id, Mark: mark})
+	if err == nil {
+		err = tx.t.tiedot.Use(collection).Update(id, doc)
+	}
+	if err != nil {
+		tx.t.tiedot.Use(collection).Delete(id)
+		tx.events = tx.events[:len(tx.events)-1]
+		return 0, err
+	}
+	log.V(3).Infof("Transaction insert into collection=%s id=%d", collection, id)
+	return id, nil
+}
+
+// Update replaces document id of collection, like TiedotEngine.Update.
+func (tx *Tx) Update(collection string, id uint64, item Insertable) error {
+	var old M
+	if _, err := tx.t.tiedot.Use(collection).Read(id, &old); err != nil {
+		return err
+	}
+	if err := tx.record(journalEntry{Op: opUpdate, Collection: collection, ID: id, Old: old}); err != nil {
+		return err
+	}
+	log.V(3).Infof("Transaction update of collection=%s id=%d", collection, id)
+	return tx.t.doUpdate(collection, id, item.ToM(), tx)
+}
+
+// Delete removes document id from collection when the transaction commits.
+func (tx *Tx) Delete(collection string, id uint64) error {
+	log.V(3).Infof("Transaction delete from collection=%s id=%d", collection, id)
+	if err := tx.record(journalEntry{Op: opDelete, Collection: collection, ID: id}); err != nil {
+		return err
+	}
+	tx.t.changed(tx, Deleted, collection, id, nil)
+	return nil
+}
+
+// Read reads document id of collection into out.
+func (tx *Tx) Read(collection string, id uint64, out interface{}) error {
+	_, err := tx.t.tiedot.Use(collection).Read(id, out)
+	return err
+}
+
+// Query starts a query on collection whose Delete goes through tx.
+func (tx *Tx) Query(collection string) *Query {
+	return &Query{t: tx.t, tx: tx, name: collection}
+}
+
+// undo reverts the inserts and updates in entries, last first. Failures are
+// logged and skipped, to undo as much as possible.
+func (t *TiedotEngine) undo(entries []journalEntry) {
+	recorded := make(map[string]bool) // marks of the inserts with an ID
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		switch e.Op {
+		case opPending:
+			if !recorded[e.Mark] {
+				t.undoPending(e.Collection, e.Mark)
+			}
+		case opInsert:
+			recorded[e.Mark] = true
+			t.tiedot.Use(e.Collection).Delete(e.ID)
+		case opUpdate:
+			if err := t.tiedot.Use(e.Collection).Update(e.ID, e.Old); err != nil {
+				log.Errorf("Failure undoing update collection=%s id=%d err=%v", e.Collection, e.ID, err)
+			}
+		}
+	}
+}
+
+// undoPending deletes the documents of collection holding mark, inserted by a
+// transaction that didn't get to record their ID.
+func (t *TiedotEngine) undoPending(collection, mark string) {
+	col := t.tiedot.Use(collection)
+	if col == nil {
+		return
+	}
+	var ids []uint64
+	col.ForAll(func(id uint64, doc map[string]interface{}) bool {
+		if doc[txMark] == mark {
+			ids = append(ids, id)
+		}
+		return true
+	})
+	for _, id := range ids {
+		col.Delete(id)
+	}
+	log.V(1).Infof("Undid pending insert collection=%s documents=%d", collection, len(ids))
+}
+
+// redo makes the deletes in entries.
+func (t *TiedotEngine) redo(entries []journalEntry) {
+	for _, e := range entries {
+		if e.Op == opDelete {
+			t.tiedot.Use(e.Collection).Delete(e.ID)
+		}
+	}
+}
+
+// recoverJournal finishes the transaction left in the journal by a crash:
+// its deletes are made if it committed, and its writes undone otherwise.
+func (t *TiedotEngine) recoverJournal() error {
+	f, err := os.Open(t.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var entries []journalEntry
+	committed := false
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e journalEntry
+		err := dec.Decode(&e)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the last entry was cut short, so its write wasn't made
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("legowebservices/persist/kv: Reading journal: %v", err)
+		}
+		if e.Op == opCommit {
+			committed = true
+		}
+		entries = append(entries, e)
+	}
+	if committed {
+		t.redo(entries)
+		log.Infof("Finished committed transaction from journal writes=%d", len(entries)-1)
+	} else {
+		t.undo(entries)
+		log.Warningf("Rolled back interrupted transaction from journal writes=%d", len(entries))
+	}
+	return os.Remove(t.journalPath())
+}
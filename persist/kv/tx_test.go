@@ -0,0 +1,180 @@
+package kv
+
+import (
+	"errors"
+	. "github.com/ryansb/legowebservices/util/m"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type TxS struct{}
+
+var _ = Suite(&TxS{})
+
+func readM(c *C, e *TiedotEngine, collection string, id uint64) M {
+	var doc M
+	c.Assert(e.Read(collection, id, &doc), IsNil)
+	return doc
+}
+
+func (s *TxS) TestCommit(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a", "b"}, KeepIfExist)
+	e.AddIndex("a", Path{"N"})
+	gone, err := e.Insert("a", M{"N": 1})
+	c.Assert(err, IsNil)
+	upd, err := e.Insert("b", M{"N": 2})
+	c.Assert(err, IsNil)
+
+	var added uint64
+	err = e.Transact(func(tx *Tx) error {
+		var err error
+		if added, err = tx.Insert("a", M{"N": 3}); err != nil {
+			return err
+		}
+		if err := tx.Update("b", upd, M{"N": 4}); err != nil {
+			return err
+		}
+		n, err := tx.Query("a").Equals(Path{"N"}, 1).Delete()
+		c.Check(n, Equals, 1)
+		// deletes wait for the commit
+		var doc M
+		c.Check(tx.Read("a", gone, &doc), IsNil)
+		return err
+	})
+	c.Assert(err, IsNil)
+	c.Check(readM(c, e, "a", added)["N"], Equals, 3.0)
+	c.Check(readM(c, e, "b", upd)["N"], Equals, 4.0)
+	c.Check(e.Read("a", gone, new(M)), NotNil)
+	_, err = os.Stat(e.journalPath())
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TxS) TestRollback(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	e.AddUniqueIndex("a", Path{"N"})
+	keep, err := e.Insert("a", M{"N": 1})
+	c.Assert(err, IsNil)
+	other, err := e.Insert("a", M{"N": 2})
+	c.Assert(err, IsNil)
+
+	var added uint64
+	err = e.Transact(func(tx *Tx) error {
+		var err error
+		if added, err = tx.Insert("a", M{"N": 3}); err != nil {
+			return err
+		}
+		c.Assert(tx.Update("a", keep, M{"N": 10}), IsNil)
+		c.Assert(tx.Update("a", keep, M{"N": 11}), IsNil)
+		c.Assert(tx.Delete("a", other), IsNil)
+		// breaks the unique index, and rolls everything back
+		_, err = tx.Insert("a", M{"N": 2})
+		return err
+	})
+	c.Check(err, FitsTypeOf, &ErrDuplicate{})
+	c.Check(e.Read("a", added, new(M)), NotNil)
+	c.Check(readM(c, e, "a", keep)["N"], Equals, 1.0)
+	c.Check(readM(c, e, "a", other)["N"], Equals, 2.0)
+	all, err := e.All("a")
+	c.Assert(err, IsNil)
+	c.Check(all, HasLen, 2)
+}
+
+func (s *TxS) TestRollbackOnPanic(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	c.Check(func() {
+		e.Transact(func(tx *Tx) error {
+			tx.Insert("a", M{"N": 1})
+			panic("boom")
+		})
+	}, Panics, "boom")
+	all, err := e.All("a")
+	c.Assert(err, IsNil)
+	c.Check(all, HasLen, 0)
+	// the engine is usable again
+	c.Check(e.Transact(func(tx *Tx) error { return nil }), IsNil)
+	_, err = e.Insert("a", M{"N": 2})
+	c.Check(err, IsNil)
+}
+
+func (s *TxS) TestErrorKeepsNothing(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	boom := errors.New("boom")
+	err := e.Transact(func(tx *Tx) error {
+		tx.Insert("a", M{"N": 1})
+		return boom
+	})
+	c.Check(err, Equals, boom)
+	all, err := e.All("a")
+	c.Assert(err, IsNil)
+	c.Check(all, HasLen, 0)
+}
+
+// Test that opening an engine finishes the transaction left in the journal.
+func (s *TxS) TestRecoverJournal(c *C) {
+	dir := c.MkDir()
+	e := NewTiedotEngine(dir, []string{"a"}, KeepIfExist)
+	updated, err := e.Insert("a", M{"N": 1})
+	c.Assert(err, IsNil)
+	deleted, err := e.Insert("a", M{"N": 2})
+	c.Assert(err, IsNil)
+
+	// crashed before the commit: the insert and update are undone
+	inserted, err := e.Insert("a", M{"N": 3})
+	c.Assert(err, IsNil)
+	c.Assert(e.Update("a", updated, M{"N": 4}), IsNil)
+	journal := `{"op":"insert","collection":"a","id":` + itoa(inserted) + `}
+{"op":"update","collection":"a","id":` + itoa(updated) + `,"old":{"N":1}}
+{"op":"delete","collection":"a","id":` + itoa(deleted) + `}
+{"op":"up`
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, journalName), []byte(journal), 0600), IsNil)
+	e = NewTiedotEngine(dir, []string{"a"}, KeepIfExist)
+	c.Check(e.Read("a", inserted, new(M)), NotNil)
+	c.Check(readM(c, e, "a", updated)["N"], Equals, 1.0)
+	c.Check(readM(c, e, "a", deleted)["N"], Equals, 2.0)
+
+	// crashed after the commit: the deletes are made
+	journal = `{"op":"delete","collection":"a","id":` + itoa(deleted) + `}
+{"op":"commit"}
+`
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, journalName), []byte(journal), 0600), IsNil)
+	e = NewTiedotEngine(dir, []string{"a"}, KeepIfExist)
+	c.Check(e.Read("a", deleted, new(M)), NotNil)
+	c.Check(readM(c, e, "a", updated)["N"], Equals, 1.0)
+	_, err = os.Stat(filepath.Join(dir, journalName))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+// Test that an insert cut short before its ID reached the journal is undone
+// through its mark, and that committed inserts keep none.
+func (s *TxS) TestPendingInsert(c *C) {
+	dir := c.MkDir()
+	e := NewTiedotEngine(dir, []string{"a"}, KeepIfExist)
+	w, err := e.Watch("a", 0)
+	c.Assert(err, IsNil)
+	var added uint64
+	c.Assert(e.Transact(func(tx *Tx) error {
+		added, err = tx.Insert("a", M{"N": 1})
+		return err
+	}), IsNil)
+	c.Check(readM(c, e, "a", added), DeepEquals, M{"N": 1.0})
+	c.Check(next(c, w).Doc, DeepEquals, M{"N": 1.0})
+
+	orphan, err := e.Insert("a", M{"N": 2, txMark: "42.0"})
+	c.Assert(err, IsNil)
+	other, err := e.Insert("a", M{"N": 3, txMark: "43.0"})
+	c.Assert(err, IsNil)
+	journal := `{"op":"pending","collection":"a","mark":"42.0"}
+`
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, journalName), []byte(journal), 0600), IsNil)
+	e = NewTiedotEngine(dir, []string{"a"}, KeepIfExist)
+	c.Check(e.Read("a", orphan, new(M)), NotNil)
+	c.Check(readM(c, e, "a", other)["N"], Equals, 3.0)
+	c.Check(readM(c, e, "a", added)["N"], Equals, 1.0)
+}
+
+func itoa(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
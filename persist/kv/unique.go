@@ -0,0 +1,143 @@
+package kv
+
+import (
+	"fmt"
+	tiedot "github.com/HouzuoGuo/tiedot/db"
+	"github.com/ryansb/legowebservices/log"
+	. "github.com/ryansb/legowebservices/util/m"
+	"strings"
+)
+
+// ErrDuplicate is returned by Insert and Update when the document would
+// break a unique index.
+type ErrDuplicate struct {
+	Collection string
+	Index      IndexSpec
+	ID         uint64 // the document already holding the values
+}
+
+func (e *ErrDuplicate) Error() string {
+	return fmt.Sprintf("legowebservices/persist/kv: Duplicate %s in collection %s, id=%d", e.Index, e.Collection, e.ID)
+}
+
+// AddUniqueIndex indexes collection on path, like AddIndex, and rejects later
+// writes of documents with the same value there as another one. With more
+// than one path the index is compound. Documents already breaking it are
+// logged.
+func (t *TiedotEngine) AddUniqueIndex(collection string, path Path, more ...Path) {
+	idx := IndexSpec{Paths: append([]Path{path}, more...), Unique: true}
+	for _, p := range idx.Paths {
+		t.AddIndex(collection, p)
+	}
+	t.writes.RLock()
+	defer t.writes.RUnlock()
+	t.addUnique(collection, idx)
+}
+
+// addUnique enforces idx on collection for later writes, and reports the
+// documents already breaking it.
+func (t *TiedotEngine) addUnique(collection string, idx IndexSpec) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.unique == nil {
+		t.unique = make(map[string][]IndexSpec)
+	}
+	for _, u := range t.unique[collection] {
+		if u.String() == idx.String() {
+			return
+		}
+	}
+	t.unique[collection] = append(t.unique[collection], idx)
+
+	r := make(map[uint64]struct{})
+	if err := tiedot.EvalQuery("all", t.tiedot.Use(collection), &r); err != nil {
+		log.Errorf("Failure checking unique index=%s collection=%s err=%v", idx, collection, err)
+		return
+	}
+	seen := make(map[string]bool)
+	dups := 0
+	for id := range r {
+		var doc M
+		if _, err := t.tiedot.Use(collection).Read(id, &doc); err != nil {
+			continue
+		}
+		key, ok := uniqueKey(doc, idx)
+		if !ok {
+			continue
+		}
+		if seen[key] {
+			dups++
+		}
+		seen[key] = true
+	}
+	if dups > 0 {
+		log.Errorf("Existing documents break unique index=%s collection=%s duplicates=%d", idx, collection, dups)
+	}
+}
+
+// uniqueKey returns the values of doc at the paths of idx, as a string, and
+// false if doc lacks one of them.
+func uniqueKey(doc M, idx IndexSpec) (string, bool) {
+	parts := make([]string, len(idx.Paths))
+	for i, p := range idx.Paths {
+		v, ok := valueAt(doc, p)
+		if !ok {
+			return "", false
+		}
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, "\x00"), true
+}
+
+// valueAt returns the value at path p of doc.
+func valueAt(doc M, p Path) (interface{}, bool) {
+	var v interface{} = map[string]interface{}(doc)
+	for _, k := range p {
+		switch d := v.(type) {
+		case map[string]interface{}:
+			v = d[k]
+		case M:
+			v = d[k]
+		default:
+			return nil, false
+		}
+		if v == nil {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// checkUnique returns an error if doc, about to be written as id (0 for an
+// insert), would break a unique index of collection. t.writeMu is held.
+func (t *TiedotEngine) checkUnique(collection string, id uint64, doc M) error {
+	for _, idx := range t.unique[collection] {
+		var matches map[uint64]struct{}
+		for _, p := range idx.Paths {
+			v, ok := valueAt(doc, p)
+			if !ok {
+				matches = nil
+				break
+			}
+			r, err := t.Query(collection).Equals(p, v).eval()
+			if err != nil {
+				return err
+			}
+			if matches == nil {
+				matches = r
+				continue
+			}
+			for m := range matches {
+				if _, ok := r[m]; !ok {
+					delete(matches, m)
+				}
+			}
+		}
+		for other := range matches {
+			if other != id {
+				return &ErrDuplicate{Collection: collection, Index: idx, ID: other}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package kv
+
+import (
+	. "github.com/ryansb/legowebservices/util/m"
+	. "launchpad.net/gocheck"
+	"sync"
+)
+
+type UniqueS struct{}
+
+var _ = Suite(&UniqueS{})
+
+func (s *UniqueS) TestUnique(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"links"}, KeepIfExist)
+	e.AddUniqueIndex("links", Path{"Short"})
+	e.AddUniqueIndex("links", Path{"Owner"}, Path{"Name"})
+
+	id, err := e.Insert("links", M{"Short": 1, "Owner": "ann", "Name": "a"})
+	c.Assert(err, IsNil)
+	_, err = e.Insert("links", M{"Short": 1})
+	dup, ok := err.(*ErrDuplicate)
+	c.Assert(ok, Equals, true, Commentf("err=%v", err))
+	c.Check(dup.ID, Equals, id)
+	c.Check(dup.Collection, Equals, "links")
+	c.Check(dup.Index.String(), Equals, "Short")
+	c.Check(err, ErrorMatches, `.*Duplicate Short in collection links, id=\d+`)
+
+	// compound: only equal on both paths conflicts
+	other, err := e.Insert("links", M{"Short": 2, "Owner": "ann", "Name": "b"})
+	c.Assert(err, IsNil)
+	_, err = e.Insert("links", M{"Short": 3, "Owner": "bob", "Name": "a"})
+	c.Check(err, IsNil)
+	_, err = e.Insert("links", M{"Short": 4, "Owner": "ann", "Name": "a"})
+	c.Check(err, ErrorMatches, `.*Duplicate Owner\+Name in collection links, id=\d+`)
+	// missing paths aren't checked
+	_, err = e.Insert("links", M{"Owner": "ann"})
+	c.Check(err, IsNil)
+
+	// a document doesn't conflict with itself
+	c.Check(e.Update("links", id, M{"Short": 1, "Owner": "ann", "Name": "a", "HitCount": 3}), IsNil)
+	err = e.Update("links", other, M{"Short": 1, "Owner": "ann", "Name": "b"})
+	c.Assert(err, FitsTypeOf, &ErrDuplicate{})
+	c.Check(err.(*ErrDuplicate).ID, Equals, id)
+}
+
+func (s *UniqueS) TestConcurrentInserts(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"links"}, KeepIfExist)
+	e.AddUniqueIndex("links", Path{"Short"})
+
+	const writers = 20
+	var wg sync.WaitGroup
+	ids := make([]uint64, writers)
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// every writer races for slug 7, and half of them for their own
+			short := 7
+			if i%2 == 1 {
+				short = 100 + i
+			}
+			ids[i], errs[i] = e.Insert("links", M{"Short": short, "Writer": i})
+		}(i)
+	}
+	wg.Wait()
+
+	var winner uint64
+	won, lost := 0, 0
+	for i, err := range errs {
+		if i%2 == 1 {
+			c.Check(err, IsNil)
+			continue
+		}
+		if err == nil {
+			winner = ids[i]
+			won++
+			continue
+		}
+		c.Assert(err, FitsTypeOf, &ErrDuplicate{})
+		lost++
+	}
+	c.Check(won, Equals, 1)
+	c.Check(lost, Equals, writers/2-1)
+	for i, err := range errs {
+		if err != nil {
+			c.Check(err.(*ErrDuplicate).ID, Equals, winner, Commentf("writer %d", i))
+		}
+	}
+	r, err := e.Query("links").Equals(Path{"Short"}, 7).All()
+	c.Assert(err, IsNil)
+	c.Check(r, HasLen, 1)
+	all, err := e.All("links")
+	c.Assert(err, IsNil)
+	c.Check(all, HasLen, writers/2+1)
+}
+
+func (s *UniqueS) TestConcurrentUpdates(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"links"}, KeepIfExist)
+	e.AddUniqueIndex("links", Path{"Short"})
+	const docs = 10
+	ids := make([]uint64, docs)
+	for i := range ids {
+		var err error
+		ids[i], err = e.Insert("links", M{"Short": i})
+		c.Assert(err, IsNil)
+	}
+
+	// every document tries to take slug 1000
+	var wg sync.WaitGroup
+	errs := make([]error, docs)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = e.Update("links", ids[i], M{"Short": 1000})
+		}(i)
+	}
+	wg.Wait()
+	won := 0
+	for _, err := range errs {
+		if err == nil {
+			won++
+		} else {
+			c.Check(err, FitsTypeOf, &ErrDuplicate{})
+		}
+	}
+	c.Check(won, Equals, 1)
+	r, err := e.Query("links").Equals(Path{"Short"}, 1000).All()
+	c.Assert(err, IsNil)
+	c.Check(r, HasLen, 1)
+}
+
+func (s *UniqueS) TestExistingDuplicates(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"links"}, KeepIfExist)
+	a, err := e.Insert("links", M{"Short": 1})
+	c.Assert(err, IsNil)
+	_, err = e.Insert("links", M{"Short": 1})
+	c.Assert(err, IsNil)
+	// logged, and enforced from now on
+	e.AddUniqueIndex("links", Path{"Short"})
+	_, err = e.Insert("links", M{"Short": 1})
+	c.Check(err, FitsTypeOf, &ErrDuplicate{})
+	c.Check(e.Update("links", a, M{"Short": 2}), IsNil)
+}
@@ -0,0 +1,256 @@
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ryansb/legowebservices/log"
+	. "github.com/ryansb/legowebservices/util/m"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Event operations.
+const (
+	Inserted = "insert"
+	Updated  = "update"
+	Deleted  = "delete"
+)
+
+// WatchHistory is the number of recent events an engine keeps for watchers
+// resuming from an earlier sequence number.
+var WatchHistory = 1024
+
+// WatchBuffer is the number of events a watcher may fall behind by before it
+// is dropped.
+var WatchBuffer = 256
+
+// seqName is the file in the database directory holding the highest
+// sequence number the feed may have handed out, so that numbers aren't
+// reused once the engine is opened again. It is written every seqBlock
+// events rather than on each.
+const seqName = "lws.seq"
+
+const seqBlock = 1 << 16
+
+var (
+	// ErrWatchGap means the events after the sequence number asked for are
+	// no longer held, so the watcher has to reload what it watches.
+	ErrWatchGap = errors.New("legowebservices/persist/kv: Events to resume from are gone")
+	// ErrWatchOverflow means the watcher didn't keep up with the writes.
+	ErrWatchOverflow = errors.New("legowebservices/persist/kv: Watcher fell behind")
+)
+
+// Event is a change made to a document. Seq grows by one with each change to
+// any collection of the engine. When the engine is opened again it goes on
+// past every number the database handed out before, so watchers resuming
+// from an earlier run get ErrWatchGap rather than other events.
+type Event struct {
+	Seq        uint64 `json:"seq"`
+	Op         string `json:"op"`
+	Collection string `json:"collection"`
+	ID         uint64 `json:"id"`
+	Doc        M      `json:"doc,omitempty"` // new value, nil for deletes
+}
+
+// stored returns a copy of doc as tiedot stores it, decoded like Read does
+// (numbers are float64), so that events keep the value written even if the
+// caller changes its map afterwards.
+func stored(doc M) M {
+	if doc == nil {
+		return nil
+	}
+	j, err := json.Marshal(doc)
+	if err != nil {
+		log.Errorf("Failure copying document for its event err=%v", err)
+		return nil
+	}
+	var out M
+	if err := json.Unmarshal(j, &out); err != nil {
+		log.Errorf("Failure copying document for its event err=%v", err)
+		return nil
+	}
+	return out
+}
+
+// Watcher receives the events of a collection on C, see Watch.
+type Watcher struct {
+	C          <-chan Event
+	c          chan Event
+	collection string
+	f          *feed
+	err        error // why c was closed, guarded by f.mu
+	closed     bool
+}
+
+// Close stops the events and closes C.
+func (w *Watcher) Close() {
+	w.f.mu.Lock()
+	defer w.f.mu.Unlock()
+	w.f.drop(w, nil)
+}
+
+// Err returns why C was closed: nil after Close, ErrWatchOverflow when the
+// watcher fell behind, and ErrClosed when the engine was closed. A watcher
+// that fell behind can resume from the last Seq it got.
+func (w *Watcher) Err() error {
+	w.f.mu.Lock()
+	defer w.f.mu.Unlock()
+	return w.err
+}
+
+// feed hands the events of an engine to its watchers.
+type feed struct {
+	mu       sync.Mutex
+	seq      uint64
+	reserved uint64 // the number recorded in path
+	path     string
+	history  []Event // the last WatchHistory events, oldest first
+	watchers map[*Watcher]bool
+	closed   bool
+}
+
+// Watch returns a Watcher for the changes made to collection, or to every
+// collection if it is empty. With since above zero, the held events after
+// since are sent first; if some are gone Watch returns ErrWatchGap.
+//
+// Events are sent in the order the writes were made, a transaction's once it
+// commits. The Doc of an event is shared by the watchers and must not be
+// changed. A watcher that falls WatchBuffer events behind is dropped, and
+// Restore sends no events.
+func (t *TiedotEngine) Watch(collection string, since uint64) (*Watcher, error) {
+	f := &t.feed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, ErrClosed
+	}
+	var backlog []Event
+	if since > 0 {
+		if since > f.seq || (since < f.seq && (len(f.history) == 0 || f.history[0].Seq > since+1)) {
+			return nil, ErrWatchGap
+		}
+		for _, e := range f.history {
+			if e.Seq > since && (collection == "" || e.Collection == collection) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	c := make(chan Event, len(backlog)+WatchBuffer)
+	for _, e := range backlog {
+		c <- e
+	}
+	w := &Watcher{C: c, c: c, collection: collection, f: f}
+	if f.watchers == nil {
+		f.watchers = make(map[*Watcher]bool)
+	}
+	f.watchers[w] = true
+	log.V(2).Infof("Watching collection=%q since=%d backlog=%d", collection, since, len(backlog))
+	return w, nil
+}
+
+// publish numbers e and sends it to the watchers. Callers hold the lock that
+// orders their writes, so events go out in the same order.
+func (f *feed) publish(op, collection string, id uint64, doc M) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	if f.seq > f.reserved {
+		f.reserve()
+	}
+	e := Event{Seq: f.seq, Op: op, Collection: collection, ID: id, Doc: doc}
+	f.history = append(f.history, e)
+	if len(f.history) >= 2*WatchHistory {
+		f.history = append([]Event(nil), f.history[len(f.history)-WatchHistory:]...)
+	}
+	for w := range f.watchers {
+		if w.collection != "" && w.collection != collection {
+			continue
+		}
+		select {
+		case w.c <- e:
+		default:
+			log.Warningf("Dropping watcher that fell behind collection=%q seq=%d", w.collection, e.Seq)
+			f.drop(w, ErrWatchOverflow)
+		}
+	}
+}
+
+// open loads the sequence number recorded at path, where the feed records
+// its own from now on.
+func (f *feed) open(path string) error {
+	f.path = path
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("legowebservices/persist/kv: Reading %s: %v", seqName, err)
+	}
+	f.seq, f.reserved = seq, seq
+	return nil
+}
+
+// reserve records that numbers up to seqBlock past f.seq may be handed out.
+// Failures are logged and retried with the next event. f.mu is held.
+func (f *feed) reserve() {
+	reserved := f.seq + seqBlock - 1
+	tmp := f.path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(reserved, 10)+"\n"), 0600)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, f.path)
+	}
+	if err != nil {
+		log.Errorf("Failure recording event sequence path=%s err=%v", f.path, err)
+		return
+	}
+	f.reserved = reserved
+}
+
+// syncFile waits for the content of name to reach the disk.
+func syncFile(name string) error {
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (t *TiedotEngine) seqPath() string {
+	return filepath.Join(t.tiedot.BaseDir, seqName)
+}
+
+// drop closes w for err. f.mu is held.
+func (f *feed) drop(w *Watcher, err error) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.err = err
+	delete(f.watchers, w)
+	close(w.c)
+}
+
+// close drops every watcher, for when the engine is closed.
+func (f *feed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for w := range f.watchers {
+		f.drop(w, ErrClosed)
+	}
+}
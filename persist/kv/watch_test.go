@@ -0,0 +1,204 @@
+package kv
+
+import (
+	"errors"
+	. "github.com/ryansb/legowebservices/util/m"
+	. "launchpad.net/gocheck"
+)
+
+type WatchS struct{}
+
+var _ = Suite(&WatchS{})
+
+// next returns the next event of w, failing if none is waiting.
+func next(c *C, w *Watcher) Event {
+	select {
+	case e, ok := <-w.C:
+		c.Assert(ok, Equals, true, Commentf("watcher closed err=%v", w.Err()))
+		return e
+	default:
+		c.Fatal("no event")
+	}
+	panic("unreachable")
+}
+
+func (s *WatchS) TestEvents(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a", "b"}, KeepIfExist)
+	e.AddIndex("a", Path{"N"})
+	w, err := e.Watch("a", 0)
+	c.Assert(err, IsNil)
+	all, err := e.Watch("", 0)
+	c.Assert(err, IsNil)
+
+	id, _ := e.Insert("a", M{"N": 1})
+	e.Insert("b", M{"N": 2})
+	c.Assert(e.Update("a", id, M{"N": 3}), IsNil)
+	e.Delete("a", id)
+	e.Insert("a", M{"N": 4})
+	n, err := e.Query("a").Equals(Path{"N"}, 4).Delete()
+	c.Assert(n, Equals, 1)
+
+	ev := next(c, w)
+	c.Check(ev, DeepEquals, Event{Seq: 1, Op: Inserted, Collection: "a", ID: id, Doc: M{"N": 1.0}})
+	ev = next(c, w)
+	c.Check(ev.Seq, Equals, uint64(3))
+	c.Check(ev.Op, Equals, Updated)
+	c.Check(ev.Doc, DeepEquals, M{"N": 3.0})
+	ev = next(c, w)
+	c.Check(ev, DeepEquals, Event{Seq: 4, Op: Deleted, Collection: "a", ID: id})
+	c.Check(next(c, w).Op, Equals, Inserted)
+	c.Check(next(c, w).Op, Equals, Deleted)
+	c.Check(w.C, HasLen, 0)
+	c.Check(all.C, HasLen, 6)
+
+	w.Close()
+	_, ok := <-w.C
+	c.Check(ok, Equals, false)
+	c.Check(w.Err(), IsNil)
+	e.Close()
+	_, ok = <-all.C
+	for ok {
+		_, ok = <-all.C
+	}
+	c.Check(all.Err(), Equals, ErrClosed)
+	_, err = e.Watch("a", 0)
+	c.Check(err, Equals, ErrClosed)
+}
+
+func (s *WatchS) TestResume(c *C) {
+	defer func(n int) { WatchHistory = n }(WatchHistory)
+	WatchHistory = 3
+	e := NewTiedotEngine(c.MkDir(), []string{"a", "b"}, KeepIfExist)
+	for i := 0; i < 4; i++ {
+		e.Insert("a", M{"N": i})
+		e.Insert("b", M{"N": i})
+	}
+	// seqs 1-8 made, the history holds at least 6-8
+	w, err := e.Watch("a", 6)
+	c.Assert(err, IsNil)
+	ev := next(c, w)
+	c.Check(ev.Seq, Equals, uint64(7))
+	c.Check(ev.Doc, DeepEquals, M{"N": 3.0})
+	c.Check(w.C, HasLen, 0)
+	w, err = e.Watch("b", 8)
+	c.Assert(err, IsNil)
+	c.Check(w.C, HasLen, 0)
+
+	for i := 0; i < 4; i++ {
+		e.Insert("a", M{"N": i})
+	}
+	_, err = e.Watch("a", 2)
+	c.Check(err, Equals, ErrWatchGap)
+	// from an earlier run of the engine
+	_, err = e.Watch("a", 100)
+	c.Check(err, Equals, ErrWatchGap)
+}
+
+func (s *WatchS) TestOverflow(c *C) {
+	defer func(n int) { WatchBuffer = n }(WatchBuffer)
+	WatchBuffer = 2
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	w, err := e.Watch("a", 0)
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		e.Insert("a", M{"N": i})
+	}
+	c.Check(next(c, w).Seq, Equals, uint64(1))
+	c.Check(next(c, w).Seq, Equals, uint64(2))
+	_, ok := <-w.C
+	c.Check(ok, Equals, false)
+	c.Check(w.Err(), Equals, ErrWatchOverflow)
+	w.Close()
+
+	// resuming picks up what was missed
+	w, err = e.Watch("a", 2)
+	c.Assert(err, IsNil)
+	c.Check(next(c, w).Seq, Equals, uint64(3))
+}
+
+func (s *WatchS) TestTransaction(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	id, _ := e.Insert("a", M{"N": 1})
+	w, err := e.Watch("a", 0)
+	c.Assert(err, IsNil)
+
+	err = e.Transact(func(tx *Tx) error {
+		tx.Insert("a", M{"N": 2})
+		return errors.New("nope")
+	})
+	c.Assert(err, NotNil)
+	c.Check(w.C, HasLen, 0)
+
+	var added uint64
+	err = e.Transact(func(tx *Tx) error {
+		if err := tx.Delete("a", id); err != nil {
+			return err
+		}
+		added, err = tx.Insert("a", M{"N": 3})
+		c.Check(w.C, HasLen, 0)
+		return err
+	})
+	c.Assert(err, IsNil)
+	c.Check(next(c, w), DeepEquals, Event{Seq: 2, Op: Deleted, Collection: "a", ID: id})
+	c.Check(next(c, w), DeepEquals, Event{Seq: 3, Op: Inserted, Collection: "a", ID: added, Doc: M{"N": 3.0}})
+}
+
+func (s *WatchS) TestEventsKeepValues(c *C) {
+	e := NewTiedotEngine(c.MkDir(), []string{"a"}, KeepIfExist)
+	w, err := e.Watch("a", 0)
+	c.Assert(err, IsNil)
+
+	// the caller reusing its map doesn't change the events already made
+	doc := M{"A": 1, "Tags": []interface{}{"x"}}
+	id, err := e.Insert("a", doc)
+	c.Assert(err, IsNil)
+	doc["A"] = 2
+	doc["Tags"].([]interface{})[0] = "y"
+	c.Assert(e.Update("a", id, doc), IsNil)
+	doc["A"] = 3
+	err = e.Transact(func(tx *Tx) error {
+		err := tx.Update("a", id, doc)
+		doc["A"] = 4
+		return err
+	})
+	c.Assert(err, IsNil)
+
+	c.Check(next(c, w).Doc, DeepEquals, M{"A": 1.0, "Tags": []interface{}{"x"}})
+	c.Check(next(c, w).Doc, DeepEquals, M{"A": 2.0, "Tags": []interface{}{"y"}})
+	c.Check(next(c, w).Doc, DeepEquals, M{"A": 3.0, "Tags": []interface{}{"y"}})
+	resumed, err := e.Watch("a", 1)
+	c.Assert(err, IsNil)
+	c.Check(next(c, resumed).Doc, DeepEquals, M{"A": 2.0, "Tags": []interface{}{"y"}})
+}
+
+func (s *WatchS) TestSeqAcrossRestarts(c *C) {
+	dir := c.MkDir()
+	e := NewTiedotEngine(dir, []string{"a"}, KeepIfExist)
+	for i := 0; i < 3; i++ {
+		e.Insert("a", M{"N": i})
+	}
+	c.Assert(e.Close(), IsNil)
+
+	// the numbers of the last run aren't handed out again
+	e = NewTiedotEngine(dir, []string{"a"}, KeepIfExist)
+	_, err := e.Watch("a", 2)
+	c.Check(err, Equals, ErrWatchGap)
+	_, err = e.Watch("a", 500)
+	c.Check(err, Equals, ErrWatchGap)
+	w, err := e.Watch("a", 0)
+	c.Assert(err, IsNil)
+	e.Insert("a", M{"N": 3})
+	ev := next(c, w)
+	c.Check(ev.Seq > 3, Equals, true)
+	_, err = e.Watch("a", ev.Seq-1)
+	c.Check(err, IsNil)
+	c.Assert(e.Close(), IsNil)
+
+	e = NewTiedotEngine(dir, []string{"a"}, KeepIfExist)
+	_, err = e.Watch("a", ev.Seq)
+	c.Check(err, Equals, ErrWatchGap)
+	w, err = e.Watch("a", 0)
+	c.Assert(err, IsNil)
+	e.Insert("a", M{"N": 4})
+	c.Check(next(c, w).Seq > ev.Seq, Equals, true)
+}
@@ -0,0 +1,209 @@
+// Package persist holds what services share about their stored data; the
+// storage engines themselves live in subpackages.
+package persist
+
+import (
+	"fmt"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	. "github.com/ryansb/legowebservices/util/m"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MigrationsCollection records the migrations applied to the database.
+const MigrationsCollection = "lws.migrations"
+
+// Collections are the collections persist keeps its own records in.
+var Collections = []kv.CollectionSpec{{Name: MigrationsCollection}}
+
+// Migration upgrades the documents of a collection to a new version. Services
+// register theirs from init, and Migrate runs the ones the database hasn't
+// seen yet, in version order:
+//
+//	func init() {
+//		persist.RegisterMigration("short.url", persist.Migration{
+//			Version: 1,
+//			Name:    "add Owner",
+//			Doc: func(doc M) (bool, error) {
+//				if _, ok := doc["Owner"]; ok {
+//					return false, nil
+//				}
+//				doc["Owner"] = ""
+//				return true, nil
+//			},
+//		})
+//	}
+type Migration struct {
+	Version int    // greater than 0, unique within the collection
+	Name    string // what it does, for the logs and the record
+	// Doc changes one document in place and reports whether it did. A
+	// migration that fails part way is run again from the start, so Doc must
+	// leave an already upgraded document alone.
+	Doc func(doc M) (bool, error)
+}
+
+// Applied records a migration run on a collection.
+type Applied struct {
+	Collection string
+	Version    int
+	Name       string
+	Changed    int // documents changed
+	Time       time.Time
+}
+
+func (a Applied) ToM() M {
+	return M{
+		"Collection": a.Collection,
+		"Version":    a.Version,
+		"Name":       a.Name,
+		"Changed":    a.Changed,
+		"Time":       a.Time.UTC().Format(time.RFC3339),
+	}
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = make(map[string][]Migration)
+)
+
+// RegisterMigration adds m to the migrations of collection. It panics on a
+// bad or duplicate version, so it is meant to be called from init.
+func RegisterMigration(collection string, m Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if m.Version < 1 || m.Doc == nil {
+		panic(fmt.Sprintf("persist: migration %d of %s needs a positive version and a Doc", m.Version, collection))
+	}
+	ms := migrations[collection]
+	for _, o := range ms {
+		if o.Version == m.Version {
+			panic(fmt.Sprintf("persist: migration %d of %s registered twice", m.Version, collection))
+		}
+	}
+	ms = append(ms, m)
+	sort.Sort(byVersion(ms))
+	migrations[collection] = ms
+}
+
+type byVersion []Migration
+
+func (b byVersion) Len() int           { return len(b) }
+func (b byVersion) Less(i, j int) bool { return b[i].Version < b[j].Version }
+func (b byVersion) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Versions returns the version each collection was migrated to, according to
+// the record in MigrationsCollection.
+func Versions(tde *kv.TiedotEngine) (map[string]int, error) {
+	versions := make(map[string]int)
+	if tde.Check(MigrationsCollection) != nil {
+		return versions, nil
+	}
+	ids, err := tde.All(MigrationsCollection)
+	if err != nil {
+		return nil, err
+	}
+	for id := range ids {
+		var a Applied
+		if err := tde.Read(MigrationsCollection, id, &a); err != nil {
+			return nil, err
+		}
+		if a.Version > versions[a.Collection] {
+			versions[a.Collection] = a.Version
+		}
+	}
+	return versions, nil
+}
+
+// Migrate runs the registered migrations newer than the version recorded for
+// their collection, collection by collection and in version order, and
+// records each one. With dryRun it changes nothing and returns what it would
+// have done. It stops at the first error, keeping the migrations done so far.
+func Migrate(tde *kv.TiedotEngine, dryRun bool) ([]Applied, error) {
+	versions, err := Versions(tde)
+	if err != nil {
+		return nil, err
+	}
+	migrationsMu.Lock()
+	names := make([]string, 0, len(migrations))
+	pending := make(map[string][]Migration)
+	for c, ms := range migrations {
+		for i, m := range ms {
+			if m.Version > versions[c] {
+				names = append(names, c)
+				pending[c] = ms[i:]
+				break
+			}
+		}
+	}
+	migrationsMu.Unlock()
+	sort.Strings(names)
+	if len(names) > 0 && !dryRun {
+		if err := tde.AddCollection(MigrationsCollection); err != nil {
+			return nil, err
+		}
+	}
+
+	var done []Applied
+	for _, c := range names {
+		applied, err := migrateCollection(tde, c, pending[c], dryRun)
+		done = append(done, applied...)
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// migrateCollection runs ms on collection c, which may not exist yet. The
+// documents are kept in memory between migrations, so a dry run sees the
+// changes of the earlier ones.
+func migrateCollection(tde *kv.TiedotEngine, c string, ms []Migration, dryRun bool) ([]Applied, error) {
+	var all map[uint64]struct{}
+	if tde.Check(c) == nil {
+		var err error
+		if all, err = tde.All(c); err != nil {
+			return nil, err
+		}
+	}
+	docs := make(map[uint64]M, len(all))
+	for id := range all {
+		var doc M
+		if err := tde.Read(c, id, &doc); err != nil {
+			return nil, err
+		}
+		docs[id] = doc
+	}
+
+	var done []Applied
+	for _, m := range ms {
+		a := Applied{Collection: c, Version: m.Version, Name: m.Name, Time: time.Now()}
+		for id, doc := range docs {
+			changed, err := m.Doc(doc)
+			if err != nil {
+				return done, fmt.Errorf("persist: migration %d (%s) of %s failed on id=%d: %v", m.Version, m.Name, c, id, err)
+			}
+			if !changed {
+				continue
+			}
+			a.Changed++
+			if dryRun {
+				continue
+			}
+			if err := tde.Update(c, id, doc); err != nil {
+				return done, err
+			}
+		}
+		if dryRun {
+			log.Infof("Would migrate collection=%s version=%d name=%q changed=%d", c, m.Version, m.Name, a.Changed)
+		} else {
+			if _, err := tde.Insert(MigrationsCollection, a); err != nil {
+				return done, err
+			}
+			log.Infof("Migrated collection=%s version=%d name=%q changed=%d", c, m.Version, m.Name, a.Changed)
+		}
+		done = append(done, a)
+	}
+	return done, nil
+}
@@ -0,0 +1,103 @@
+package persist
+
+import (
+	"errors"
+	"github.com/ryansb/legowebservices/persist/kv"
+	. "github.com/ryansb/legowebservices/util/m"
+	. "launchpad.net/gocheck"
+	"strings"
+)
+
+func addOwner(doc M) (bool, error) {
+	if _, ok := doc["Owner"]; ok {
+		return false, nil
+	}
+	doc["Owner"] = "nobody"
+	return true, nil
+}
+
+func renameName(doc M) (bool, error) {
+	if _, ok := doc["Name"]; !ok {
+		return false, nil
+	}
+	doc["FullName"] = doc["Name"]
+	delete(doc, "Name")
+	return true, nil
+}
+
+func resetMigrations() {
+	migrationsMu.Lock()
+	migrations = make(map[string][]Migration)
+	migrationsMu.Unlock()
+}
+
+func allDocs(c *C, engine *kv.TiedotEngine) []M {
+	ids, err := engine.All("fake")
+	c.Assert(err, IsNil)
+	var docs []M
+	for id := range ids {
+		var doc M
+		c.Assert(engine.Read("fake", id, &doc), IsNil)
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func (s *TS) TestMigrate(c *C) {
+	engine := getEngine()
+	defer engine.DB().Close()
+	defer resetMigrations()
+	engine.Insert("fake", person{Name: "Bob", Age: 42})
+	engine.Insert("fake", M{"Name": "Ann", "Owner": "ann"})
+	// registered out of order
+	RegisterMigration("fake", Migration{Version: 2, Name: "rename Name", Doc: renameName})
+	RegisterMigration("fake", Migration{Version: 1, Name: "add Owner", Doc: addOwner})
+
+	applied, err := Migrate(engine, true)
+	c.Assert(err, IsNil)
+	c.Assert(applied, HasLen, 2)
+	c.Check(applied[0].Version, Equals, 1)
+	c.Check(applied[0].Changed, Equals, 1)
+	c.Check(applied[1].Name, Equals, "rename Name")
+	c.Check(applied[1].Changed, Equals, 2)
+	c.Check(engine.Check(MigrationsCollection), NotNil)
+	for _, doc := range allDocs(c, engine) {
+		c.Check(doc["Name"], NotNil)
+	}
+
+	applied, err = Migrate(engine, false)
+	c.Assert(err, IsNil)
+	c.Assert(applied, HasLen, 2)
+	owners := make([]string, 0, 2)
+	for _, doc := range allDocs(c, engine) {
+		c.Check(doc["Name"], IsNil)
+		owners = append(owners, doc["Owner"].(string)+":"+doc["FullName"].(string))
+	}
+	c.Check(strings.Contains(strings.Join(owners, " "), "nobody:Bob"), Equals, true)
+	versions, err := Versions(engine)
+	c.Assert(err, IsNil)
+	c.Check(versions, DeepEquals, map[string]int{"fake": 2})
+
+	// nothing left to do
+	applied, err = Migrate(engine, false)
+	c.Assert(err, IsNil)
+	c.Check(applied, HasLen, 0)
+
+	RegisterMigration("fake", Migration{Version: 3, Name: "broken", Doc: func(M) (bool, error) {
+		return false, errors.New("boom")
+	}})
+	applied, err = Migrate(engine, false)
+	c.Check(err, ErrorMatches, `persist: migration 3 \(broken\) of fake failed on id=\d+: boom`)
+	c.Check(applied, HasLen, 0)
+	versions, err = Versions(engine)
+	c.Assert(err, IsNil)
+	c.Check(versions["fake"], Equals, 2)
+}
+
+func (s *TS) TestRegisterMigration(c *C) {
+	defer resetMigrations()
+	RegisterMigration("fake", Migration{Version: 1, Doc: addOwner})
+	c.Check(func() { RegisterMigration("fake", Migration{Version: 1, Doc: addOwner}) }, Panics, "persist: migration 1 of fake registered twice")
+	c.Check(func() { RegisterMigration("fake", Migration{Version: 0, Doc: addOwner}) }, PanicMatches, ".*positive version.*")
+	c.Check(func() { RegisterMigration("fake", Migration{Version: 2}) }, PanicMatches, ".*positive version.*")
+}
@@ -0,0 +1,371 @@
+// Package repo stores structs in kv collections, going by the kv tags of
+// their fields:
+//
+//	type Link struct {
+//		ID       uint64 `kv:",id"`
+//		Original string
+//		Short    int64  `kv:"Short,index,unique"`
+//		Draft    bool   `kv:"-"`
+//	}
+//
+//	var links = repo.NewModel("short.url", Link{})
+//
+// A field is stored under the name in its tag, or its own name without one,
+// and "-" leaves it out. The index and unique options declare an index on the
+// field in Spec. The uint64 field marked id isn't stored: it holds the ID of
+// the document, which Save fills in. The text option declares a text index,
+// for kv.Query.Match.
+//
+//	l := &Link{Original: "http://example.com", Short: 1}
+//	_, err := links.Repo(tde).Save(l)
+//	err = links.Repo(tde).FindOne(l, "Short", 1)
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ryansb/legowebservices/persist/kv"
+	. "github.com/ryansb/legowebservices/util/m"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var uint64Type = reflect.TypeOf(uint64(0))
+
+type field struct {
+	index   int // in the struct
+	name    string
+	indexed bool
+	unique  bool
+	text    bool
+}
+
+// Model says how the structs of one type are stored in a collection.
+type Model struct {
+	Collection string
+	typ        reflect.Type
+	fields     []field
+	names      map[string]bool
+	id         int // index of the ID field, -1 without one
+}
+
+// NewModel returns the model for structs of the type of proto, a struct or a
+// pointer to one, stored in collection. It panics on bad tags, so it is meant
+// for package variables.
+func NewModel(collection string, proto interface{}) *Model {
+	t := reflect.TypeOf(proto)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("repo: model of %s needs a struct, got %T", collection, proto))
+	}
+	m := &Model{Collection: collection, typ: t, names: make(map[string]bool), id: -1}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("kv")
+		if sf.PkgPath != "" || tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		f := field{index: i, name: opts[0]}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		id := false
+		for _, o := range opts[1:] {
+			switch o {
+			case "index":
+				f.indexed = true
+			case "unique":
+				f.indexed, f.unique = true, true
+			case "text":
+				f.text = true
+			case "id":
+				id = true
+			default:
+				panic(fmt.Sprintf("repo: unknown option %q on %s.%s", o, t.Name(), sf.Name))
+			}
+		}
+		if id {
+			if sf.Type != uint64Type || m.id >= 0 || f.indexed || f.text {
+				panic(fmt.Sprintf("repo: %s.%s can't be the id, there must be one uint64 id without other options", t.Name(), sf.Name))
+			}
+			m.id = i
+			continue
+		}
+		if m.names[f.name] {
+			panic(fmt.Sprintf("repo: %s stores two fields as %s", t.Name(), f.name))
+		}
+		m.fields = append(m.fields, f)
+		m.names[f.name] = true
+	}
+	return m
+}
+
+// Spec declares the collection of m and the indexes its tags ask for, for
+// kv.TiedotEngine.Reconcile.
+func (m *Model) Spec() kv.CollectionSpec {
+	spec := kv.CollectionSpec{Name: m.Collection}
+	for _, f := range m.fields {
+		if f.indexed {
+			spec.Indexes = append(spec.Indexes, kv.IndexSpec{Paths: []kv.Path{{f.name}}, Unique: f.unique})
+		}
+		if f.text {
+			spec.Indexes = append(spec.Indexes, kv.IndexSpec{Paths: []kv.Path{{f.name}}, Text: true})
+		}
+	}
+	return spec
+}
+
+// ToM returns the document storing v, a struct of the model or a pointer to
+// one. Types implement kv.Insertable with it:
+//
+//	func (l Link) ToM() M { return links.ToM(l) }
+func (m *Model) ToM(v interface{}) M {
+	sv := m.value(v)
+	doc := make(M, len(m.fields))
+	for _, f := range m.fields {
+		doc[f.name] = sv.Field(f.index).Interface()
+	}
+	return doc
+}
+
+// FromM sets the fields of out, a pointer to a struct of the model, from doc.
+// Fields missing from doc are left alone.
+func (m *Model) FromM(doc M, out interface{}) error {
+	ov := reflect.ValueOf(out)
+	if ov.Kind() != reflect.Ptr || ov.Elem().Type() != m.typ {
+		return fmt.Errorf("repo: %s needs a *%s, got %T", m.Collection, m.typ.Name(), out)
+	}
+	sv := ov.Elem()
+	for _, f := range m.fields {
+		v, ok := doc[f.name]
+		if !ok {
+			continue
+		}
+		if err := assign(sv.Field(f.index), v); err != nil {
+			return fmt.Errorf("repo: %s.%s: %v", m.typ.Name(), m.typ.Field(f.index).Name, err)
+		}
+	}
+	return nil
+}
+
+// assign sets fv to v, converting the float64s of decoded JSON and going
+// through JSON for anything else it can't set directly.
+func assign(fv reflect.Value, v interface{}) error {
+	if v == nil {
+		fv.Set(reflect.Zero(fv.Type()))
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Type().AssignableTo(fv.Type()) {
+		fv.Set(rv)
+		return nil
+	}
+	if f, ok := v.(float64); ok {
+		switch fv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fv.SetInt(int64(f))
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fv.SetUint(uint64(f))
+			return nil
+		case reflect.Float32, reflect.Float64:
+			fv.SetFloat(f)
+			return nil
+		}
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, fv.Addr().Interface())
+}
+
+// value returns the struct v holds or points to, panicking if it isn't one
+// of the model, as callers pass their own types.
+func (m *Model) value(v interface{}) reflect.Value {
+	sv := reflect.ValueOf(v)
+	if sv.Kind() == reflect.Ptr {
+		sv = sv.Elem()
+	}
+	if !sv.IsValid() || sv.Type() != m.typ {
+		panic(fmt.Sprintf("repo: %s stores %s, got %T", m.Collection, m.typ.Name(), v))
+	}
+	return sv
+}
+
+func (m *Model) setID(sv reflect.Value, id uint64) {
+	if m.id >= 0 {
+		sv.Field(m.id).SetUint(id)
+	}
+}
+
+// Repo reads and writes the structs of a model, in an engine or a
+// transaction.
+type Repo struct {
+	m   *Model
+	tde *kv.TiedotEngine
+	tx  *kv.Tx
+}
+
+// Repo returns the repository of m in tde.
+func (m *Model) Repo(tde *kv.TiedotEngine) *Repo {
+	return &Repo{m: m, tde: tde}
+}
+
+// In returns the repository of m writing through tx.
+func (m *Model) In(tx *kv.Tx) *Repo {
+	return &Repo{m: m, tx: tx}
+}
+
+// Get reads document id into out, a pointer to a struct of the model.
+func (r *Repo) Get(id uint64, out interface{}) error {
+	var doc M
+	var err error
+	if r.tx != nil {
+		err = r.tx.Read(r.m.Collection, id, &doc)
+	} else {
+		err = r.tde.Read(r.m.Collection, id, &doc)
+	}
+	if err != nil {
+		return err
+	}
+	if err := r.m.FromM(doc, out); err != nil {
+		return err
+	}
+	r.m.setID(reflect.ValueOf(out).Elem(), id)
+	return nil
+}
+
+// Query starts a query on the collection of the model, for All.
+func (r *Repo) Query() *kv.Query {
+	if r.tx != nil {
+		return r.tx.Query(r.m.Collection)
+	}
+	return r.tde.Query(r.m.Collection)
+}
+
+// Find sets out, a pointer to a slice of structs of the model or of pointers
+// to them, to the documents whose field equals value, by ID. The field must
+// be indexed.
+func (r *Repo) Find(out interface{}, field string, value interface{}) error {
+	q, err := r.equals(field, value)
+	if err != nil {
+		return err
+	}
+	return r.All(q, out)
+}
+
+// FindOne reads a document whose field equals value into out, a pointer to a
+// struct of the model. It returns kv.ErrNotFound if there is none.
+func (r *Repo) FindOne(out interface{}, field string, value interface{}) error {
+	q, err := r.equals(field, value)
+	if err != nil {
+		return err
+	}
+	id, v, err := q.One()
+	if err != nil {
+		return err
+	}
+	doc, _ := v.(map[string]interface{})
+	if err := r.m.FromM(doc, out); err != nil {
+		return err
+	}
+	r.m.setID(reflect.ValueOf(out).Elem(), id)
+	return nil
+}
+
+func (r *Repo) equals(field string, value interface{}) (*kv.Query, error) {
+	if !r.m.names[field] {
+		return nil, fmt.Errorf("repo: %s has no field %s", r.m.typ.Name(), field)
+	}
+	return r.Query().Equals(kv.Path{field}, value), nil
+}
+
+// All sets out, as for Find, to the documents q matches.
+func (r *Repo) All(q *kv.Query, out interface{}) error {
+	ov := reflect.ValueOf(out)
+	if ov.Kind() != reflect.Ptr || ov.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("repo: %s needs a pointer to a slice, got %T", r.m.Collection, out)
+	}
+	et := ov.Elem().Type().Elem()
+	ptrs := et.Kind() == reflect.Ptr
+	if et != r.m.typ && !(ptrs && et.Elem() == r.m.typ) {
+		return fmt.Errorf("repo: %s needs a slice of %s, got %T", r.m.Collection, r.m.typ.Name(), out)
+	}
+	res, err := q.All()
+	if err != nil {
+		return err
+	}
+	ids := make([]uint64, 0, len(res))
+	for id := range res {
+		ids = append(ids, id)
+	}
+	sort.Sort(byID(ids))
+	list := reflect.MakeSlice(ov.Elem().Type(), 0, len(ids))
+	for _, id := range ids {
+		p := reflect.New(r.m.typ)
+		doc, _ := res[id].(map[string]interface{})
+		if err := r.m.FromM(doc, p.Interface()); err != nil {
+			return err
+		}
+		r.m.setID(p.Elem(), id)
+		if ptrs {
+			list = reflect.Append(list, p)
+		} else {
+			list = reflect.Append(list, p.Elem())
+		}
+	}
+	ov.Elem().Set(list)
+	return nil
+}
+
+type byID []uint64
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Less(i, j int) bool { return b[i] < b[j] }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Save stores v, a pointer to a struct of the model, and returns its ID. It
+// is inserted if its ID field is zero, and the field set to the new ID, and
+// updated otherwise. Models without an ID field always insert.
+func (r *Repo) Save(v interface{}) (uint64, error) {
+	sv := reflect.ValueOf(v)
+	if sv.Kind() != reflect.Ptr {
+		return 0, fmt.Errorf("repo: %s saves a *%s, got %T", r.m.Collection, r.m.typ.Name(), v)
+	}
+	doc := r.m.ToM(v)
+	var id uint64
+	if r.m.id >= 0 {
+		id = sv.Elem().Field(r.m.id).Uint()
+	}
+	if id != 0 {
+		if r.tx != nil {
+			return id, r.tx.Update(r.m.Collection, id, doc)
+		}
+		return id, r.tde.Update(r.m.Collection, id, doc)
+	}
+	var err error
+	if r.tx != nil {
+		id, err = r.tx.Insert(r.m.Collection, doc)
+	} else {
+		id, err = r.tde.Insert(r.m.Collection, doc)
+	}
+	if err != nil {
+		return 0, err
+	}
+	r.m.setID(sv.Elem(), id)
+	return id, nil
+}
+
+// Delete removes document id.
+func (r *Repo) Delete(id uint64) error {
+	if r.tx != nil {
+		return r.tx.Delete(r.m.Collection, id)
+	}
+	r.tde.Delete(r.m.Collection, id)
+	return nil
+}
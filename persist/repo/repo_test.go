@@ -0,0 +1,152 @@
+package repo
+
+import (
+	"github.com/ryansb/legowebservices/persist/kv"
+	. "github.com/ryansb/legowebservices/util/m"
+	. "launchpad.net/gocheck"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TS struct{}
+
+var _ = Suite(&TS{})
+
+type link struct {
+	ID       uint64   `kv:",id"`
+	Original string   `kv:"Original,text"`
+	Short    int64    `kv:"short,index,unique"`
+	Tags     []string `kv:"tags"`
+	Owner    *owner
+	Draft    bool `kv:"-"`
+	hits     int
+}
+
+type owner struct {
+	Name string
+}
+
+var links = NewModel("links", link{})
+
+func engine(c *C) *kv.TiedotEngine {
+	tde := kv.NewTiedotEngine(c.MkDir(), nil, kv.KeepIfExist)
+	_, err := tde.Reconcile([]kv.CollectionSpec{links.Spec()}, false)
+	c.Assert(err, IsNil)
+	return tde
+}
+
+func (s *TS) TestModel(c *C) {
+	c.Check(links.Spec(), DeepEquals, kv.CollectionSpec{
+		Name: "links",
+		Indexes: []kv.IndexSpec{
+			{Paths: []kv.Path{{"Original"}}, Text: true},
+			{Paths: []kv.Path{{"short"}}, Unique: true},
+		},
+	})
+	l := link{ID: 3, Original: "http://example.com", Short: 1, Draft: true, hits: 2}
+	c.Check(links.ToM(l), DeepEquals, M{
+		"Original": "http://example.com",
+		"short":    int64(1),
+		"tags":     []string(nil),
+		"Owner":    (*owner)(nil),
+	})
+
+	// as decoded from JSON
+	var got link
+	err := links.FromM(M{
+		"Original": "http://example.com",
+		"short":    float64(7),
+		"tags":     []interface{}{"a", "b"},
+		"Owner":    map[string]interface{}{"Name": "ann"},
+	}, &got)
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, link{Original: "http://example.com", Short: 7, Tags: []string{"a", "b"}, Owner: &owner{"ann"}})
+	c.Check(links.FromM(M{"short": "x"}, &got), ErrorMatches, "repo: link.Short: .*")
+	c.Check(links.FromM(M{}, got), ErrorMatches, `repo: links needs a \*link, got repo.link`)
+}
+
+func (s *TS) TestBadModels(c *C) {
+	c.Check(func() { NewModel("x", 1) }, Panics, "repo: model of x needs a struct, got int")
+	c.Check(func() {
+		NewModel("x", struct {
+			ID int `kv:",id"`
+		}{})
+	}, PanicMatches, ".*can't be the id.*")
+	c.Check(func() {
+		NewModel("x", struct {
+			A int `kv:"a,sorted"`
+		}{})
+	}, PanicMatches, `repo: unknown option "sorted".*`)
+	c.Check(func() {
+		NewModel("x", struct {
+			A int `kv:"B"`
+			B int
+		}{})
+	}, PanicMatches, ".*two fields as B")
+}
+
+func (s *TS) TestRepo(c *C) {
+	r := links.Repo(engine(c))
+	a := &link{Original: "http://a.example.com", Short: 1, Tags: []string{"x"}}
+	id, err := r.Save(a)
+	c.Assert(err, IsNil)
+	c.Check(a.ID, Equals, id)
+	b := &link{Original: "http://b.example.com", Short: 2, Owner: &owner{"bob"}}
+	_, err = r.Save(b)
+	c.Assert(err, IsNil)
+
+	var got link
+	c.Assert(r.Get(id, &got), IsNil)
+	c.Check(got, DeepEquals, *a)
+	c.Assert(r.FindOne(&got, "short", 2), IsNil)
+	c.Check(got, DeepEquals, *b)
+	c.Check(r.FindOne(&got, "short", 3), Equals, kv.ErrNotFound)
+	c.Check(r.FindOne(&got, "Short", 2), ErrorMatches, "repo: link has no field Short")
+
+	// saving again updates
+	a.Original = "http://c.example.com"
+	again, err := r.Save(a)
+	c.Assert(err, IsNil)
+	c.Check(again, Equals, id)
+	var all []*link
+	c.Assert(r.All(r.Query().Has(kv.Path{"short"}), &all), IsNil)
+	c.Assert(all, HasLen, 2)
+	c.Check(all[0], DeepEquals, a)
+	c.Check(all[1], DeepEquals, b)
+	var found []link
+	c.Assert(r.Find(&found, "short", 1), IsNil)
+	c.Check(found, DeepEquals, []link{*a})
+	c.Assert(r.All(r.Query().Match(kv.Path{"Original"}, "b example"), &found), IsNil)
+	c.Check(found, DeepEquals, []link{*b})
+	c.Check(r.Find(&got, "short", 1), ErrorMatches, "repo: links needs a pointer to a slice, got .*")
+	c.Check(r.Find(&[]owner{}, "short", 1), ErrorMatches, "repo: links needs a slice of link, got .*")
+
+	// unique indexes declared in the tags hold
+	_, err = r.Save(&link{Short: 2})
+	c.Check(err, FitsTypeOf, &kv.ErrDuplicate{})
+
+	c.Assert(r.Delete(id), IsNil)
+	c.Check(r.Get(id, &got), NotNil)
+}
+
+func (s *TS) TestTransaction(c *C) {
+	tde := engine(c)
+	l := &link{Short: 1}
+	err := tde.Transact(func(tx *kv.Tx) error {
+		r := links.In(tx)
+		if _, err := r.Save(l); err != nil {
+			return err
+		}
+		var got link
+		if err := r.FindOne(&got, "short", 1); err != nil {
+			return err
+		}
+		c.Check(got.ID, Equals, l.ID)
+		return r.Delete(got.ID)
+	})
+	c.Assert(err, IsNil)
+	var all []link
+	c.Assert(links.Repo(tde).Find(&all, "short", 1), IsNil)
+	c.Check(all, HasLen, 0)
+}
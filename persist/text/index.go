@@ -0,0 +1,212 @@
+package text
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// BM25 parameters: K1 is how fast repeating a term stops counting, and B how
+// much long documents are penalized.
+var (
+	K1 = 1.2
+	B  = 0.75
+)
+
+// Hit is a document found by Search, with its BM25 score.
+type Hit struct {
+	ID    uint64
+	Score float64
+}
+
+// Index is an inverted index of documents by their terms. It is safe for
+// concurrent use.
+type Index struct {
+	mu sync.RWMutex
+	// postings holds the positions of each term in each document.
+	postings map[string]map[uint64][]int
+	docs     map[uint64]doc
+	total    int // terms in all documents, for the average length
+}
+
+type doc struct {
+	terms  []string // distinct, for Remove
+	length int
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{postings: make(map[string]map[uint64][]int), docs: make(map[uint64]doc)}
+}
+
+// Add indexes the texts of document id, replacing what it held before.
+// Phrases don't match across two texts.
+func (x *Index) Add(id uint64, texts ...string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+	d := doc{}
+	pos := 0
+	for _, s := range texts {
+		for _, t := range Terms(s) {
+			p := x.postings[t]
+			if p == nil {
+				p = make(map[uint64][]int)
+				x.postings[t] = p
+			}
+			if p[id] == nil {
+				d.terms = append(d.terms, t)
+			}
+			p[id] = append(p[id], pos)
+			pos++
+			d.length++
+		}
+		pos++ // a gap, so the last word and the next text's first aren't a phrase
+	}
+	if d.length == 0 {
+		return
+	}
+	x.docs[id] = d
+	x.total += d.length
+}
+
+// Remove drops document id from the index.
+func (x *Index) Remove(id uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+}
+
+func (x *Index) remove(id uint64) {
+	d, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for _, t := range d.terms {
+		delete(x.postings[t], id)
+		if len(x.postings[t]) == 0 {
+			delete(x.postings, t)
+		}
+	}
+	delete(x.docs, id)
+	x.total -= d.length
+}
+
+// Reset empties the index.
+func (x *Index) Reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.postings = make(map[string]map[uint64][]int)
+	x.docs = make(map[uint64]doc)
+	x.total = 0
+}
+
+// Len returns the number of documents in the index.
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// Terms returns the number of distinct terms in the index.
+func (x *Index) Terms() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.postings)
+}
+
+// Search returns the documents matching every word and phrase of query, best
+// first, and those with the same score by ID. A query without words matches
+// nothing.
+func (x *Index) Search(query string) []Hit {
+	terms, phrases := parse(query)
+	for _, p := range phrases {
+		terms = append(terms, p...)
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	// every term must be there: start from the rarest
+	distinct := make(map[string]bool)
+	var rarest map[uint64][]int
+	for _, t := range terms {
+		p := x.postings[t]
+		if len(p) == 0 {
+			return nil
+		}
+		if rarest == nil || len(p) < len(rarest) {
+			rarest = p
+		}
+		distinct[t] = true
+	}
+	var hits []Hit
+	avg := float64(x.total) / float64(len(x.docs))
+	n := float64(len(x.docs))
+candidates:
+	for id := range rarest {
+		for t := range distinct {
+			if _, ok := x.postings[t][id]; !ok {
+				continue candidates
+			}
+		}
+		for _, p := range phrases {
+			if !x.phraseIn(id, p) {
+				continue candidates
+			}
+		}
+		score := 0.0
+		norm := K1 * (1 - B + B*float64(x.docs[id].length)/avg)
+		for t := range distinct {
+			df := float64(len(x.postings[t]))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			tf := float64(len(x.postings[t][id]))
+			score += idf * tf * (K1 + 1) / (tf + norm)
+		}
+		hits = append(hits, Hit{ID: id, Score: score})
+	}
+	Sort(hits)
+	return hits
+}
+
+// phraseIn reports whether document id holds the terms of p one after the
+// other.
+func (x *Index) phraseIn(id uint64, p []string) bool {
+	for _, start := range x.postings[p[0]][id] {
+		found := true
+		for i, t := range p[1:] {
+			if !hasPos(x.postings[t][id], start+i+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPos reports whether the sorted positions hold pos.
+func hasPos(positions []int, pos int) bool {
+	i := sort.SearchInts(positions, pos)
+	return i < len(positions) && positions[i] == pos
+}
+
+// Sort orders hits as Search does: best first, then by ID.
+func Sort(hits []Hit) {
+	sort.Sort(byScore(hits))
+}
+
+type byScore []Hit
+
+func (b byScore) Len() int { return len(b) }
+func (b byScore) Less(i, j int) bool {
+	if b[i].Score != b[j].Score {
+		return b[i].Score > b[j].Score
+	}
+	return b[i].ID < b[j].ID
+}
+func (b byScore) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,68 @@
+// Package text is full-text search for the kv engine: it splits text into
+// stemmed English terms and keeps them in an inverted index, which finds the
+// documents holding words and phrases and ranks them by BM25.
+//
+//	idx := text.NewIndex()
+//	idx.Add(1, "Connecting the dots")
+//	idx.Add(2, "Dots connected, then the lines")
+//	hits := idx.Search(`connection "the dots"`) // 1
+//
+// Words of a query match any word with the same stem, and a phrase in double
+// quotes matches its words one after the other. Every word and phrase of a
+// query must match.
+package text
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tokenize splits s into its words in lower case, at anything that isn't a
+// letter or a digit. Apostrophes inside words are dropped, so "don't" is
+// "dont".
+func Tokenize(s string) []string {
+	var words []string
+	var w []rune
+	rs := []rune(s)
+	for i, r := range rs {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			w = append(w, unicode.ToLower(r))
+			continue
+		case (r == '\'' || r == '’') && len(w) > 0 && i+1 < len(rs) && unicode.IsLetter(rs[i+1]):
+			continue
+		}
+		if len(w) > 0 {
+			words = append(words, string(w))
+			w = w[:0]
+		}
+	}
+	if len(w) > 0 {
+		words = append(words, string(w))
+	}
+	return words
+}
+
+// Terms returns the stemmed words of s, as the index holds them.
+func Terms(s string) []string {
+	words := Tokenize(s)
+	for i, w := range words {
+		words[i] = Stem(w)
+	}
+	return words
+}
+
+// parse splits a query into its terms outside double quotes and the phrases
+// within them. A phrase of one term counts as a term, and an unclosed quote
+// runs to the end.
+func parse(query string) (terms []string, phrases [][]string) {
+	for i, part := range strings.Split(query, `"`) {
+		t := Terms(part)
+		if i%2 == 0 || len(t) == 1 {
+			terms = append(terms, t...)
+		} else if len(t) > 1 {
+			phrases = append(phrases, t)
+		}
+	}
+	return terms, phrases
+}
@@ -0,0 +1,113 @@
+package text
+
+import (
+	. "launchpad.net/gocheck"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TS struct{}
+
+var _ = Suite(&TS{})
+
+func (s *TS) TestTokenize(c *C) {
+	c.Check(Tokenize("Don't panic: http://Example.com/a-b_c?x=42"), DeepEquals,
+		[]string{"dont", "panic", "http", "example", "com", "a", "b", "c", "x", "42"})
+	c.Check(Tokenize("Crème brûlée 'quoted'"), DeepEquals, []string{"crème", "brûlée", "quoted"})
+	c.Check(Tokenize(" ,. "), HasLen, 0)
+}
+
+func (s *TS) TestStem(c *C) {
+	for word, stem := range map[string]string{
+		"caresses":        "caress",
+		"ponies":          "poni",
+		"cats":            "cat",
+		"feed":            "feed",
+		"agreed":          "agre",
+		"plastered":       "plaster",
+		"motoring":        "motor",
+		"sing":            "sing",
+		"hopping":         "hop",
+		"falling":         "fall",
+		"filing":          "file",
+		"happy":           "happi",
+		"relational":      "relat",
+		"conditional":     "condit",
+		"generalizations": "gener",
+		"oscillators":     "oscil",
+		"hopefulness":     "hope",
+		"electrical":      "electr",
+		"adjustment":      "adjust",
+		"controlling":     "control",
+		"connected":       "connect",
+		"connection":      "connect",
+		"at":              "at",
+		"42nd":            "42nd",
+		"brûlée":          "brûlée",
+	} {
+		c.Check(Stem(word), Equals, stem, Commentf("word %q", word))
+	}
+}
+
+func (s *TS) TestParse(c *C) {
+	terms, phrases := parse(`running "the dogs" "cats" "unclosed quote`)
+	c.Check(terms, DeepEquals, []string{"run", "cat"})
+	c.Check(phrases, DeepEquals, [][]string{{"the", "dog"}, {"unclos", "quot"}})
+}
+
+func (s *TS) TestSearch(c *C) {
+	x := NewIndex()
+	x.Add(1, "Connecting the dots")
+	x.Add(2, "Dots connected, then the lines")
+	x.Add(3, "Nothing to see", "here")
+	x.Add(4, "")
+	c.Check(x.Len(), Equals, 3)
+
+	c.Check(ids(x.Search("connection")), DeepEquals, []uint64{1, 2})
+	c.Check(ids(x.Search(`connection "the dots"`)), DeepEquals, []uint64{1})
+	c.Check(ids(x.Search(`"dots the"`)), HasLen, 0)
+	c.Check(ids(x.Search("connected lines")), DeepEquals, []uint64{2})
+	c.Check(ids(x.Search("connected unknown")), HasLen, 0)
+	c.Check(ids(x.Search(`""`)), HasLen, 0)
+	// phrases don't run from one text to the next
+	c.Check(ids(x.Search(`"see here"`)), HasLen, 0)
+	c.Check(ids(x.Search("see here")), DeepEquals, []uint64{3})
+
+	// replacing and removing
+	x.Add(1, "something else")
+	c.Check(ids(x.Search("dots")), DeepEquals, []uint64{2})
+	x.Remove(2)
+	x.Remove(5)
+	c.Check(ids(x.Search("dots")), HasLen, 0)
+	c.Check(x.Len(), Equals, 2)
+	x.Reset()
+	c.Check(x.Len(), Equals, 0)
+	c.Check(x.Terms(), Equals, 0)
+}
+
+func (s *TS) TestRanking(c *C) {
+	x := NewIndex()
+	x.Add(1, "go go go, the go language")
+	x.Add(2, "go to the shop and then to the park and then home again")
+	x.Add(3, "go")
+	x.Add(4, "the park")
+	hits := x.Search("go")
+	c.Assert(hits, HasLen, 3)
+	// more occurrences, then shorter documents, come first
+	c.Check(ids(hits), DeepEquals, []uint64{1, 3, 2})
+	c.Check(hits[0].Score > hits[1].Score, Equals, true)
+
+	// the rarer term weighs more
+	hits = x.Search("the park")
+	c.Assert(hits, HasLen, 2)
+	c.Check(ids(hits), DeepEquals, []uint64{4, 2})
+}
+
+func ids(hits []Hit) []uint64 {
+	var ids []uint64
+	for _, h := range hits {
+		ids = append(ids, h.ID)
+	}
+	return ids
+}
@@ -0,0 +1,142 @@
+// Package reqlog tags every request with an ID and gives its handlers a logger
+// that adds the ID to each line, so the lines of one request can be found
+// together.
+//
+// The server's outermost martini uses Logger, which also writes the access
+// log. Services mounted as their own martini use Map to get the same logger
+// injected:
+//
+//	func retrieve(w http.ResponseWriter, r *http.Request, l *log.Logger) {
+//		l.Infow("Served redirect", "short", short)
+//	}
+package reqlog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/codegangsta/martini"
+	"github.com/ryansb/legowebservices/log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Header carries the request ID. An ID sent by the client or a proxy is kept,
+// otherwise a new one is assigned, and either way it is echoed in the
+// response.
+const Header = "X-Request-ID"
+
+// Key is the log field holding the request ID.
+const Key = "request_id"
+
+// maxIDLen bounds the IDs accepted from clients, so they can't flood the log.
+const maxIDLen = 128
+
+var (
+	mu      sync.Mutex
+	loggers = make(map[*http.Request]*log.Logger)
+)
+
+// Logger returns the martini handler that assigns request IDs, maps the
+// request's *log.Logger for the rest of the chain and logs each request once
+// it has been served. It replaces martini.Logger and should come first.
+func Logger() martini.Handler {
+	return func(c martini.Context, w martini.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		// nested martinis see the request, not this injector; they find the
+		// ID in the header and the logger with For
+		r.Header.Set(Header, id)
+		w.Header().Set(Header, id)
+		l := log.With(Key, id)
+		mu.Lock()
+		loggers[r] = l
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(loggers, r)
+			mu.Unlock()
+		}()
+
+		c.Map(l)
+		c.Next()
+
+		status := w.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		l.Infow("Served request",
+			"method", r.Method,
+			"path", r.URL.RequestURI(),
+			"status", status,
+			"bytes", w.Size(),
+			"duration", time.Since(start).String(),
+			"remote", remoteAddr(r))
+	}
+}
+
+// Map maps the request's *log.Logger in a martini mounted under one using
+// Logger.
+func Map(c martini.Context, r *http.Request) {
+	c.Map(For(r))
+}
+
+// For returns the logger of a request being served behind Logger. For other
+// requests it returns a logger with the ID from the request header, if any.
+func For(r *http.Request) *log.Logger {
+	mu.Lock()
+	l, ok := loggers[r]
+	mu.Unlock()
+	if ok {
+		return l
+	}
+	if id := r.Header.Get(Header); validID(id) {
+		return log.With(Key, id)
+	}
+	return log.With()
+}
+
+// requestID returns the ID sent with r if it is usable, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(Header); validID(id) {
+		return id
+	}
+	return newID()
+}
+
+// validID reports whether id is short and only holds printable ASCII without
+// spaces, so it can't break the log line or response header.
+func validID(id string) bool {
+	if id == "" || len(id) > maxIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Errorf("Failure generating request ID err=%v", err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func remoteAddr(r *http.Request) string {
+	if addr := r.Header.Get("X-Real-IP"); addr != "" {
+		return addr
+	}
+	if addr := r.Header.Get("X-Forwarded-For"); addr != "" {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,59 @@
+package reqlog
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	a, b := requestID(r), requestID(r)
+	if len(a) != 24 || a == b {
+		t.Errorf("expected distinct 24 character IDs, got %q and %q", a, b)
+	}
+
+	r.Header.Set(Header, "upstream-42")
+	if id := requestID(r); id != "upstream-42" {
+		t.Errorf("expected the client's ID to be kept, got %q", id)
+	}
+
+	for _, bad := range []string{"two words", "tab\there", "caf\xc3\xa9", strings.Repeat("x", maxIDLen+1)} {
+		r.Header.Set(Header, bad)
+		if id := requestID(r); id == bad || !validID(id) {
+			t.Errorf("expected %q to be replaced, got %q", bad, id)
+		}
+	}
+}
+
+func TestFor(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	l := For(r)
+	if l == nil {
+		t.Fatal("expected a logger for an unknown request")
+	}
+
+	mu.Lock()
+	loggers[r] = l
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		delete(loggers, r)
+		mu.Unlock()
+	}()
+	if For(r) != l {
+		t.Error("expected the logger registered for the request")
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	if addr := remoteAddr(r); addr != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1, got %q", addr)
+	}
+	r.Header.Set("X-Real-IP", "192.0.2.7")
+	if addr := remoteAddr(r); addr != "192.0.2.7" {
+		t.Errorf("expected 192.0.2.7, got %q", addr)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// restore loads the dump at path, or standard input if path is empty or "-",
+// into a new database in dir. It refuses to touch an existing database.
+//
+// Documents that don't get their old IDs back are listed in the file at
+// idsPath, see kv.Renumbered. Without idsPath the first such document makes
+// restore fail, and what it restored is removed.
+func restore(dir, path, idsPath string) (err error) {
+	names, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(names) > 0 {
+		return errors.New("restore: " + dir + " is not empty")
+	}
+	in := io.Reader(os.Stdin)
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var ids io.Writer
+	if idsPath != "" {
+		f, err := os.Create(idsPath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		ids = f
+	}
+	tde := kv.NewTiedotEngine(dir, nil, kv.KeepIfExist)
+	err = tde.Restore(in, ids)
+	if cerr := tde.Close(); err == nil {
+		err = cerr
+	}
+	if _, ok := err.(*kv.ErrRenumbered); ok {
+		emptyDir(dir)
+		return errors.New(err.Error() + "; pass a file to list the new IDs in to restore anyway")
+	}
+	return err
+}
+
+// emptyDir removes what is in dir.
+func emptyDir(dir string) {
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range names {
+		name := filepath.Join(dir, fi.Name())
+		if err := os.RemoveAll(name); err != nil {
+			log.Errorf("Failure removing partial restore path=%s err=%v", name, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package admin serves a small HTML admin UI under /admin. It only knows how
+// to browse raw collections; services add their own pages with Router,
+// AddPage and Template.
+package admin
+
+import (
+	"bytes"
+	"github.com/codegangsta/martini"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"github.com/ryansb/legowebservices/reqlog"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Prefix is the path the admin UI is mounted under. Templates use it to build
+// links.
+const Prefix = "/admin"
+
+// Link is an entry in the admin navigation bar.
+type Link struct {
+	Path, Title string
+}
+
+// Admin is the admin UI. It is mapped into every admin request, so handlers
+// added through Router can ask for it.
+type Admin struct {
+	*martini.Martini
+	router martini.Router
+
+	mu          sync.Mutex
+	nav         []Link
+	collections map[string][]string
+	stats       map[string]cachedStats // see StatsMaxAge
+}
+
+var (
+	tmplMu    sync.Mutex
+	templates = template.New("admin").Funcs(template.FuncMap{
+		"prefix": func() string { return Prefix },
+		"path":   func(p kv.Path) string { return strings.Join(p, ".") },
+		"size":   size,
+	})
+)
+
+// Template adds a named page template to the admin UI. Pages are rendered
+// with a *Page, and should start with {{template "header" .}} and end with
+// {{template "footer" .}}. Template panics if text does not parse, so it is
+// meant to be called from init.
+func Template(name, text string) {
+	tmplMu.Lock()
+	defer tmplMu.Unlock()
+	template.Must(templates.New(name).Parse(text))
+}
+
+// Page is the value every admin template is executed with.
+type Page struct {
+	Title string
+	Nav   []Link
+	Flash string
+	Data  interface{}
+}
+
+// New returns the admin UI for tde, protected by the credentials in conf.
+func New(tde *kv.TiedotEngine, conf *Config) *Admin {
+	a := &Admin{
+		Martini:     martini.New(),
+		router:      martini.NewRouter(),
+		collections: make(map[string][]string),
+	}
+	a.Use(reqlog.Map)
+	a.Use(BasicAuth(conf.User, conf.Password))
+	a.Use(SameOrigin)
+	a.Map(tde)
+	a.Map(a)
+
+	a.router.Get("/", home)
+	a.AddPage("/collections", "Collections")
+	a.router.Get("/collections", listCollections)
+	a.router.Get("/collections/:name", browseCollection)
+	a.router.Post("/collections/:name/compact", compactCollection)
+	a.router.Get("/collections/:name/:id", showDocument)
+	a.router.Post("/collections/:name/:id/delete", deleteDocument)
+	a.AddPage("/levels", "Log levels")
+	a.router.Get("/levels", showLevels)
+	a.router.Post("/levels", setLevels)
+	a.router.Get("/snapshot", snapshot)
+	a.router.Get("/events", events)
+	a.Action(a.router.Handle)
+	return a
+}
+
+// Router returns the router behind the admin UI so services can add their
+// own pages. Paths are relative to Prefix.
+func (a *Admin) Router() martini.Router {
+	return a.router
+}
+
+// AddPage adds a link to path, relative to Prefix, in the navigation bar.
+func (a *Admin) AddPage(path, title string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nav = append(a.nav, Link{Path: Prefix + path, Title: title})
+}
+
+// AddCollections makes the given collections of service browsable.
+func (a *Admin) AddCollections(service string, collections ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.collections[service] = append(a.collections[service], collections...)
+}
+
+// Services returns the names of the services that added collections, sorted.
+func (a *Admin) Services() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names := make([]string, 0, len(a.collections))
+	for s := range a.collections {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Collections returns the collections added by service.
+func (a *Admin) Collections(service string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.collections[service]...)
+}
+
+func (a *Admin) hasCollection(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, cs := range a.collections {
+		for _, c := range cs {
+			if c == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Render executes the template called name with a Page holding title and
+// data, and writes it with the given status.
+func (a *Admin) Render(w http.ResponseWriter, status int, name, title string, data interface{}) {
+	a.mu.Lock()
+	p := &Page{Title: title, Nav: append([]Link(nil), a.nav...), Data: data}
+	a.mu.Unlock()
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, p); err != nil {
+		log.Errorf("Failure rendering admin template=%s err=%v", name, err)
+		http.Error(w, "Failure rendering page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// Error renders an error page with the given status.
+func (a *Admin) Error(w http.ResponseWriter, status int, msg string) {
+	a.Render(w, status, "error", http.StatusText(status), msg)
+}
+
+// Redirect sends the browser to path, relative to Prefix, after a form post.
+func Redirect(w http.ResponseWriter, r *http.Request, path string) {
+	http.Redirect(w, r, Prefix+path, http.StatusSeeOther)
+}
+
+func home(w http.ResponseWriter, r *http.Request, a *Admin) {
+	a.Render(w, http.StatusOK, "home", "Admin", nil)
+}
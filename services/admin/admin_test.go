@@ -0,0 +1,324 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"github.com/ryansb/legowebservices/util/m"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	h := BasicAuth("admin", "s3cret").(func(http.ResponseWriter, *http.Request))
+	for _, c := range []struct {
+		user, password string
+		set            bool
+		want           int
+	}{
+		{"admin", "s3cret", true, http.StatusOK},
+		{"admin", "wrong", true, http.StatusUnauthorized},
+		{"root", "s3cret", true, http.StatusUnauthorized},
+		{"", "", false, http.StatusUnauthorized},
+	} {
+		r, _ := http.NewRequest("GET", "/admin/", nil)
+		if c.set {
+			r.SetBasicAuth(c.user, c.password)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != c.want {
+			t.Errorf("user=%q password=%q: status=%d, want %d", c.user, c.password, w.Code, c.want)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	for _, c := range []struct {
+		method, header, value string
+		want                  int
+	}{
+		{"GET", "Origin", "http://evil.example.com", http.StatusOK},
+		{"POST", "", "", http.StatusOK},
+		{"POST", "Origin", "http://lws.example.com", http.StatusOK},
+		{"POST", "Referer", "http://lws.example.com/admin/short", http.StatusOK},
+		{"POST", "Origin", "http://evil.example.com", http.StatusForbidden},
+		{"POST", "Referer", "http://evil.example.com/form", http.StatusForbidden},
+	} {
+		r, _ := http.NewRequest(c.method, "http://lws.example.com/admin/short/1/delete", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		w := httptest.NewRecorder()
+		SameOrigin(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s with %s=%q: status=%d, want %d", c.method, c.header, c.value, w.Code, c.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	a := &Admin{collections: make(map[string][]string)}
+	a.AddPage("/short", "Short links")
+	a.AddCollections("short", "short.url", "short.counter")
+	if !a.hasCollection("short.counter") || a.hasCollection("secret") {
+		t.Error("hasCollection should only know registered collections")
+	}
+
+	w := httptest.NewRecorder()
+	a.Render(w, http.StatusOK, "collections", "Collections", []collectionInfo{
+		{Service: "short", Name: "short.url", Stats: &kv.CollectionStats{
+			Name:    "short.url",
+			Docs:    3,
+			Bytes:   1536,
+			Indexes: []kv.IndexStats{{Path: kv.Path{"Short"}, Entries: 4, Dangling: 1}},
+		}},
+	})
+	body := w.Body.String()
+	for _, want := range []string{
+		`<a href="/admin/short">Short links</a>`,
+		`<a href="/admin/collections/short.url">short.url</a>`,
+		"<td>3</td>",
+		"<td>1.5 KiB</td>",
+		"Short: 4 entries, <span class=\"error\">1 dangling</span>",
+		`action="/admin/collections/short.url/compact"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("rendered page is missing %q:\n%s", want, body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	a.Error(w, http.StatusNotFound, "<script>")
+	if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "<script>") {
+		t.Errorf("error page should be escaped, got status=%d body=%s", w.Code, w.Body.String())
+	}
+}
+
+func TestShowLogs(t *testing.T) {
+	a := &Admin{collections: make(map[string][]string)}
+	ring := log.NewRing(10)
+	for _, e := range []log.Entry{
+		{Severity: "INFO", Data: []byte("I one\n")},
+		{Severity: "ERROR", Data: []byte("E two <b>\n")},
+		{Severity: "WARNING", Data: []byte("W three\n")},
+	} {
+		ring.Emit(&e)
+	}
+
+	r, _ := http.NewRequest("GET", "/logs?severity=WARNING", nil)
+	w := httptest.NewRecorder()
+	showLogs(w, r, a, ring)
+	body := w.Body.String()
+	if !strings.Contains(body, "W three\nE two &lt;b&gt;\n") || strings.Contains(body, "I one") {
+		t.Errorf("expected WARNING and up, newest first:\n%s", body)
+	}
+
+	r, _ = http.NewRequest("GET", "/logs?q=one", nil)
+	w = httptest.NewRecorder()
+	showLogs(w, r, a, ring)
+	body = w.Body.String()
+	if !strings.Contains(body, "I one") || strings.Contains(body, "three") {
+		t.Errorf("expected only lines matching q:\n%s", body)
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	a := &Admin{collections: make(map[string][]string)}
+	defer log.SetLevels(log.Levels{}, 0)
+
+	r, _ := http.NewRequest("POST", "/levels?format=json", strings.NewReader("v=2&vmodule=shorter=4&revert_after=1h"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	setLevels(w, r, a, log.With())
+	var got log.Levels
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+	}
+	if got.V != 2 || got.VModule != "shorter=4" || !got.Temporary {
+		t.Errorf("unexpected levels %+v", got)
+	}
+
+	r, _ = http.NewRequest("POST", "/levels", strings.NewReader("vmodule=shorter"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	setLevels(w, r, a, log.With())
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "syntax error") {
+		t.Errorf("expected the form with an error, got status=%d body=%s", w.Code, w.Body.String())
+	}
+	if l := log.CurrentLevels(); l.V != 2 || l.VModule != "shorter=4" {
+		t.Errorf("a bad form changed the levels to %+v", l)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adminsnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tde := kv.NewTiedotEngine(dir, []string{"short.url"}, kv.KeepIfExist)
+	if _, err := tde.Insert("short.url", m.M{"Short": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "/snapshot", nil)
+	w := httptest.NewRecorder()
+	snapshot(w, r, tde, log.With())
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status=%d headers=%v", w.Code, w.Header())
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="lws-`) {
+		t.Errorf("unexpected Content-Disposition %q", cd)
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length=%s for %d bytes", w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	lines := strings.Split(w.Body.String(), "\n")
+	if len(lines) != 4 || lines[1] != `{"collection":"short.url","indexes":[]}` || !strings.HasSuffix(lines[2], `"doc":{"Short":1}}`) {
+		t.Errorf("unexpected snapshot %q", w.Body.String())
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admincompact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tde := kv.NewTiedotEngine(dir, []string{"short.url", "secret"}, kv.KeepIfExist)
+	id, err := tde.Insert("short.url", m.M{"Short": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tde.Insert("short.url", m.M{"Short": 2})
+	tde.Delete("short.url", id)
+	a := &Admin{collections: make(map[string][]string)}
+	a.AddCollections("short", "short.url")
+
+	r, _ := http.NewRequest("POST", "/collections/secret/compact", nil)
+	w := httptest.NewRecorder()
+	compactCollection(w, r, tde, a, martini.Params{"name": "secret"}, log.With())
+	if w.Code != http.StatusNotFound {
+		t.Errorf("compacting an unregistered collection: status=%d", w.Code)
+	}
+
+	r, _ = http.NewRequest("POST", "/collections/short.url/compact?format=json", nil)
+	w = httptest.NewRecorder()
+	compactCollection(w, r, tde, a, martini.Params{"name": "short.url"}, log.With())
+	var got map[string]kv.CollectionStats
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+	}
+	if got["before"].Docs != 1 || got["after"].Docs != 1 || got["after"].Name != "short.url" {
+		t.Errorf("unexpected stats %+v", got)
+	}
+
+	r, _ = http.NewRequest("POST", "/collections/short.url/compact", nil)
+	w = httptest.NewRecorder()
+	compactCollection(w, r, tde, a, martini.Params{"name": "short.url"}, log.With())
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/collections" {
+		t.Errorf("status=%d location=%s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// Test that the collections page reuses the stats it gathered until asked to
+// refresh them.
+func TestListCollectionsCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admincollections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tde := kv.NewTiedotEngine(dir, []string{"short.url"}, kv.KeepIfExist)
+	a := &Admin{collections: make(map[string][]string)}
+	a.AddCollections("short", "short.url")
+	docs := func(query string) int {
+		r, _ := http.NewRequest("GET", "/collections?format=json"+query, nil)
+		w := httptest.NewRecorder()
+		listCollections(w, r, tde, a)
+		var got []kv.CollectionStats
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != 1 {
+			t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+		}
+		return got[0].Docs
+	}
+
+	if n := docs(""); n != 0 {
+		t.Errorf("docs=%d, want 0", n)
+	}
+	tde.Insert("short.url", m.M{"Short": 1})
+	if n := docs(""); n != 0 {
+		t.Errorf("docs=%d before a refresh, want the 0 gathered first", n)
+	}
+	if n := docs("&refresh=1"); n != 1 {
+		t.Errorf("docs=%d after a refresh, want 1", n)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adminevents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tde := kv.NewTiedotEngine(dir, []string{"short.url", "secret"}, kv.KeepIfExist)
+	a := &Admin{collections: make(map[string][]string)}
+	a.AddCollections("short", "short.url")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events(w, r, tde, a, log.With())
+	}))
+	defer srv.Close()
+
+	if resp, err := http.Get(srv.URL + "?collection=secret"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("watching an unknown collection: resp=%v err=%v", resp, err)
+	}
+	id, _ := tde.Insert("short.url", m.M{"Short": 1})
+	r, _ := http.NewRequest("GET", srv.URL, nil)
+	r.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type=%q", ct)
+	}
+	tde.Insert("secret", m.M{"Password": "x"})
+	tde.Delete("short.url", id)
+
+	lines := bufio.NewReader(resp.Body)
+	var got []string
+	for len(got) < 3 {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading events got=%q err=%v", got, err)
+		}
+		if line != "\n" {
+			got = append(got, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	want := []string{"id: 3", "event: delete", fmt.Sprintf(`data: {"seq":3,"op":"delete","collection":"short.url","id":%d}`, id)}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events got=%q want=%q", got, want)
+	}
+
+	// from an earlier run
+	resp, err = http.Get(srv.URL + "?since=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if line != "event: reset\n" {
+		t.Errorf("expected a reset, got %q err=%v", line, err)
+	}
+}
@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/codegangsta/martini"
+	"github.com/ryansb/legowebservices/reqlog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BasicAuth returns a martini handler that rejects requests without the given
+// HTTP basic auth credentials.
+func BasicAuth(user, password string) martini.Handler {
+	want := []byte("Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			reqlog.For(r).V(1).Infof("Rejected admin request path=%s remote=%s", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="LWS admin"`)
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+		}
+	}
+}
+
+// SameOrigin rejects state changing requests sent by another site. Browsers
+// replay basic auth credentials on cross site form posts, so the admin forms
+// need this in place of a CSRF token.
+func SameOrigin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return
+	}
+	if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+		reqlog.For(r).Warningf("Rejected cross origin admin request path=%s origin=%s", r.URL.Path, origin)
+		http.Error(w, "Cross origin request refused", http.StatusForbidden)
+	}
+}
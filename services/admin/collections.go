@@ -0,0 +1,242 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PageSize is the number of documents shown per page of the collection
+// browser.
+var PageSize = 50
+
+// StatsMaxAge is how long the collections page keeps showing the stats of a
+// collection, as gathering them scans its indexes. ?refresh=1 gathers them
+// again.
+var StatsMaxAge = time.Minute
+
+type collectionInfo struct {
+	Service, Name string
+	Stats         *kv.CollectionStats
+	At            time.Time // when Stats were gathered
+	Err           error
+}
+
+type cachedStats struct {
+	stats *kv.CollectionStats
+	at    time.Time
+}
+
+type document struct {
+	ID   uint64
+	JSON string
+}
+
+type browsePage struct {
+	Collection string
+	Docs       []document
+	Total      int
+	Page       int
+	Prev, Next int // zero when there is no such page
+}
+
+// listCollections shows the collections of the services with their stats,
+// as JSON if asked.
+func listCollections(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *Admin) {
+	refresh := r.URL.Query().Get("refresh") != ""
+	var infos []collectionInfo
+	var stats []*kv.CollectionStats
+	for _, s := range a.Services() {
+		for _, c := range a.Collections(s) {
+			st, at, err := a.collectionStats(tde, c, refresh)
+			infos = append(infos, collectionInfo{Service: s, Name: c, Stats: st, At: at, Err: err})
+			if err == nil {
+				stats = append(stats, st)
+			}
+		}
+	}
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, stats)
+		return
+	}
+	a.Render(w, http.StatusOK, "collections", "Collections", infos)
+}
+
+// collectionStats returns the stats of collection and when they were
+// gathered, at most StatsMaxAge ago unless refresh is set.
+func (a *Admin) collectionStats(tde *kv.TiedotEngine, collection string, refresh bool) (*kv.CollectionStats, time.Time, error) {
+	a.mu.Lock()
+	c, ok := a.stats[collection]
+	a.mu.Unlock()
+	if ok && !refresh && time.Since(c.at) < StatsMaxAge {
+		return c.stats, c.at, nil
+	}
+	s, err := tde.CollectionStats(collection)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return s, a.keepStats(s), nil
+}
+
+// keepStats caches s for collectionStats, and returns the time it is from.
+func (a *Admin) keepStats(s *kv.CollectionStats) time.Time {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stats == nil {
+		a.stats = make(map[string]cachedStats)
+	}
+	a.stats[s.Name] = cachedStats{stats: s, at: now}
+	return now
+}
+
+// compactCollection compacts a collection, see kv.TiedotEngine.Compact, and
+// answers with its stats before and after if asked for JSON.
+func compactCollection(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *Admin, params martini.Params, l *log.Logger) {
+	name := params["name"]
+	if !a.hasCollection(name) {
+		a.Error(w, http.StatusNotFound, "No collection named "+name)
+		return
+	}
+	before, after, err := tde.Compact(name)
+	if err != nil {
+		a.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.keepStats(after)
+	l.Infof("Admin compacted collection=%s freed=%d", name, before.Bytes-after.Bytes)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]*kv.CollectionStats{"before": before, "after": after})
+		return
+	}
+	Redirect(w, r, "/collections")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+func browseCollection(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *Admin, params martini.Params) {
+	name := params["name"]
+	if !a.hasCollection(name) {
+		a.Error(w, http.StatusNotFound, "No collection named "+name)
+		return
+	}
+	all, err := tde.All(name)
+	if err != nil {
+		a.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ids := make([]uint64, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64s(ids))
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	bp := browsePage{Collection: name, Total: len(ids), Page: page}
+	start := (page - 1) * PageSize
+	if start > len(ids) {
+		start = len(ids)
+	}
+	end := start + PageSize
+	if end > len(ids) {
+		end = len(ids)
+	} else if end < len(ids) {
+		bp.Next = page + 1
+	}
+	if page > 1 {
+		bp.Prev = page - 1
+	}
+	for _, id := range ids[start:end] {
+		j, err := readJSON(tde, name, id, false)
+		if err != nil {
+			j = "error: " + err.Error()
+		}
+		bp.Docs = append(bp.Docs, document{ID: id, JSON: j})
+	}
+	a.Render(w, http.StatusOK, "browse", name, bp)
+}
+
+func showDocument(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *Admin, params martini.Params) {
+	name := params["name"]
+	id, err := strconv.ParseUint(params["id"], 10, 64)
+	if err != nil || !a.hasCollection(name) {
+		a.Error(w, http.StatusNotFound, "No document "+params["id"]+" in "+name)
+		return
+	}
+	j, err := readJSON(tde, name, id, true)
+	if err != nil {
+		a.Error(w, http.StatusNotFound, "No document "+params["id"]+" in "+name)
+		return
+	}
+	doc := struct {
+		Collection string
+		document
+	}{name, document{ID: id, JSON: j}}
+	a.Render(w, http.StatusOK, "document", name+" "+params["id"], doc)
+}
+
+func deleteDocument(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *Admin, params martini.Params, l *log.Logger) {
+	name := params["name"]
+	id, err := strconv.ParseUint(params["id"], 10, 64)
+	if err != nil || !a.hasCollection(name) {
+		a.Error(w, http.StatusNotFound, "No document "+params["id"]+" in "+name)
+		return
+	}
+	tde.Delete(name, id)
+	l.Infof("Admin deleted id=%d collection=%s", id, name)
+	Redirect(w, r, "/collections/"+name)
+}
+
+func readJSON(tde *kv.TiedotEngine, collection string, id uint64, indent bool) (string, error) {
+	var v interface{}
+	if err := tde.Read(collection, id, &v); err != nil {
+		return "", err
+	}
+	var j []byte
+	var err error
+	if indent {
+		j, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		j, err = json.Marshal(v)
+	}
+	return string(j), err
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// size formats n bytes for people: 512 B, 1.5 KiB, 20.0 MiB.
+func size(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n) / 1024
+	units := "KMGTPE"
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"errors"
+	"github.com/ryansb/legowebservices/config"
+)
+
+// Config is the "admin" section of the LWS config.
+type Config struct {
+	Enabled  bool   `config:"enabled" flag:"admin" usage:"Whether to serve the admin UI under /admin"`
+	User     string `config:"user" usage:"User name for the admin UI"`
+	Password string `config:"password" flag:"-"`
+}
+
+// Conf holds the admin settings once config.Load has run.
+var Conf = &Config{
+	User: "admin",
+}
+
+func init() {
+	config.Register("admin", Conf)
+}
+
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.User == "" {
+		return errors.New("user: must be set when the admin UI is enabled")
+	}
+	if c.Password == "" {
+		return errors.New("password: must be set when the admin UI is enabled")
+	}
+	return nil
+}
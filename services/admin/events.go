@@ -0,0 +1,114 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeepAlive is how often the event stream sends a comment while there are no
+// events, so that proxies keep it open.
+var KeepAlive = 15 * time.Second
+
+// events streams the changes to the collection parameter, or to every
+// browsable collection without it, as Server-Sent Events. Each event is named
+// after its operation and carries its sequence number as id, so browsers
+// resume through Last-Event-ID; other clients can pass since. When resuming
+// isn't possible anymore a reset event is sent, and the client should reload
+// what it shows.
+func events(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *Admin, l *log.Logger) {
+	collection := r.URL.Query().Get("collection")
+	if collection != "" && !a.hasCollection(collection) {
+		a.Error(w, http.StatusNotFound, "No collection named "+collection)
+		return
+	}
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	var last uint64
+	if since != "" {
+		var err error
+		if last, err = strconv.ParseUint(since, 10, 64); err != nil {
+			a.Error(w, http.StatusBadRequest, "Bad event id "+since)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		a.Error(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	watcher, err := watch(w, tde, collection, last)
+	if err != nil {
+		l.Errorf("Failure watching collection=%q err=%v", collection, err)
+		return
+	}
+	defer func() { watcher.Close() }()
+	flusher.Flush()
+	l.V(2).Infof("Admin watching collection=%q since=%d", collection, last)
+
+	keepAlive := time.NewTicker(KeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-watcher.C:
+			if !ok {
+				if watcher.Err() != kv.ErrWatchOverflow {
+					return
+				}
+				// fell behind, pick up from the last event sent
+				next, err := watch(w, tde, collection, last)
+				if err != nil {
+					return
+				}
+				watcher = next
+				break
+			}
+			if collection == "" && !a.hasCollection(e.Collection) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				l.Errorf("Failure encoding event seq=%d err=%v", e.Seq, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Op, data); err != nil {
+				return
+			}
+			last = e.Seq
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// watch starts watching collection from since, and falls back to watching
+// from now after sending a reset event when since is gone.
+func watch(w http.ResponseWriter, tde *kv.TiedotEngine, collection string, since uint64) (*kv.Watcher, error) {
+	watcher, err := tde.Watch(collection, since)
+	if err != kv.ErrWatchGap {
+		return watcher, err
+	}
+	if _, err := fmt.Fprint(w, "event: reset\ndata: {}\n\n"); err != nil {
+		return nil, err
+	}
+	return tde.Watch(collection, 0)
+}
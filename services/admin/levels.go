@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/ryansb/legowebservices/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type levelsPage struct {
+	log.Levels
+	Err string
+}
+
+// wantsJSON reports whether the client asked for JSON rather than a page,
+// with ?format=json or an Accept header.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeLevels(w http.ResponseWriter, status int, l log.Levels) {
+	out, _ := json.Marshal(l)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// showLevels shows the log verbosity, as JSON if asked.
+func showLevels(w http.ResponseWriter, r *http.Request, a *Admin) {
+	if wantsJSON(r) {
+		writeLevels(w, http.StatusOK, log.CurrentLevels())
+		return
+	}
+	a.Render(w, http.StatusOK, "levels", "Log levels", levelsPage{Levels: log.CurrentLevels()})
+}
+
+// setLevels changes the log verbosity from the form values v, vmodule and
+// backtrace_at. A revert_after duration makes the change temporary. Fields
+// left out keep their current value.
+func setLevels(w http.ResponseWriter, r *http.Request, a *Admin, l *log.Logger) {
+	levels := log.CurrentLevels()
+	var revertAfter time.Duration
+	err := r.ParseForm()
+	if err == nil {
+		err = parseLevels(r, &levels, &revertAfter)
+	}
+	if err == nil {
+		err = log.SetLevels(levels, revertAfter)
+	}
+	if err != nil {
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			out, _ := json.Marshal(map[string]string{"error": err.Error()})
+			w.Write(out)
+			return
+		}
+		a.Render(w, http.StatusBadRequest, "levels", "Log levels", levelsPage{Levels: levels, Err: err.Error()})
+		return
+	}
+	l.Infow("Admin changed log levels", "v", levels.V, "vmodule", levels.VModule,
+		"backtrace_at", levels.TraceAt, "revert_after", revertAfter.String())
+	if wantsJSON(r) {
+		writeLevels(w, http.StatusOK, log.CurrentLevels())
+		return
+	}
+	Redirect(w, r, "/levels")
+}
+
+func parseLevels(r *http.Request, levels *log.Levels, revertAfter *time.Duration) error {
+	if v, ok := r.Form["v"]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v[0]))
+		if err != nil {
+			return err
+		}
+		levels.V = n
+	}
+	if v, ok := r.Form["vmodule"]; ok {
+		levels.VModule = strings.TrimSpace(v[0])
+	}
+	if v, ok := r.Form["backtrace_at"]; ok {
+		levels.TraceAt = strings.TrimSpace(v[0])
+	}
+	if v := strings.TrimSpace(r.Form.Get("revert_after")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*revertAfter = d
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package admin
+
+import (
+	"github.com/ryansb/legowebservices/log"
+	"net/http"
+	"strings"
+)
+
+var severities = []string{"INFO", "WARNING", "ERROR", "FATAL"}
+
+type logsPage struct {
+	Severity   string
+	Query      string
+	Severities []string
+	Held       int
+	Lines      []string
+}
+
+// AddLogs shows the lines held by ring under /logs, newest first.
+func (a *Admin) AddLogs(ring *log.Ring) {
+	a.AddPage("/logs", "Logs")
+	a.router.Get("/logs", func(w http.ResponseWriter, r *http.Request) {
+		showLogs(w, r, a, ring)
+	})
+}
+
+func showLogs(w http.ResponseWriter, r *http.Request, a *Admin, ring *log.Ring) {
+	p := logsPage{
+		Severity:   r.URL.Query().Get("severity"),
+		Query:      r.URL.Query().Get("q"),
+		Severities: severities,
+	}
+	min := 0
+	for i, s := range severities {
+		if s == p.Severity {
+			min = i
+		}
+	}
+	entries := ring.Entries()
+	p.Held = len(entries)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if severityIndex(e.Severity) < min {
+			continue
+		}
+		line := strings.TrimSuffix(string(e.Data), "\n")
+		if p.Query != "" && !strings.Contains(line, p.Query) {
+			continue
+		}
+		p.Lines = append(p.Lines, line)
+	}
+	a.Render(w, http.StatusOK, "logs", "Logs", p)
+}
+
+func severityIndex(sev string) int {
+	for i, s := range severities {
+		if s == sev {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// snapshot sends a dump of the whole database. It is taken into a temporary
+// file first, so writes only wait for the disk and not for the client.
+func snapshot(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, l *log.Logger) {
+	f, size, err := tde.Snapshot()
+	if err != nil {
+		l.Errorf("Failure dumping database err=%v", err)
+		http.Error(w, "Failure creating snapshot", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	name := "lws-" + time.Now().UTC().Format("20060102-150405") + ".ndjson"
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if _, err := io.Copy(w, f); err != nil {
+		l.Warningf("Failure sending snapshot bytes=%d err=%v", size, err)
+		return
+	}
+	l.Infof("Admin downloaded snapshot bytes=%d", size)
+}
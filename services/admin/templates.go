@@ -0,0 +1,119 @@
+package admin
+
+func init() {
+	Template("header", headerTmpl)
+	Template("footer", footerTmpl)
+	Template("home", homeTmpl)
+	Template("error", errorTmpl)
+	Template("collections", collectionsTmpl)
+	Template("browse", browseTmpl)
+	Template("document", documentTmpl)
+	Template("logs", logsTmpl)
+	Template("levels", levelsTmpl)
+}
+
+const headerTmpl = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - LWS admin</title>
+<style>
+body { font-family: sans-serif; margin: 0 2em 2em; }
+nav { padding: 1em 0; border-bottom: 1px solid #ccc; margin-bottom: 1em; }
+nav a { margin-right: 1em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: .3em .8em; border-bottom: 1px solid #eee; vertical-align: top; }
+td.json { font-family: monospace; word-break: break-all; }
+form.inline { display: inline; }
+.error { color: #a00; }
+</style>
+</head>
+<body>
+<nav><a href="{{prefix}}/">LWS admin</a>{{range .Nav}}<a href="{{.Path}}">{{.Title}}</a>{{end}}</nav>
+<h1>{{.Title}}</h1>
+`
+
+const footerTmpl = `</body>
+</html>
+`
+
+const homeTmpl = `{{template "header" .}}
+<ul>
+{{range .Nav}}<li><a href="{{.Path}}">{{.Title}}</a></li>
+{{end}}</ul>
+<p><a href="{{prefix}}/snapshot">Download a snapshot</a> of all the data, for lws restore.</p>
+<p><a href="{{prefix}}/events">Watch the changes</a> to the collections as Server-Sent Events, or to one with ?collection=name.</p>
+{{template "footer" .}}`
+
+const errorTmpl = `{{template "header" .}}
+<p class="error">{{.Data}}</p>
+{{template "footer" .}}`
+
+const collectionsTmpl = `{{template "header" .}}
+<table>
+<tr><th>Service</th><th>Collection</th><th>Documents</th><th>Size</th><th>Indexes</th><th>As of</th><th></th></tr>
+{{range .Data}}<tr>
+<td>{{.Service}}</td>
+<td><a href="{{prefix}}/collections/{{.Name}}">{{.Name}}</a></td>
+{{if .Err}}<td colspan="5" class="error">{{.Err}}</td>{{else}}{{$at := .At}}{{with .Stats}}<td>{{.Docs}}</td>
+<td>{{size .Bytes}}</td>
+<td>{{range .Indexes}}{{path .Path}}: {{.Entries}} entries{{if .Dangling}}, <span class="error">{{.Dangling}} dangling</span>{{end}}<br>
+{{end}}{{range .Text}}{{path .Path}}: text, {{.Docs}} documents, {{.Terms}} terms<br>
+{{end}}</td>
+<td>{{$at.Format "15:04:05"}}</td>
+<td><form class="inline" method="post" action="{{prefix}}/collections/{{.Name}}/compact"><button>Compact</button></form></td>{{end}}{{end}}
+</tr>
+{{end}}</table>
+<p>Stats are kept for a while, as gathering them scans the indexes: <a href="?refresh=1">gather them again</a>.</p>
+<p>Compacting gives back the space of deleted documents and drops dangling index entries. Writes and reads wait meanwhile.</p>
+{{template "footer" .}}`
+
+const browseTmpl = `{{template "header" .}}
+{{with .Data}}
+<p>{{.Total}} documents, page {{.Page}}.
+{{if .Prev}}<a href="?page={{.Prev}}">previous</a>{{end}}
+{{if .Next}}<a href="?page={{.Next}}">next</a>{{end}}</p>
+<table>
+<tr><th>ID</th><th>Document</th><th></th></tr>
+{{$c := .Collection}}{{range .Docs}}<tr>
+<td><a href="{{prefix}}/collections/{{$c}}/{{.ID}}">{{.ID}}</a></td>
+<td class="json">{{.JSON}}</td>
+<td><form class="inline" method="post" action="{{prefix}}/collections/{{$c}}/{{.ID}}/delete"><button>Delete</button></form></td>
+</tr>
+{{end}}</table>
+{{end}}
+{{template "footer" .}}`
+
+const documentTmpl = `{{template "header" .}}
+{{with .Data}}
+<pre>{{.JSON}}</pre>
+<form method="post" action="{{prefix}}/collections/{{.Collection}}/{{.ID}}/delete"><button>Delete</button></form>
+<p><a href="{{prefix}}/collections/{{.Collection}}">Back to {{.Collection}}</a></p>
+{{end}}
+{{template "footer" .}}`
+
+const logsTmpl = `{{template "header" .}}
+{{with .Data}}
+<form method="get">
+<select name="severity">{{$sev := .Severity}}{{range .Severities}}<option{{if eq . $sev}} selected{{end}}>{{.}}</option>{{end}}</select>
+<input name="q" value="{{.Query}}" placeholder="text"> <button>Filter</button>
+</form>
+<p>{{len .Lines}} of the last {{.Held}} lines, newest first.</p>
+<pre>{{range .Lines}}{{.}}
+{{end}}</pre>
+{{end}}
+{{template "footer" .}}`
+
+const levelsTmpl = `{{template "header" .}}
+{{with .Data}}
+{{if .Err}}<p class="error">{{.Err}}</p>{{end}}
+{{if .Temporary}}<p>Reverting at {{.RevertAt.Format "2006-01-02 15:04:05 MST"}}.</p>{{end}}
+<form method="post" action="{{prefix}}/levels">
+<p><label>v <input name="v" value="{{.V}}" size="3"></label></p>
+<p><label>vmodule <input name="vmodule" value="{{.VModule}}" size="60" placeholder="file=N,pattern*=N"></label></p>
+<p><label>backtrace at <input name="backtrace_at" value="{{.TraceAt}}" placeholder="file.go:N"></label></p>
+<p><label>revert after <input name="revert_after" placeholder="15m, empty to keep"></label></p>
+<button>Set</button>
+</form>
+{{end}}
+{{template "footer" .}}`
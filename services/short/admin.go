@@ -0,0 +1,173 @@
+package short
+
+import (
+	"github.com/codegangsta/martini"
+	"github.com/ryansb/legowebservices/encoding/base62"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"github.com/ryansb/legowebservices/persist/repo"
+	"github.com/ryansb/legowebservices/services/admin"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// link is a Shortened as shown in the admin UI.
+type link struct {
+	Shortened
+	Slug string
+	Full string
+}
+
+type linkList struct {
+	Query string
+	Err   string
+	Links []link
+}
+
+type byShort []link
+
+func (b byShort) Len() int           { return len(b) }
+func (b byShort) Less(i, j int) bool { return b[i].Short < b[j].Short }
+func (b byShort) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// AdminPages adds the shortener's pages and collections to the admin UI.
+func AdminPages(a *admin.Admin, conf *Config) {
+	a.AddCollections("short", urlCollection, counterCollection)
+	a.AddPage("/short", "Short links")
+	r := a.Router()
+	r.Get("/short", adminList)
+	r.Get("/short/:short", adminEdit)
+	r.Post("/short/:short", adminSave)
+	r.Post("/short/:short/delete", adminDelete)
+	a.Map(conf)
+}
+
+func init() {
+	admin.Template("short.list", listTmpl)
+	admin.Template("short.edit", editTmpl)
+}
+
+func adminList(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *admin.Admin, conf *Config) {
+	list := linkList{Query: r.URL.Query().Get("q")}
+	store := links.Repo(tde)
+	var found []Shortened
+	var err error
+	if list.Query != "" {
+		found, err = searchLinks(store, list.Query)
+	} else {
+		err = store.All(store.Query().Has(kv.Path{"Short"}), &found)
+	}
+	if err != nil {
+		list.Err = err.Error()
+	}
+	for _, s := range found {
+		slug := base62.EncodeInt(s.Short)
+		list.Links = append(list.Links, link{Shortened: s, Slug: slug, Full: conf.Base + slug})
+	}
+	if list.Query == "" {
+		sort.Sort(byShort(list.Links))
+	}
+	a.Render(w, http.StatusOK, "short.list", "Short links", list)
+}
+
+// searchLinks returns the links whose destination holds the words of query,
+// best match first.
+func searchLinks(store *repo.Repo, query string) ([]Shortened, error) {
+	hits, err := store.Query().Match(kv.Path{"Original"}, query).Ranked()
+	if err != nil {
+		return nil, err
+	}
+	found := make([]Shortened, 0, len(hits))
+	for _, h := range hits {
+		var s Shortened
+		if err := store.Get(h.ID, &s); err != nil {
+			continue // deleted since
+		}
+		found = append(found, s)
+	}
+	return found, nil
+}
+
+func adminEdit(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *admin.Admin, conf *Config, params martini.Params) {
+	slug := params["short"]
+	s, err := LongURL(slug, tde)
+	if err != nil {
+		a.Error(w, http.StatusNotFound, "No short URL /"+slug)
+		return
+	}
+	a.Render(w, http.StatusOK, "short.edit", "Edit /"+slug, link{Shortened: *s, Slug: slug, Full: conf.Base + slug})
+}
+
+func adminSave(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *admin.Admin, params martini.Params, l *log.Logger) {
+	slug := params["short"]
+	dest := strings.TrimSpace(r.FormValue("url"))
+	if u, err := url.Parse(dest); err != nil || dest == "" {
+		a.Error(w, http.StatusBadRequest, "Malformed URL: "+dest)
+		return
+	} else if u.Scheme == "" {
+		dest = "http://" + dest
+	}
+	if err := setOriginal(slug, dest, tde); err == kv.ErrNotFound {
+		a.Error(w, http.StatusNotFound, "No short URL /"+slug)
+		return
+	} else if err != nil {
+		a.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	l.Infof("Admin changed short URL /%s to %s", slug, dest)
+	admin.Redirect(w, r, "/short")
+}
+
+// setOriginal points the link of slug to dest.
+func setOriginal(slug, dest string, tde *kv.TiedotEngine) error {
+	mu.Lock()
+	defer mu.Unlock()
+	s := new(Shortened)
+	store := links.Repo(tde)
+	if err := findShort(slug, store, s); err != nil {
+		return err
+	}
+	s.Original = dest
+	_, err := store.Save(s)
+	return err
+}
+
+func adminDelete(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, a *admin.Admin, params martini.Params, l *log.Logger) {
+	slug := params["short"]
+	if _, err := deleteShort(slug, tde); err != nil {
+		a.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	l.Infof("Admin deleted short URL /%s", slug)
+	admin.Redirect(w, r, "/short")
+}
+
+const listTmpl = `{{template "header" .}}
+{{with .Data}}
+<form method="get"><input name="q" value="{{.Query}}" placeholder="words or &quot;a phrase&quot; in destination"> <button>Search</button></form>
+{{if .Err}}<p class="error">{{.Err}}</p>{{end}}
+<table>
+<tr><th>Slug</th><th>Destination</th><th>Hits</th><th></th></tr>
+{{range .Links}}<tr>
+<td><a href="{{.Full}}">{{.Slug}}</a></td>
+<td>{{.Original}}</td>
+<td>{{.HitCount}}</td>
+<td><a href="{{prefix}}/short/{{.Slug}}">Edit</a>
+<form class="inline" method="post" action="{{prefix}}/short/{{.Slug}}/delete"><button>Delete</button></form></td>
+</tr>
+{{else}}<tr><td colspan="4">No short links.</td></tr>
+{{end}}</table>
+{{end}}
+{{template "footer" .}}`
+
+const editTmpl = `{{template "header" .}}
+{{with .Data}}
+<p><a href="{{.Full}}">{{.Full}}</a> has been followed {{.HitCount}} times.</p>
+<form method="post" action="{{prefix}}/short/{{.Slug}}">
+<input name="url" value="{{.Original}}" size="80"> <button>Save</button>
+</form>
+<form method="post" action="{{prefix}}/short/{{.Slug}}/delete"><button>Delete</button></form>
+{{end}}
+{{template "footer" .}}`
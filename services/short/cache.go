@@ -0,0 +1,201 @@
+package short
+
+import (
+	"container/list"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"sync"
+	"time"
+)
+
+// cache keeps the most recently followed short URLs in memory, so redirects
+// of hot links don't touch storage. It follows the changes to urlCollection
+// to drop deleted links and refresh updated ones. Cached links have no
+// HitCount, which changes with every redirect.
+type cache struct {
+	mu     sync.Mutex
+	size   int // zero disables the cache
+	ttl    time.Duration
+	now    func() time.Time
+	lru    *list.List // of *cached, most recently used first
+	shorts map[int64]*list.Element
+	ids    map[uint64]*list.Element
+
+	// epoch counts the changes seen, and changed holds the last ones, so a
+	// lookup that read storage before a change it hasn't seen doesn't cache
+	// what it read. Hits counted on a cached link change nothing cached,
+	// and aren't counted.
+	epoch   uint64
+	changed [64]linkChange
+}
+
+// linkChange is a change seen to document id, with the new link, nil for
+// deletes.
+type linkChange struct {
+	id uint64
+	s  *Shortened
+}
+
+type cached struct {
+	id      uint64
+	s       Shortened
+	expires time.Time
+}
+
+func newCache(size int, ttl time.Duration) *cache {
+	return &cache{
+		size:   size,
+		ttl:    ttl,
+		now:    time.Now,
+		lru:    list.New(),
+		shorts: make(map[int64]*list.Element),
+		ids:    make(map[uint64]*list.Element),
+	}
+}
+
+// lookup returns the Shortened of slug, from memory if it can.
+func (c *cache) lookup(slug string, tde *kv.TiedotEngine) (*Shortened, error) {
+	n, err := slugNumber(slug)
+	if err != nil {
+		return nil, err
+	}
+	s, epoch, ok := c.get(n)
+	if ok {
+		cacheHits.Inc()
+		return s, nil
+	}
+	cacheMisses.Inc()
+	s = new(Shortened)
+	if err := links.Repo(tde).FindOne(s, "Short", n); err != nil {
+		return nil, err
+	}
+	c.put(s.ID, *s, epoch)
+	return s, nil
+}
+
+// get returns a copy of the Shortened cached under short. On a miss it
+// returns the epoch to hand to put.
+func (c *cache) get(short int64) (*Shortened, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.shorts[short]
+	if !ok {
+		return nil, c.epoch, false
+	}
+	v := e.Value.(*cached)
+	if c.now().After(v.expires) {
+		c.remove(e)
+		return nil, c.epoch, false
+	}
+	c.lru.MoveToFront(e)
+	s := v.s
+	return &s, c.epoch, true
+}
+
+// put caches s, read from storage as document id during epoch, unless it
+// changed since other than by counting hits.
+func (c *cache) put(id uint64, s Shortened, epoch uint64) {
+	s.HitCount = 0
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 || c.epoch-epoch >= uint64(len(c.changed)) {
+		return
+	}
+	for e := epoch; e < c.epoch; e++ {
+		ch := c.changed[e%uint64(len(c.changed))]
+		if ch.id == id && (ch.s == nil || *ch.s != s) {
+			return
+		}
+	}
+	c.add(&cached{id: id, s: s, expires: c.now().Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// add caches v in place of what was cached under its ID or Short.
+func (c *cache) add(v *cached) {
+	if e, ok := c.ids[v.id]; ok {
+		c.remove(e)
+	}
+	if e, ok := c.shorts[v.s.Short]; ok {
+		c.remove(e)
+	}
+	e := c.lru.PushFront(v)
+	c.shorts[v.s.Short] = e
+	c.ids[v.id] = e
+}
+
+func (c *cache) remove(e *list.Element) {
+	v := c.lru.Remove(e).(*cached)
+	delete(c.shorts, v.s.Short)
+	delete(c.ids, v.id)
+}
+
+// change applies a change made to urlCollection.
+func (c *cache) change(ev kv.Event) {
+	var s *Shortened
+	if ev.Op == kv.Updated {
+		s = &Shortened{ID: ev.ID}
+		if err := links.FromM(ev.Doc, s); err != nil {
+			log.Errorf("Failure decoding updated short URL id=%d err=%v", ev.ID, err)
+			s = nil
+		} else {
+			s.HitCount = 0
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.ids[ev.ID]
+	if ok && s != nil && e.Value.(*cached).s == *s {
+		return // only hits were counted
+	}
+	c.changed[c.epoch%uint64(len(c.changed))] = linkChange{id: ev.ID, s: s}
+	c.epoch++
+	if !ok {
+		return
+	}
+	if s == nil {
+		c.remove(e)
+		return
+	}
+	c.add(&cached{id: ev.ID, s: *s, expires: e.Value.(*cached).expires})
+}
+
+// purge empties the cache and fails the lookups in progress, for when
+// changes may have been missed.
+func (c *cache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.shorts = make(map[int64]*list.Element)
+	c.ids = make(map[uint64]*list.Element)
+	c.epoch += uint64(len(c.changed))
+}
+
+// follow applies the changes made to urlCollection until the engine is
+// closed, and then turns the cache off as it can't be kept right anymore.
+func (c *cache) follow(tde *kv.TiedotEngine) {
+	defer func() {
+		c.purge()
+		c.mu.Lock()
+		c.size = 0
+		c.mu.Unlock()
+	}()
+	for {
+		w, err := tde.Watch(urlCollection, 0)
+		if err != nil {
+			log.Warningf("Short URL cache off, failure watching err=%v", err)
+			return
+		}
+		c.purge()
+		for ev := range w.C {
+			c.change(ev)
+		}
+		if err := w.Err(); err != kv.ErrWatchOverflow {
+			log.V(1).Infof("Short URL cache off err=%v", err)
+			return
+		}
+		log.Warning("Short URL cache fell behind the changes, emptying it")
+	}
+}
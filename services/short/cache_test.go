@@ -0,0 +1,193 @@
+package short
+
+import (
+	"github.com/ryansb/legowebservices/persist/kv"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheEvicts(t *testing.T) {
+	c := newCache(2, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	for i := int64(1); i <= 2; i++ {
+		_, epoch, _ := c.get(i)
+		c.put(uint64(i), Shortened{Short: i}, epoch)
+	}
+	if _, _, ok := c.get(1); !ok {
+		t.Fatal("expected 1 to be cached")
+	}
+	_, epoch, _ := c.get(3)
+	c.put(3, Shortened{Short: 3}, epoch)
+	if _, _, ok := c.get(2); ok {
+		t.Error("the least recently used link should be evicted")
+	}
+	if s, _, ok := c.get(1); !ok || s.Short != 1 {
+		t.Errorf("expected 1 to be cached, got %v", s)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, _, ok := c.get(3); ok {
+		t.Error("expired link still served")
+	}
+	if c.lru.Len() != 1 || len(c.ids) != 1 || len(c.shorts) != 1 {
+		t.Errorf("expired link still held lru=%d ids=%d", c.lru.Len(), len(c.ids))
+	}
+}
+
+// Test that a lookup doesn't cache what it read before a change it missed.
+func TestCacheSkipsChanged(t *testing.T) {
+	c := newCache(10, time.Minute)
+	_, epoch, _ := c.get(1)
+	c.change(kv.Event{Op: kv.Deleted, ID: 7})
+	c.put(7, Shortened{Short: 1}, epoch)
+	if _, _, ok := c.get(1); ok {
+		t.Error("cached a link deleted while it was read")
+	}
+	c.put(8, Shortened{Short: 2}, epoch)
+	if _, _, ok := c.get(2); !ok {
+		t.Error("a change to another link should not stop caching")
+	}
+	c.purge()
+	c.put(9, Shortened{Short: 3}, epoch)
+	if _, _, ok := c.get(3); ok {
+		t.Error("cached a link read before a purge")
+	}
+}
+
+// Test that counting hits doesn't keep links out of the cache.
+func TestCacheIgnoresHits(t *testing.T) {
+	c := newCache(10, time.Minute)
+	_, epoch, _ := c.get(1)
+	c.put(1, Shortened{ID: 1, Original: "http://a.example.com", Short: 1, HitCount: 5}, epoch)
+	if s, _, ok := c.get(1); !ok || s.HitCount != 0 {
+		t.Fatalf("got %v, want a cached link without hits", s)
+	}
+
+	_, epoch, _ = c.get(2)
+	for i := uint64(0); i < 100; i++ {
+		c.change(kv.Event{Op: kv.Updated, ID: 1, Doc: links.ToM(Shortened{Original: "http://a.example.com", Short: 1, HitCount: 6 + i})})
+	}
+	c.change(kv.Event{Op: kv.Updated, ID: 2, Doc: links.ToM(Shortened{Original: "http://b.example.com", Short: 2, HitCount: 1})})
+	c.put(2, Shortened{ID: 2, Original: "http://b.example.com", Short: 2, HitCount: 1}, epoch)
+	if _, _, ok := c.get(2); !ok {
+		t.Error("hits counted while a link was read kept it out")
+	}
+
+	_, epoch, _ = c.get(3)
+	c.change(kv.Event{Op: kv.Updated, ID: 3, Doc: links.ToM(Shortened{Original: "http://new.example.com", Short: 3})})
+	c.put(3, Shortened{ID: 3, Original: "http://old.example.com", Short: 3}, epoch)
+	if _, _, ok := c.get(3); ok {
+		t.Error("cached a link changed while it was read")
+	}
+}
+
+// Test that redirects and the hits they count keep being served from memory.
+func TestCacheHitRatio(t *testing.T) {
+	tde, done := testEngine(t)
+	defer done()
+	for i := int64(1); i <= 5; i++ {
+		if _, err := tde.Insert(urlCollection, Shortened{Original: "http://a.example.com", Short: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newCache(10, time.Minute)
+	go c.follow(tde)
+	defer tde.Close()
+	waitFor(t, "start", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.epoch > 0
+	})
+
+	hits, misses := cacheHits.Value(), cacheMisses.Value()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				slug := strconv.Itoa(1 + (g+i)%5)
+				if _, err := c.lookup(slug, tde); err != nil {
+					t.Error(err)
+					return
+				}
+				incrHits(tde, slug)
+			}
+		}(g)
+	}
+	wg.Wait()
+	hits, misses = cacheHits.Value()-hits, cacheMisses.Value()-misses
+	if hits+misses != 800 || misses > 40 {
+		t.Errorf("hits=%d misses=%d, want at most 40 misses out of 800", hits, misses)
+	}
+}
+
+func TestCacheFollows(t *testing.T) {
+	tde, done := testEngine(t)
+	defer done()
+	id, err := tde.Insert(urlCollection, Shortened{Original: "http://a.example.com", Short: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCache(10, time.Minute)
+	go c.follow(tde)
+	// wait for follow to watch, it purges when it starts
+	for {
+		c.mu.Lock()
+		started := c.epoch > 0
+		c.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	hits, misses := cacheHits.Value(), cacheMisses.Value()
+	for i := 0; i < 2; i++ {
+		if s, err := c.lookup("1", tde); err != nil || s.Original != "http://a.example.com" {
+			t.Fatalf("lookup got %v err=%v", s, err)
+		}
+	}
+	if cacheHits.Value()-hits != 1 || cacheMisses.Value()-misses != 1 {
+		t.Errorf("hits=%d misses=%d, want 1 and 1", cacheHits.Value()-hits, cacheMisses.Value()-misses)
+	}
+	if _, err := c.lookup("!", tde); err != kv.ErrNotFound {
+		t.Errorf("invalid slug gave err=%v", err)
+	}
+
+	if err := tde.Update(urlCollection, id, Shortened{Original: "http://b.example.com", Short: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "update", func() bool {
+		s, _, ok := c.get(1)
+		return ok && s.Original == "http://b.example.com"
+	})
+	tde.Delete(urlCollection, id)
+	waitFor(t, "delete", func() bool {
+		_, _, ok := c.get(1)
+		return !ok
+	})
+	if _, err := c.lookup("1", tde); err != kv.ErrNotFound {
+		t.Errorf("deleted link gave err=%v", err)
+	}
+
+	tde.Close()
+	waitFor(t, "close", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.size == 0
+	})
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	for i := 0; i < 1000; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("cache didn't follow the %s", what)
+}
@@ -0,0 +1,88 @@
+package short
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ryansb/legowebservices/config"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Slug schemes.
+const (
+	// SequentialSlugs encode the counter as is: 1, 2, ... 9, a, b.
+	SequentialSlugs = "sequential"
+	// FeistelSlugs encode a permutation of the counter keyed by SlugKey.
+	FeistelSlugs = "feistel"
+	// RandomSlugs encode random numbers, retrying on collisions.
+	RandomSlugs = "random"
+)
+
+// Config is the "short" section of the LWS config.
+type Config struct {
+	Enabled bool   `config:"enabled" flag:"short" usage:"Whether to run the URL shortener"`
+	Base    string `config:"base" usage:"Base URL for the shortener"`
+
+	// Slugs picks how new short URLs are named. Existing slugs stay valid
+	// whatever the scheme, so it can be changed on a running deployment.
+	Slugs    string `config:"slugs" usage:"How new slugs are generated: sequential, feistel or random"`
+	SlugKey  string `config:"slug_key" flag:"-"`
+	SlugBits uint   `config:"slug_bits" usage:"Size in bits of feistel and random slugs"`
+
+	CacheSize int           `config:"cache_size" usage:"Short URLs kept in memory for redirects, 0 to read storage every time"`
+	CacheTTL  time.Duration `config:"cache_ttl" usage:"How long a short URL is kept in memory"`
+}
+
+// Conf holds the shortener settings once config.Load has run.
+var Conf = &Config{
+	Base:     "http://localhost/",
+	Slugs:    SequentialSlugs,
+	SlugBits: 40,
+
+	CacheSize: 10000,
+	CacheTTL:  10 * time.Minute,
+}
+
+func init() {
+	config.Register("short", Conf)
+}
+
+func (c *Config) Validate() error {
+	u, err := url.Parse(c.Base)
+	if err != nil {
+		return errors.New("base: " + err.Error())
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return errors.New("base: must be an absolute URL, got " + c.Base)
+	}
+	if !strings.HasSuffix(c.Base, "/") {
+		return errors.New("base: must end with a slash, got " + c.Base)
+	}
+	if c.CacheSize < 0 {
+		return fmt.Errorf("cache_size: must not be negative, got %d", c.CacheSize)
+	}
+	if c.CacheSize > 0 && c.CacheTTL <= 0 {
+		return fmt.Errorf("cache_ttl: must be positive, got %s", c.CacheTTL)
+	}
+	switch c.Slugs {
+	case SequentialSlugs:
+	case FeistelSlugs:
+		if len(c.SlugKey) < 16 {
+			return errors.New("slug_key: must be at least 16 characters for feistel slugs")
+		}
+		if c.SlugBits%2 != 0 {
+			return fmt.Errorf("slug_bits: must be even for feistel slugs, got %d", c.SlugBits)
+		}
+		fallthrough
+	case RandomSlugs:
+		// Short is stored as a JSON number, and compared as a float64
+		// which holds integers exactly up to 2^53.
+		if c.SlugBits < 16 || c.SlugBits > 52 {
+			return fmt.Errorf("slug_bits: must be between 16 and 52, got %d", c.SlugBits)
+		}
+	default:
+		return fmt.Errorf("slugs: must be sequential, feistel or random, got %q", c.Slugs)
+	}
+	return nil
+}
@@ -1,7 +0,0 @@
-package short
-
-import (
-	"flag"
-)
-
-var base = flag.String("short-base", "http://localhost/", "Base URL for the shortener")
@@ -2,9 +2,9 @@ package short
 
 import (
 	"github.com/codegangsta/martini"
-	"github.com/ryansb/legowebservices/encoding/base62"
 	"github.com/ryansb/legowebservices/log"
 	"github.com/ryansb/legowebservices/persist/kv"
+	"github.com/ryansb/legowebservices/persist/repo"
 	. "github.com/ryansb/legowebservices/util/m"
 	"net/http"
 )
@@ -12,45 +12,61 @@ import (
 var urlCollection = "short.url"
 var counterCollection = "short.counter"
 
-func root(w http.ResponseWriter, r *http.Request) (int, string) {
-	log.V(3).Info("Served Homepage")
+var links = repo.NewModel(urlCollection, Shortened{})
+var counters = repo.NewModel(counterCollection, Counter{})
+
+// Collections are the collections the shortener keeps its data in.
+var Collections = []kv.CollectionSpec{links.Spec(), counters.Spec()}
+
+func root(w http.ResponseWriter, r *http.Request, l *log.Logger) (int, string) {
+	l.V(3).Info("Served Homepage")
 	return 200, ("Welcome to legowebservices.short URL shortener service.\n" +
 		"POST to this URL with JSON matching {\"url\":\"some.long.url.com\"}\n")
 }
 
-func retrieve(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, params martini.Params) {
+func retrieve(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, c *cache, params martini.Params, l *log.Logger) {
 	short := params["short"]
-	domain, err := LongURL(short, tde)
+	domain, err := c.lookup(short, tde)
 	if err == kv.ErrNotFound {
-		log.V(1).Info("Path /" + short + " not found")
+		l.V(1).Info("Path /" + short + " not found")
+		notFound.Inc()
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if len(domain.Original) > 0 {
-		log.V(3).Info("[INFO]: Served /" + short + " redirect to " + domain.Original)
+	if err == nil && len(domain.Original) > 0 {
+		l.V(3).Infow("Served redirect", "short", short, "url", domain.Original)
 		http.Redirect(w, r, domain.Original, http.StatusFound)
+		redirects.Inc()
 		hits <- short
 		return
 	}
-	log.Error("retrieving long URL err:" + err.Error())
+	l.Errorw("Failure retrieving long URL", "short", short, "err", err)
 	w.WriteHeader(500)
 	if err != nil {
 		w.Write(M{"error": err.Error()}.JSON())
 	}
 }
 
-func remove(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, params martini.Params) (int, []byte) {
+func remove(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, params martini.Params, l *log.Logger) (int, []byte) {
 	short := params["short"]
-	_, err := tde.Query(urlCollection).Equals(kv.Path{"Short"}, base62.DecodeString(short)).Delete()
+	_, err := deleteShort(short, tde)
 	if err != nil {
-		log.Error("Failure deleting URL /" + short + " err:" + err.Error())
+		l.Errorw("Failure deleting URL", "short", short, "err", err)
 		return 500, M{
 			"message": "Could not delete URL /" + short,
 			"error":   err.Error(),
 		}.JSON()
 	}
-	log.V(1).Info("Deleted URL /" + short)
+	l.V(1).Infow("Deleted URL", "short", short)
 	return 200, M{
 		"deleted": M{"short": short},
 	}.JSON()
 }
+
+func deleteShort(short string, tde *kv.TiedotEngine) (int, error) {
+	q, err := shortQuery(short, tde)
+	if err == kv.ErrNotFound {
+		return 0, nil
+	}
+	return q.Delete()
+}
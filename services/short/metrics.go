@@ -0,0 +1,19 @@
+package short
+
+import (
+	"github.com/ryansb/legowebservices/metrics"
+)
+
+var (
+	creates   = metrics.NewCounter("lws_short_creates_total", "Short URLs created.")
+	redirects = metrics.NewCounter("lws_short_redirects_total", "Requests redirected to their long URL.")
+	notFound  = metrics.NewCounter("lws_short_not_found_total", "Requests for short URLs that do not exist.")
+
+	cacheHits   = metrics.NewCounter("lws_short_cache_hits_total", "Short URL lookups served from memory.")
+	cacheMisses = metrics.NewCounter("lws_short_cache_misses_total", "Short URL lookups that read storage.")
+)
+
+func init() {
+	metrics.NewGaugeFunc("lws_short_hits_queue_depth", "Hits waiting to be counted.",
+		func() float64 { return float64(len(hits)) })
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
-	"flag"
 	"github.com/codegangsta/martini"
 	"github.com/ryansb/legowebservices/encoding/base62"
+	"github.com/ryansb/legowebservices/health"
 	"github.com/ryansb/legowebservices/log"
 	"github.com/ryansb/legowebservices/persist/kv"
+	"github.com/ryansb/legowebservices/persist/repo"
+	"github.com/ryansb/legowebservices/reqlog"
 	. "github.com/ryansb/legowebservices/util/m"
 	"io/ioutil"
 	"net/http"
@@ -17,67 +19,56 @@ import (
 )
 
 type Shortened struct {
-	Original string
-	Short    int64
+	ID       uint64 `kv:",id"`
+	Original string `kv:"Original,text"`
+	Short    int64  `kv:"Short,index,unique"`
 	HitCount uint64
 }
 
 func (s Shortened) ToM() M {
-	return M{
-		"Original": s.Original,
-		"Short":    s.Short,
-		"HitCount": s.HitCount,
-	}
+	return links.ToM(s)
 }
 
 type Counter struct {
-	Count int64
+	ID    uint64 `kv:",id"`
+	Count int64  `kv:"Count,index"`
 }
 
 func (c Counter) ToM() M {
-	return M{"Count": c.Count}
+	return counters.ToM(c)
 }
 
 var hits = make(chan string, 100)
 
+// mu serializes the changes made by reading a link and saving it back, so
+// hit counts and admin edits don't undo each other.
 var mu = new(sync.Mutex)
 
-func incrCount(tde *kv.TiedotEngine) int64 {
-	mu.Lock()
-	defer mu.Unlock()
-	counter := new(Counter)
-	id, err := tde.Query(counterCollection).Has(kv.Path{"Count"}).OneInto(counter)
-	if err == kv.ErrNotFound {
-		log.Warning("Counter not found, saving new one.")
-		_, err = tde.Insert(counterCollection, Counter{Count: 1})
-		if err != nil {
-			log.Errorf("Error saving new counter err=%s", err.Error())
-		}
-		r, err := tde.All(counterCollection)
-		log.V(3).Infof("total of %d results=%v, err=%v", len(r), r, err)
-		return 1
+// incrCount takes the next value of the counter. The transaction keeps
+// concurrent requests from taking the same one.
+func incrCount(tx *kv.Tx) (int64, error) {
+	r := counters.In(tx)
+	var found []Counter
+	if err := r.All(r.Query().Has(kv.Path{"Count"}), &found); err != nil {
+		return 0, err
 	}
-	if err != nil {
-		log.Error("Failure getting counter err:" + err.Error())
-		panic(err)
+	if len(found) == 0 {
+		log.Warning("Counter not found, saving new one.")
+		_, err := r.Save(&Counter{Count: 1})
+		return 1, err
 	}
+	counter := found[0]
 	counter.Count++
-	err = tde.Update(counterCollection, id, counter)
-	if err != nil {
-		log.Error("Failure updating counter err:" + err.Error())
-		panic(err)
-	}
-	return counter.Count
+	_, err := r.Save(&counter)
+	return counter.Count, err
 }
 
 func incrHits(tde *kv.TiedotEngine, key string) uint64 {
 	mu.Lock()
 	defer mu.Unlock()
 	short := new(Shortened)
-	id, err := tde.Query(urlCollection).Equals(
-		kv.Path{"Short"},
-		base62.DecodeString(key),
-	).OneInto(short)
+	r := links.Repo(tde)
+	err := findShort(key, r, short)
 	if err == kv.ErrNotFound {
 		log.Warningf("Short URL %s not found", key)
 		return 0
@@ -87,48 +78,68 @@ func incrHits(tde *kv.TiedotEngine, key string) uint64 {
 	}
 
 	short.HitCount++
-	err = tde.Update(urlCollection, id, short)
-	if err != nil {
-		log.Error("Failure updating hitcount key=%s err=%s", key, err.Error())
+	if _, err := r.Save(short); err != nil {
+		log.Errorf("Failure updating hitcount key=%s err=%s", key, err.Error())
 		return 0
 	}
 	return short.HitCount
 }
 
-func newShort(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine) {
+func newShort(w http.ResponseWriter, r *http.Request, tde *kv.TiedotEngine, conf *Config, l *log.Logger) {
 	defer r.Body.Close()
 	raw, err := ioutil.ReadAll(r.Body)
 	log.FatalIfErr(err, "Failure reading request err:")
 	var v M
 	err = json.Unmarshal(raw, &v)
-	log.FatalIfErr(err, "Failure decoding JSON json:"+string(raw)+" err:")
+	log.FatalIfErr(err, "Failure decoding JSON json:%s err:", raw)
 	if dest, ok := v["url"]; ok {
-		count := incrCount(tde)
-		shortSlug := base62.EncodeInt(count)
 		parsed, err := url.Parse(dest.(string))
 		if err != nil {
-			log.Warning("Malformed URL:" + dest.(string) + " err:" + err.Error())
+			l.Warning("Malformed URL:" + dest.(string) + " err:" + err.Error())
 		}
 		if parsed.Scheme == "" {
 			dest = "http://" + dest.(string)
 		}
 
-		s := Shortened{
-			Original: dest.(string),
-			Short:    count,
+		// the counter and the link are saved together, or not at all
+		var s Shortened
+		err = tde.Transact(func(tx *kv.Tx) error {
+			for i := 0; ; i++ {
+				count, err := nextShort(tx, conf)
+				if err != nil {
+					return err
+				}
+				s = Shortened{
+					Original: dest.(string),
+					Short:    count,
+				}
+				err = saveShortened(s, tx)
+				// a link made under another slug scheme may have the
+				// number the counter gave
+				if _, dup := err.(*kv.ErrDuplicate); dup && i+1 < maxSlugAttempts {
+					l.V(2).Infof("Slug taken short=%d, retrying", count)
+					continue
+				}
+				return err
+			}
+		})
+		if err != nil {
+			l.Errorf("Failure saving URL err=%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(M{"error": err.Error()}.JSON())
+			return
 		}
-
-		err = saveShortened(s, tde)
-		log.FatalIfErr(err, "Failure saving URL err:")
+		shortSlug := base62.EncodeInt(s.Short)
+		creates.Inc()
 		out, _ := json.Marshal(map[string]interface{}{
 			"Short":    s.Short,
 			"Original": s.Original,
-			"Full":     *base + shortSlug,
+			"Full":     conf.Base + shortSlug,
 			"HitCount": s.HitCount,
 		})
 		w.Write(out)
 	} else {
-		log.Info("No url field included in JSON")
+		l.Info("No url field included in JSON")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Require 'url' field in request JSON"))
 	}
@@ -141,29 +152,45 @@ func encodeShortened(s Shortened) []byte {
 	return buf.Bytes()
 }
 
-func decodeShortened(v interface{}) (*Shortened, error) {
-	o, _ := json.Marshal(v)
-	s := new(Shortened)
-	err := json.Unmarshal(o, s)
-	if err != nil {
+func LongURL(short string, tde *kv.TiedotEngine) (*Shortened, error) {
+	out := new(Shortened)
+	if err := findShort(short, links.Repo(tde), out); err != nil {
 		return nil, err
 	}
-	return s, nil
+	return out, nil
 }
 
-func LongURL(short string, tde *kv.TiedotEngine) (*Shortened, error) {
-	// ignore the ID for now, we don't really need it
-	out := new(Shortened)
-	_, err := tde.Query("short.url").Equals(kv.Path{"Short"}, base62.DecodeString(short)).OneInto(out)
-	log.Infof("Read one into %+v error:%v", out, err)
+// findShort reads the Shortened stored under slug into out.
+func findShort(slug string, r *repo.Repo, out *Shortened) error {
+	n, err := slugNumber(slug)
+	if err != nil {
+		return err
+	}
+	return r.FindOne(out, "Short", n)
+}
+
+// shortQuery builds the query matching the Shortened stored under slug.
+func shortQuery(slug string, tde *kv.TiedotEngine) (*kv.Query, error) {
+	n, err := slugNumber(slug)
 	if err != nil {
 		return nil, err
 	}
-	return out, nil
+	return tde.Query(urlCollection).Equals(kv.Path{"Short"}, n), nil
+}
+
+// slugNumber returns the Short of slug. Slugs that aren't valid base62 can't
+// match anything and give kv.ErrNotFound.
+func slugNumber(slug string) (int64, error) {
+	n, err := base62.Decode(slug)
+	if err != nil {
+		log.V(1).Infof("Invalid short URL slug=%s err=%v", slug, err)
+		return 0, kv.ErrNotFound
+	}
+	return n, nil
 }
 
-func saveShortened(s Shortened, tde *kv.TiedotEngine) error {
-	_, err := tde.Insert(urlCollection, s)
+func saveShortened(s Shortened, tx *kv.Tx) error {
+	_, err := links.In(tx).Save(&s)
 	return err
 }
 
@@ -172,18 +199,27 @@ func countHits(tde *kv.TiedotEngine) {
 	for {
 		key = <-hits
 		newHitCount := incrHits(tde, key)
-		log.V(3).Infof("[HIT]: key=%s count=%d", key, newHitCount)
+		log.V(3).Every(100).Infof("[HIT]: key=%s count=%d", key, newHitCount)
 	}
 }
 
-func NewShortener(tde *kv.TiedotEngine) *martini.Martini {
-	flag.Parse()
+func NewShortener(tde *kv.TiedotEngine, conf *Config) *martini.Martini {
 	app := martini.New()
 
+	app.Use(reqlog.Map)
 	app.Map(tde)
+	app.Map(conf)
+
+	health.Register("short", func() error {
+		return tde.Check(urlCollection, counterCollection)
+	})
 
 	go countHits(tde)
 
+	c := newCache(conf.CacheSize, conf.CacheTTL)
+	go c.follow(tde)
+	app.Map(c)
+
 	r := martini.NewRouter()
 	r.Get("/", root)
 	r.Post("/", newShort)
@@ -0,0 +1,146 @@
+package short
+
+import (
+	"encoding/json"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testEngine(t *testing.T) (*kv.TiedotEngine, func()) {
+	dir, err := ioutil.TempDir("", "short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tde := kv.NewTiedotEngine(dir, nil, kv.KeepIfExist)
+	if _, err := tde.Reconcile(Collections, false); err != nil {
+		t.Fatal(err)
+	}
+	return tde, func() { os.RemoveAll(dir) }
+}
+
+func post(tde *kv.TiedotEngine, conf *Config, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	newShort(w, r, tde, conf, log.With())
+	return w
+}
+
+func count(t *testing.T, tde *kv.TiedotEngine) int64 {
+	var c Counter
+	_, err := tde.Query(counterCollection).Has(kv.Path{"Count"}).OneInto(&c)
+	if err == kv.ErrNotFound {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return c.Count
+}
+
+func TestNewShort(t *testing.T) {
+	tde, done := testEngine(t)
+	defer done()
+	conf := &Config{Base: "http://lws.example.com/", Slugs: SequentialSlugs}
+
+	// a link from before a switch of schemes holds slug 2
+	if _, err := tde.Insert(urlCollection, Shortened{Original: "http://old.example.com", Short: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int64{1, 3} {
+		w := post(tde, conf, `{"url":"example.com"}`)
+		var got Shortened
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+		}
+		if got.Short != want || got.Original != "http://example.com" {
+			t.Errorf("got %+v, want Short=%d", got, want)
+		}
+	}
+	if c := count(t, tde); c != 3 {
+		t.Errorf("counter=%d, want 3", c)
+	}
+}
+
+// Test that a failure after taking a counter value gives it back.
+func TestNewShortRollsBack(t *testing.T) {
+	tde, done := testEngine(t)
+	defer done()
+	conf := &Config{Base: "http://lws.example.com/", Slugs: SequentialSlugs}
+	for n := int64(1); n <= maxSlugAttempts; n++ {
+		if _, err := tde.Insert(urlCollection, Shortened{Original: "http://old.example.com", Short: n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := post(tde, conf, `{"url":"example.com"}`)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "Duplicate") {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	if c := count(t, tde); c != 0 {
+		t.Errorf("counter=%d after a failed create, want 0", c)
+	}
+	all, err := tde.All(urlCollection)
+	if err != nil || len(all) != maxSlugAttempts {
+		t.Errorf("links=%d err=%v, want %d", len(all), err, maxSlugAttempts)
+	}
+}
+
+func TestSearchLinks(t *testing.T) {
+	tde, done := testEngine(t)
+	defer done()
+	for i, u := range []string{"http://example.com/docs/searching", "http://example.com/blog", "http://search.example.org/"} {
+		if _, err := tde.Insert(urlCollection, Shortened{Original: u, Short: int64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err := searchLinks(links.Repo(tde), "search example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("found %+v, want 2 links", found)
+	}
+	// the shorter destination ranks first
+	if found[0].Short != 3 || found[1].Short != 1 {
+		t.Errorf("found %+v, want Short 3 then 1", found)
+	}
+}
+
+// Test that admin edits and hit counts made together both stick.
+func TestSetOriginalWithHits(t *testing.T) {
+	tde, done := testEngine(t)
+	defer done()
+	if _, err := tde.Insert(urlCollection, Shortened{Original: "http://old.example.com", Short: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			incrHits(tde, "1")
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := setOriginal("1", "http://new.example.com", tde); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	var got Shortened
+	if err := findShort("1", links.Repo(tde), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Original != "http://new.example.com" || got.HitCount != 100 {
+		t.Errorf("got %+v, want the new URL with 100 hits", got)
+	}
+	if err := setOriginal("2", "http://new.example.com", tde); err != kv.ErrNotFound {
+		t.Errorf("err=%v for a missing link, want kv.ErrNotFound", err)
+	}
+}
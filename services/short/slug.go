@@ -0,0 +1,100 @@
+package short
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist/kv"
+)
+
+// maxSlugAttempts bounds the retries when a generated slug is taken.
+const maxSlugAttempts = 16
+
+var errSlugsExhausted = errors.New("legowebservices/short: Could not find a free slug")
+
+// nextShort picks the number behind a new short URL according to
+// conf.Slugs. Slugs are always the base62 encoding of that number, so lookups
+// don't care which scheme produced them.
+func nextShort(tx *kv.Tx, conf *Config) (int64, error) {
+	switch conf.Slugs {
+	case FeistelSlugs:
+		f := newFeistel([]byte(conf.SlugKey), conf.SlugBits)
+		for i := 0; i < maxSlugAttempts; i++ {
+			count, err := incrCount(tx)
+			if err != nil {
+				return 0, err
+			}
+			if uint64(count) > f.mask {
+				return 0, fmt.Errorf("legowebservices/short: Counter %d does not fit in %d bit slugs", count, conf.SlugBits)
+			}
+			// slugs made before switching schemes may already use this number
+			if n := int64(f.permute(uint64(count))); !shortExists(n, tx) {
+				return n, nil
+			}
+			log.V(2).Infof("Permuted slug taken count=%d, skipping", count)
+		}
+		return 0, errSlugsExhausted
+	case RandomSlugs:
+		var b [8]byte
+		for i := 0; i < maxSlugAttempts; i++ {
+			if _, err := rand.Read(b[:]); err != nil {
+				return 0, err
+			}
+			n := int64(binary.BigEndian.Uint64(b[:]) & (1<<conf.SlugBits - 1))
+			if !shortExists(n, tx) {
+				return n, nil
+			}
+			log.V(2).Infof("Random slug taken n=%d, retrying", n)
+		}
+		return 0, errSlugsExhausted
+	}
+	return incrCount(tx)
+}
+
+func shortExists(n int64, tx *kv.Tx) bool {
+	err := links.In(tx).FindOne(new(Shortened), "Short", n)
+	return err != kv.ErrNotFound
+}
+
+// feistel is a keyed permutation of the numbers below 2**bits, built as a
+// balanced Feistel network with HMAC-SHA256 as the round function.
+type feistel struct {
+	key  []byte
+	half uint
+	mask uint64 // 2**bits - 1
+}
+
+const feistelRounds = 4
+
+func newFeistel(key []byte, bits uint) *feistel {
+	return &feistel{key: key, half: bits / 2, mask: 1<<bits - 1}
+}
+
+func (f *feistel) round(i byte, r uint64) uint64 {
+	var msg [9]byte
+	msg[0] = i
+	binary.BigEndian.PutUint64(msg[1:], r)
+	h := hmac.New(sha256.New, f.key)
+	h.Write(msg[:])
+	return binary.BigEndian.Uint64(h.Sum(nil)) & (1<<f.half - 1)
+}
+
+func (f *feistel) permute(x uint64) uint64 {
+	l, r := x>>f.half, x&(1<<f.half-1)
+	for i := byte(0); i < feistelRounds; i++ {
+		l, r = r, l^f.round(i, r)
+	}
+	return l<<f.half | r
+}
+
+func (f *feistel) invert(y uint64) uint64 {
+	l, r := y>>f.half, y&(1<<f.half-1)
+	for i := byte(feistelRounds); i > 0; i-- {
+		l, r = r^f.round(i-1, l), l
+	}
+	return l<<f.half | r
+}
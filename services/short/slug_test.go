@@ -0,0 +1,69 @@
+package short
+
+import (
+	"testing"
+)
+
+func TestFeistelPermutes(t *testing.T) {
+	f := newFeistel([]byte("0123456789abcdef"), 16)
+	seen := make(map[uint64]bool, 1<<16)
+	inOrder := 0
+	for x := uint64(0); x < 1<<16; x++ {
+		y := f.permute(x)
+		if y > f.mask {
+			t.Fatalf("permute(%d)=%d is outside the domain", x, y)
+		}
+		if seen[y] {
+			t.Fatalf("permute(%d)=%d collides", x, y)
+		}
+		seen[y] = true
+		if f.invert(y) != x {
+			t.Fatalf("invert(permute(%d))=%d", x, f.invert(y))
+		}
+		if y == x+1 {
+			inOrder++
+		}
+	}
+	if inOrder > 16 {
+		t.Errorf("%d consecutive counters map to consecutive slugs", inOrder)
+	}
+}
+
+func TestFeistelKeyed(t *testing.T) {
+	a := newFeistel([]byte("0123456789abcdef"), 40)
+	b := newFeistel([]byte("fedcba9876543210"), 40)
+	same := 0
+	for x := uint64(1); x <= 100; x++ {
+		if a.permute(x) == b.permute(x) {
+			same++
+		}
+	}
+	if same > 1 {
+		t.Errorf("%d of 100 slugs are the same under different keys", same)
+	}
+}
+
+func TestValidateSlugs(t *testing.T) {
+	for _, c := range []struct {
+		slugs, key string
+		bits       uint
+		ok         bool
+	}{
+		{SequentialSlugs, "", 0, true},
+		{RandomSlugs, "", 40, true},
+		{RandomSlugs, "", 8, false},
+		{RandomSlugs, "", 52, true},
+		{RandomSlugs, "", 53, false},
+		{FeistelSlugs, "0123456789abcdef", 40, true},
+		{FeistelSlugs, "short", 40, false},
+		{FeistelSlugs, "0123456789abcdef", 41, false},
+		{FeistelSlugs, "0123456789abcdef", 52, true},
+		{FeistelSlugs, "0123456789abcdef", 54, false},
+		{"hashids", "", 40, false},
+	} {
+		conf := &Config{Base: "http://lws.example.com/s/", Slugs: c.slugs, SlugKey: c.key, SlugBits: c.bits}
+		if err := conf.Validate(); (err == nil) != c.ok {
+			t.Errorf("slugs=%s key=%q bits=%d: err=%v, want ok=%v", c.slugs, c.key, c.bits, err, c.ok)
+		}
+	}
+}
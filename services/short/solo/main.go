@@ -1,17 +1,45 @@
 package main
 
 import (
-	"flag"
+	"github.com/codegangsta/martini"
+	"github.com/ryansb/legowebservices/config"
 	"github.com/ryansb/legowebservices/log"
+	"github.com/ryansb/legowebservices/persist"
+	"github.com/ryansb/legowebservices/persist/kv"
+	"github.com/ryansb/legowebservices/reqlog"
 	"github.com/ryansb/legowebservices/services/short"
 	"net/http"
 )
 
-var port = flag.String("p", ":3000", "Port you want to listen on, defaults to 3000")
+type soloConfig struct {
+	Port string `config:"port" flag:"p" usage:"Port you want to listen on, defaults to 3000"`
+	DB   string `config:"db" usage:"Directory holding the tiedot database"`
+}
+
+var solo = &soloConfig{
+	Port: ":3000",
+	DB:   "./tiedotdb",
+}
+
+func init() {
+	config.Register("", solo)
+}
 
 func main() {
 	log.DevelDefaults()
-	flag.Parse()
-	m := short.NewShortener()
-	http.ListenAndServe(*port, m)
+	err := config.Parse()
+	log.FatalIfErr(err, "Failure loading configuration err:")
+	tde := kv.NewTiedotEngine(solo.DB, nil, kv.KeepIfExist)
+	var specs []kv.CollectionSpec
+	specs = append(specs, persist.Collections...)
+	specs = append(specs, short.Collections...)
+	_, err = tde.Reconcile(specs, false)
+	log.FatalIfErr(err, "Failure setting up collections err:")
+	_, err = persist.Migrate(tde, false)
+	log.FatalIfErr(err, "Failure migrating the database err:")
+	m := martini.New()
+	m.Use(reqlog.Logger())
+	m.Use(martini.Recovery())
+	m.Action(short.NewShortener(tde, short.Conf).ServeHTTP)
+	http.ListenAndServe(solo.Port, m)
 }